@@ -1 +1,189 @@
 package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/rabbitprincess/eth-indexer/indexer"
+	"github.com/rabbitprincess/eth-indexer/indexer/db"
+	"github.com/rabbitprincess/eth-indexer/indexer/schema"
+	"github.com/rs/zerolog/log"
+)
+
+func main() {
+	var (
+		executionURL = flag.String("execution", os.Getenv("EXECUTION_URL"), "execution client rpc url, comma separated with one url per network")
+		beaconURL    = flag.String("beacon", os.Getenv("BEACON_URL"), "beacon client url, comma separated with one url per network")
+		dbURL        = flag.String("db", os.Getenv("ELASTICSEARCH_URL"), "database url: elasticsearch url, postgres://, sqlite:// or *.db, pebble:// or memory://")
+		network      = flag.String("network", "mainnet", "network name, selects the prealloc in indexer/allocs, comma separated to index several networks concurrently")
+		indexPrefix  = flag.String("index-prefix", "", "prefix of the indices, comma separated with one prefix per network, defaults to the network name and an underscore, set it empty to keep the unprefixed indices of earlier versions, see README")
+		from         = flag.Uint64("from", 0, "first block to index")
+		to           = flag.Uint64("to", 0, "last block to index, 0 follows the chain head")
+		verify       = flag.Bool("verify", false, "verify indexed balances against the execution client")
+		verifyTokens = flag.Bool("verify-tokens", false, "verify indexed token balances against the balanceOf of their tokens")
+		cacheSize    = flag.Int("cache", 0, "number of account balances cached across blocks")
+		dryRun       = flag.Bool("dry-run", false, "index into memory and print the documents instead of persisting them")
+		migrate      = flag.Bool("migrate", false, "migrate the indices to the schema version of this build and exit")
+		reindex      = flag.Bool("reindex", false, "rebuild the indices into new versioned indices while indexing and swap the aliases once they caught up")
+
+		partition       = flag.String("history-partition", "", "partition the balance change history of elasticsearch into indices of a block range, a month or by ILM rollover: blocks, month or rollover")
+		partitionBlocks = flag.Uint64("history-partition-blocks", 1000000, "number of blocks of a history partition")
+		shards          = flag.Int("history-shards", 0, "number of shards of a history partition, 0 keeps the cluster default")
+		replicas        = flag.Int("history-replicas", 0, "number of replicas of a history partition, 0 keeps the cluster default")
+		rolloverSize    = flag.String("history-rollover-max-size", "50gb", "primary shard size rolling over a history partition")
+		rolloverDocs    = flag.Int64("history-rollover-max-docs", 0, "number of documents rolling over a history partition")
+		rolloverAge     = flag.String("history-rollover-max-age", "", "age rolling over a history partition")
+	)
+	flag.Parse()
+
+	networks := strings.Split(*network, ",")
+	executionURLs := perNetwork("execution", *executionURL, len(networks))
+	beaconURLs := perNetwork("beacon", *beaconURL, len(networks))
+	prefixes := make([]string, len(networks))
+	for i, name := range networks {
+		prefixes[i] = schema.IndexPrefix(name)
+	}
+	var prefixSet bool
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "index-prefix" {
+			prefixes, prefixSet = perNetwork("index-prefix", *indexPrefix, len(networks)), true
+		}
+	})
+	for i := range prefixes {
+		if slices.Contains(prefixes[:i], prefixes[i]) {
+			log.Fatal().Str("prefix", prefixes[i]).Msg("networks need distinct index prefixes")
+		}
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	if *dryRun {
+		*dbURL = "memory://"
+	}
+	controller, err := db.NewDbController(ctx, &log.Logger, *dbURL)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to connect to database")
+	}
+	if !prefixSet {
+		checkUnprefixedIndices(controller, prefixes)
+	}
+	esdb, isES := controller.(*db.EsDBController)
+	if *partition != "" {
+		if !isES {
+			log.Fatal().Msg("history partitioning only applies to elasticsearch")
+		}
+		for _, prefix := range prefixes {
+			err = esdb.SetPartitioning(prefix+schema.TableBalanceChangeHistory, schema.TableBalanceChangeHistory, db.Partitioning{
+				Mode:            db.PartitionMode(*partition),
+				Blocks:          *partitionBlocks,
+				Shards:          *shards,
+				Replicas:        *replicas,
+				RolloverMaxSize: *rolloverSize,
+				RolloverMaxDocs: *rolloverDocs,
+				RolloverMaxAge:  *rolloverAge,
+			})
+			if err != nil {
+				log.Fatal().Err(err).Msg("failed to partition history")
+			}
+		}
+	} else if isES {
+		// a history partitioned by an earlier run keeps its partitioning, persisted in its index template
+		for _, prefix := range prefixes {
+			if _, err = esdb.RestorePartitioning(prefix+schema.TableBalanceChangeHistory, schema.TableBalanceChangeHistory); err != nil {
+				log.Fatal().Err(err).Msg("failed to restore history partitioning")
+			}
+		}
+	}
+
+	if *migrate {
+		for _, prefix := range prefixes {
+			if err = indexer.Migrate(ctx, &log.Logger, controller, prefix); err != nil {
+				log.Fatal().Err(err).Str("prefix", prefix).Msg("failed to migrate schema")
+			}
+		}
+		return
+	}
+
+	// every network runs its own indexer on the shared database
+	var reindexVersion string
+	if *reindex {
+		reindexVersion = fmt.Sprintf("v%d", time.Now().Unix())
+	}
+	var wg sync.WaitGroup
+	var failed atomic.Bool
+	for i, name := range networks {
+		logger := log.With().Str("network", name).Logger()
+		idx, err := indexer.NewIndexer(ctx, &logger, executionURLs[i], beaconURLs[i], controller, prefixes[i])
+		if err != nil {
+			logger.Fatal().Err(err).Msg("failed to create indexer")
+		}
+		wg.Add(1)
+		go func(cfg *indexer.RunConfig) {
+			defer wg.Done()
+			if err := idx.Run(ctx, cfg); err != nil {
+				logger.Error().Err(err).Msg("indexer stopped")
+				failed.Store(true)
+			}
+		}(&indexer.RunConfig{
+			NetworkName:        name,
+			VerifyBalance:      *verify,
+			VerifyTokenBalance: *verifyTokens,
+			From:               *from,
+			To:                 *to,
+			BalanceCacheSize:   *cacheSize,
+			ReindexVersion:     reindexVersion,
+		})
+	}
+	wg.Wait()
+
+	if memory, ok := controller.(*db.MemoryDBController); ok && *dryRun {
+		if err := memory.Dump(os.Stdout); err != nil {
+			log.Fatal().Err(err).Msg("failed to dump documents")
+		}
+	}
+	if failed.Load() {
+		os.Exit(1)
+	}
+}
+
+// checkUnprefixedIndices refuses to start on the unprefixed indices of versions before the network prefix, the
+// default prefixes would index the networks from genesis again beside them. See README on migrating them.
+// Counting a missing index creates nothing, the probe leaves no unprefixed index behind.
+func checkUnprefixedIndices(controller db.DbController, prefixes []string) {
+	count, err := controller.Count(db.QueryParams{IndexName: schema.TableAccountBalance})
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to look for unprefixed indices")
+	} else if count == 0 {
+		return
+	}
+	for _, prefix := range prefixes {
+		count, err = controller.Count(db.QueryParams{IndexName: prefix + schema.TableAccountBalance})
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to look for unprefixed indices")
+		} else if count == 0 {
+			log.Fatal().Str("prefix", prefix).Msg("found the unprefixed indices of an earlier version, set -index-prefix= to keep indexing into them or move them under the prefix")
+		}
+	}
+}
+
+// perNetwork splits a comma separated flag into one value per network, an empty value is shared by all networks
+func perNetwork(name string, value string, networks int) []string {
+	if value == "" {
+		return make([]string, networks)
+	}
+	values := strings.Split(value, ",")
+	if len(values) != networks {
+		log.Fatal().Str("flag", name).Int("values", len(values)).Int("networks", networks).Msg("flag needs one value per network")
+	}
+	return values
+}
@@ -0,0 +1,73 @@
+package indexer
+
+import (
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/rabbitprincess/eth-indexer/indexer/client"
+	"github.com/rabbitprincess/eth-indexer/indexer/db"
+	"github.com/rabbitprincess/eth-indexer/indexer/schema"
+)
+
+// ApplyWithdrawals credits the withdrawals of the consensus layer of the current block to their addresses
+func (d *DTO) ApplyWithdrawals(withdrawals []*types.Withdrawal, dbController db.DbController, client *client.Client) error {
+	accounts := make([]string, len(withdrawals))
+	for i, withdrawal := range withdrawals {
+		accounts[i] = strings.ToLower(withdrawal.Address.Hex())
+	}
+	err := d.PrefetchAccountBalance(accounts, dbController)
+	if err != nil {
+		return err
+	}
+
+	for i, withdrawal := range withdrawals {
+		if withdrawal.Amount == 0 {
+			continue
+		}
+		amount := new(big.Int).Mul(new(big.Int).SetUint64(withdrawal.Amount), big.NewInt(params.GWei))
+		// withdrawals are applied after the transactions of the block
+		err = d.addBalanceDelta(accounts[i], "", amount, schema.StakingWithdrawal, "", 0, "withdrawal."+strconv.FormatUint(withdrawal.Index, 10), dbController, client)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddBlock records the header of the current block with the totals of the balance changes applied so far,
+// it is called once the traces, withdrawals and transactions of the block are applied
+func (d *DTO) AddBlock(block *client.Block) {
+	d.block = &schema.Block{
+		BaseEsType:      &schema.BaseEsType{Id: schema.BlockID(d.blockNumber)},
+		BlockNumber:     d.blockNumber,
+		BlockTimestamp:  d.blockTimestamp,
+		Hash:            strings.ToLower(block.Hash),
+		ParentHash:      strings.ToLower(block.ParentHash),
+		Miner:           strings.ToLower(block.Miner),
+		GasUsed:         uint64(block.GasUsed),
+		GasLimit:        uint64(block.GasLimit),
+		TxCount:         uint64(len(block.Transactions)),
+		WithdrawalCount: uint64(len(block.Withdrawals)),
+	}
+
+	// the base fee of the gas used and the blob fees of the transactions are burnt, the price of blob gas is taken
+	// from the receipts as it depends on the fork of the block
+	burn := new(big.Int)
+	if block.BaseFeePerGas != nil {
+		baseFee := block.BaseFeePerGas.ToInt()
+		d.block.BaseFeePerGas = baseFee.String()
+		burn.Mul(baseFee, new(big.Int).SetUint64(uint64(block.GasUsed)))
+	}
+	if block.BlobGasUsed != nil && block.ExcessBlobGas != nil {
+		d.block.BlobGasUsed, d.block.ExcessBlobGas = uint64(*block.BlobGasUsed), uint64(*block.ExcessBlobGas)
+	}
+	for _, transaction := range d.transactions {
+		if blobFee, ok := new(big.Int).SetString(transaction.BlobFee, 10); ok {
+			burn.Add(burn, blobFee)
+		}
+	}
+	d.block.SetTotals(d.issuance.String(), burn.String(), d.transferVolume.String())
+}
@@ -0,0 +1,68 @@
+package indexer
+
+import (
+	"github.com/ethereum/go-ethereum/common/lru"
+	"github.com/rabbitprincess/eth-indexer/indexer/schema"
+)
+
+const defaultBalanceCacheSize = 100000
+
+// BalanceCache keeps the latest committed balance of recently touched accounts across blocks
+type BalanceCache struct {
+	cache  lru.BasicLRU[string, *schema.AccountBalance]
+	hits   uint64
+	misses uint64
+}
+
+func NewBalanceCache(size int) *BalanceCache {
+	if size <= 0 {
+		size = defaultBalanceCacheSize
+	}
+	return &BalanceCache{
+		cache: lru.NewBasicLRU[string, *schema.AccountBalance](size),
+	}
+}
+
+// Get returns the cached balance of account and records a hit or a miss
+func (c *BalanceCache) Get(account string) (*schema.AccountBalance, bool) {
+	balance, ok := c.cache.Get(account)
+	if ok {
+		c.hits++
+	} else {
+		c.misses++
+	}
+	return balance, ok
+}
+
+// Peek returns the cached balance of account without recording a hit or a miss or refreshing its recency
+func (c *BalanceCache) Peek(account string) (*schema.AccountBalance, bool) {
+	return c.cache.Peek(account)
+}
+
+// Contains reports whether account is cached without recording a hit or a miss
+func (c *BalanceCache) Contains(account string) bool {
+	return c.cache.Contains(account)
+}
+
+// Add caches a committed balance, evicting the least recently used account when full
+func (c *BalanceCache) Add(balance *schema.AccountBalance) {
+	c.cache.Add(balance.Account, balance)
+}
+
+// Purge drops every cached balance, it must be called when committed blocks are rolled back
+func (c *BalanceCache) Purge() {
+	c.cache.Purge()
+}
+
+// Stats returns the number of hits and misses and the hit rate since the cache was created
+func (c *BalanceCache) Stats() (hits uint64, misses uint64, hitRate float64) {
+	if total := c.hits + c.misses; total > 0 {
+		hitRate = float64(c.hits) / float64(total)
+	}
+	return c.hits, c.misses, hitRate
+}
+
+// Len returns the number of cached accounts
+func (c *BalanceCache) Len() int {
+	return c.cache.Len()
+}
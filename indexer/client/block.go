@@ -0,0 +1,55 @@
+package client
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// Block is a block of eth_getBlockByNumber with its transactions.
+// It is decoded from the raw response so that unknown transaction types do not fail the block.
+type Block struct {
+	Number        hexutil.Uint64      `json:"number"`
+	Hash          string              `json:"hash"`
+	ParentHash    string              `json:"parentHash"`
+	Timestamp     hexutil.Uint64      `json:"timestamp"`
+	Miner         string              `json:"miner"`
+	BaseFeePerGas *hexutil.Big        `json:"baseFeePerGas"` // nil before london
+	GasUsed       hexutil.Uint64      `json:"gasUsed"`
+	GasLimit      hexutil.Uint64      `json:"gasLimit"`
+	BlobGasUsed   *hexutil.Uint64     `json:"blobGasUsed"`   // nil before cancun
+	ExcessBlobGas *hexutil.Uint64     `json:"excessBlobGas"` // nil before cancun
+	Transactions  []*Transaction      `json:"transactions"`
+	Withdrawals   []*types.Withdrawal `json:"withdrawals"` // nil before shanghai
+}
+
+// Transaction is a transaction of a block, fields of later transaction types are nil for earlier types
+type Transaction struct {
+	Hash                 string         `json:"hash"`
+	TransactionIndex     hexutil.Uint64 `json:"transactionIndex"`
+	Type                 hexutil.Uint64 `json:"type"`
+	From                 string         `json:"from"`
+	To                   string         `json:"to"` // empty for contract creations
+	Value                hexutil.Big    `json:"value"`
+	Nonce                hexutil.Uint64 `json:"nonce"`
+	Gas                  hexutil.Uint64 `json:"gas"`
+	GasPrice             *hexutil.Big   `json:"gasPrice"`
+	MaxFeePerGas         *hexutil.Big   `json:"maxFeePerGas"`
+	MaxPriorityFeePerGas *hexutil.Big   `json:"maxPriorityFeePerGas"`
+	MaxFeePerBlobGas     *hexutil.Big   `json:"maxFeePerBlobGas"`
+}
+
+// GetBlock returns the block of blockNumber, its Timestamp is in seconds
+func (c *Client) GetBlock(ctx context.Context, blockNumber uint64) (*Block, error) {
+	var block *Block
+	err := c.execution.Client().CallContext(ctx, &block, "eth_getBlockByNumber", hexutil.EncodeUint64(blockNumber), true)
+	if err != nil {
+		return nil, err
+	}
+	if block == nil {
+		return nil, fmt.Errorf("block %d not found", blockNumber)
+	}
+	return block, nil
+}
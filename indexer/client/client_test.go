@@ -64,3 +64,56 @@ func TestBalanceOf(t *testing.T) {
 
 	fmt.Println(hex.EncodeToString(balance.Bytes()))
 }
+
+// newReachableClient connects to rpcUrl, skipping the test when the node is unreachable
+func newReachableClient(t *testing.T) *Client {
+	ctx := context.Background()
+	client, err := NewClient(ctx, nil, rpcUrl, beaconUrl)
+	if err == nil {
+		_, err = client.GetLatestBlockNumber(ctx)
+	}
+	if err != nil {
+		t.Skipf("rpc %s unreachable: %v", rpcUrl, err)
+	}
+	return client
+}
+
+func TestGetBlock(t *testing.T) {
+	ctx := context.Background()
+	client := newReachableClient(t)
+
+	block, err := client.GetBlock(ctx, 656270)
+	require.NoError(t, err)
+	require.EqualValues(t, 656270, block.Number)
+	require.NotEmpty(t, block.Hash)
+	require.NotEmpty(t, block.Miner)
+	require.NotZero(t, block.Timestamp)
+	require.NotNil(t, block.BaseFeePerGas) // london
+	require.NotNil(t, block.Withdrawals)   // shanghai
+	require.Equal(t, block.BlobGasUsed == nil, block.ExcessBlobGas == nil)
+	for i, tx := range block.Transactions {
+		require.EqualValues(t, i, tx.TransactionIndex)
+		require.NotEmpty(t, tx.Hash)
+		require.NotEmpty(t, tx.From)
+		require.NotNil(t, tx.GasPrice)
+	}
+}
+
+func TestGetBlockReceipts(t *testing.T) {
+	ctx := context.Background()
+	client := newReachableClient(t)
+
+	block, err := client.GetBlock(ctx, 656270)
+	require.NoError(t, err)
+	receipts, err := client.GetBlockReceipts(ctx, 656270)
+	require.NoError(t, err)
+	require.Len(t, receipts, len(block.Transactions))
+	for i, receipt := range receipts {
+		require.Equal(t, block.Transactions[i].Hash, receipt.TransactionHash)
+		require.EqualValues(t, i, receipt.TransactionIndex)
+		require.NotNil(t, receipt.Status) // byzantium
+		require.NotNil(t, receipt.EffectiveGasPrice)
+		require.NotZero(t, receipt.GasUsed)
+		require.Equal(t, receipt.BlobGasUsed == nil, receipt.BlobGasPrice == nil)
+	}
+}
@@ -5,12 +5,19 @@ import (
 	"math/big"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
 )
 
 func (c *Client) GetLatestBlockNumber(ctx context.Context) (uint64, error) {
 	return c.execution.BlockNumber(ctx)
 }
 
+// GetBlockHeader returns the header of a block, its Time is in seconds
+func (c *Client) GetBlockHeader(ctx context.Context, blockNumber uint64) (*types.Header, error) {
+	return c.execution.HeaderByNumber(ctx, new(big.Int).SetUint64(blockNumber))
+}
+
 func (c *Client) GetAccountBalance(ctx context.Context, account string, blockNumber uint64) (*big.Int, error) {
 	acc := common.HexToAddress(account)
 	num := big.NewInt(int64(blockNumber))
@@ -22,6 +29,15 @@ func (c *Client) GetAccountBalance(ctx context.Context, account string, blockNum
 	return balance, nil
 }
 
+// HasCode reports whether a contract has code at the state after blockNumber
+func (c *Client) HasCode(ctx context.Context, contract string, blockNumber uint64) (bool, error) {
+	code, err := c.execution.CodeAt(ctx, common.HexToAddress(contract), new(big.Int).SetUint64(blockNumber))
+	if err != nil {
+		return false, err
+	}
+	return len(code) > 0, nil
+}
+
 func (c *Client) TraceTransaction(ctx context.Context, txHash string) (interface{}, error) {
 	var result interface{}
 	err := c.execution.Client().CallContext(ctx, &result, "trace_transaction", txHash, nil)
@@ -32,9 +48,9 @@ func (c *Client) TraceTransaction(ctx context.Context, txHash string) (interface
 	return result, nil
 }
 
-func (c *Client) TraceBlock(ctx context.Context, blockNumber uint64) (interface{}, error) {
-	var result interface{}
-	err := c.execution.Client().CallContext(ctx, &result, "trace_block", blockNumber, nil)
+func (c *Client) TraceBlock(ctx context.Context, blockNumber uint64) ([]TraceBlock, error) {
+	var result []TraceBlock
+	err := c.execution.Client().CallContext(ctx, &result, "trace_block", hexutil.EncodeUint64(blockNumber))
 	if err != nil {
 		return nil, err
 	}
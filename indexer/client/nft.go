@@ -0,0 +1,45 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+var (
+	// selector of ownerOf(uint256) of ERC-721
+	ownerOfSelector = common.FromHex("0x6352211e")
+	// selector of balanceOf(address,uint256) of ERC-1155
+	balanceOfIdSelector = common.FromHex("0x00fdd58e")
+)
+
+// GetNftOwner returns the ownerOf an ERC-721 token id at the state after blockNumber,
+// the call reverts for token ids which do not exist, see IsExecutionError
+func (c *Client) GetNftOwner(ctx context.Context, contract string, tokenID *big.Int, blockNumber uint64) (string, error) {
+	data := append(append([]byte{}, ownerOfSelector...), common.BigToHash(tokenID).Bytes()...)
+	output, err := c.Call(ctx, contract, data, blockNumber)
+	if err != nil {
+		return "", err
+	}
+	if len(output) < 32 {
+		return "", fmt.Errorf("token %s owner of %s: %w", contract, tokenID, ErrNoOutput)
+	}
+	return strings.ToLower(common.BytesToAddress(output[:32]).Hex()), nil
+}
+
+// GetNftBalance returns the balanceOf an ERC-1155 token id of a holder at the state after blockNumber
+func (c *Client) GetNftBalance(ctx context.Context, contract string, holder string, tokenID *big.Int, blockNumber uint64) (*big.Int, error) {
+	data := append(append([]byte{}, balanceOfIdSelector...), common.LeftPadBytes(common.HexToAddress(holder).Bytes(), 32)...)
+	data = append(data, common.BigToHash(tokenID).Bytes()...)
+	output, err := c.Call(ctx, contract, data, blockNumber)
+	if err != nil {
+		return nil, err
+	}
+	if len(output) < 32 {
+		return nil, fmt.Errorf("token %s balance of %s of %s: %w", contract, tokenID, holder, ErrNoOutput)
+	}
+	return new(big.Int).SetBytes(output[:32]), nil
+}
@@ -0,0 +1,42 @@
+package client
+
+import (
+	"context"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+// Receipt is the receipt of a transaction, fields introduced by later forks are nil for earlier blocks
+type Receipt struct {
+	TransactionHash   string          `json:"transactionHash"`
+	TransactionIndex  hexutil.Uint64  `json:"transactionIndex"`
+	Status            *hexutil.Uint64 `json:"status"` // nil before byzantium
+	GasUsed           hexutil.Uint64  `json:"gasUsed"`
+	EffectiveGasPrice *hexutil.Big    `json:"effectiveGasPrice"`
+	ContractAddress   string          `json:"contractAddress"` // empty unless the transaction created a contract
+	BlobGasUsed       *hexutil.Uint64 `json:"blobGasUsed"`
+	BlobGasPrice      *hexutil.Big    `json:"blobGasPrice"`
+	Logs              []*Log          `json:"logs"`
+}
+
+// Log is an event emitted by a transaction, the first topic is the hash of the event signature
+type Log struct {
+	Address          string         `json:"address"`
+	Topics           []string       `json:"topics"`
+	Data             hexutil.Bytes  `json:"data"`
+	LogIndex         hexutil.Uint64 `json:"logIndex"`
+	TransactionHash  string         `json:"transactionHash"`
+	TransactionIndex hexutil.Uint64 `json:"transactionIndex"`
+	Removed          bool           `json:"removed"`
+}
+
+// GetBlockReceipts returns the receipts of the transactions of a block in their order
+func (c *Client) GetBlockReceipts(ctx context.Context, blockNumber uint64) ([]*Receipt, error) {
+	var result []*Receipt
+	err := c.execution.Client().CallContext(ctx, &result, "eth_getBlockReceipts", hexutil.EncodeUint64(blockNumber))
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
@@ -0,0 +1,148 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+var (
+	// selector of balanceOf(address)
+	balanceOfSelector = common.FromHex("0x70a08231")
+	// selectors of the optional metadata functions of ERC-20, name and symbol also of ERC-721
+	nameSelector        = common.FromHex("0x06fdde03")
+	symbolSelector      = common.FromHex("0x95d89b41")
+	decimalsSelector    = common.FromHex("0x313ce567")
+	totalSupplySelector = common.FromHex("0x18160ddd")
+)
+
+// ErrNoOutput is returned by calls of a function which returned less than its result, the contract lacks the function
+var ErrNoOutput = errors.New("call returned no output")
+
+// TokenMetadata is the metadata a token contract reports, functions it does not implement leave their field empty
+type TokenMetadata struct {
+	Name        string
+	Symbol      string
+	Decimals    *uint8
+	TotalSupply *big.Int
+}
+
+// Call executes a call of a contract at the state after blockNumber and returns its output
+func (c *Client) Call(ctx context.Context, contract string, data []byte, blockNumber uint64) ([]byte, error) {
+	to := common.HexToAddress(contract)
+	return c.execution.CallContract(ctx, ethereum.CallMsg{To: &to, Data: data}, new(big.Int).SetUint64(blockNumber))
+}
+
+// executionErrors are the messages of the errors of the evm which nodes return for a call failing in execution,
+// code 3 (execution reverted) aside, like the invalid opcode pre-0.4.10 contracts throw for a missing function
+var executionErrors = []string{
+	vm.ErrExecutionReverted.Error(),
+	vm.ErrOutOfGas.Error(),
+	vm.ErrInvalidJump.Error(),
+	vm.ErrDepth.Error(),
+	vm.ErrWriteProtection.Error(),
+	vm.ErrReturnDataOutOfBounds.Error(),
+	vm.ErrGasUintOverflow.Error(),
+	"invalid opcode",
+	"stack underflow",
+	"stack limit reached",
+}
+
+// IsExecutionError reports whether a call failed in the execution of the contract, as when it reverts or lacks the
+// function, rather than in the transport or the node. The node answered such a call with an error of its own.
+func IsExecutionError(err error) bool {
+	var rpcErr rpc.Error
+	if !errors.As(err, &rpcErr) {
+		return false
+	}
+	// 3 is returned by geth for reverts, -32015 by nethermind for every execution error
+	if code := rpcErr.ErrorCode(); code == 3 || code == -32015 {
+		return true
+	}
+	message := strings.ToLower(rpcErr.Error())
+	for _, executionError := range executionErrors {
+		if strings.Contains(message, executionError) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetTokenBalance returns the balanceOf an ERC-20 token holder at the state after blockNumber
+func (c *Client) GetTokenBalance(ctx context.Context, token string, holder string, blockNumber uint64) (*big.Int, error) {
+	data := append(append([]byte{}, balanceOfSelector...), common.LeftPadBytes(common.HexToAddress(holder).Bytes(), 32)...)
+	output, err := c.Call(ctx, token, data, blockNumber)
+	if err != nil {
+		return nil, err
+	}
+	if len(output) < 32 {
+		return nil, fmt.Errorf("token %s balance of %s: %w", token, holder, ErrNoOutput)
+	}
+	return new(big.Int).SetBytes(output[:32]), nil
+}
+
+// GetTokenMetadata calls name, symbol, decimals and totalSupply of a token at the state after blockNumber.
+// Functions whose call fails in execution are treated as missing and skipped, name and symbol are decoded as string or as the bytes32 of legacy tokens.
+func (c *Client) GetTokenMetadata(ctx context.Context, token string, blockNumber uint64) (*TokenMetadata, error) {
+	call := func(selector []byte) ([]byte, error) {
+		output, err := c.Call(ctx, token, selector, blockNumber)
+		if IsExecutionError(err) {
+			return nil, nil
+		}
+		return output, err
+	}
+	metadata := new(TokenMetadata)
+	output, err := call(nameSelector)
+	if err != nil {
+		return nil, err
+	}
+	metadata.Name = DecodeString(output)
+	if output, err = call(symbolSelector); err != nil {
+		return nil, err
+	}
+	metadata.Symbol = DecodeString(output)
+	if output, err = call(decimalsSelector); err != nil {
+		return nil, err
+	}
+	if len(output) >= 32 {
+		if decimals := new(big.Int).SetBytes(output[:32]); decimals.IsUint64() && decimals.Uint64() <= 255 {
+			value := uint8(decimals.Uint64())
+			metadata.Decimals = &value
+		}
+	}
+	if output, err = call(totalSupplySelector); err != nil {
+		return nil, err
+	}
+	if len(output) >= 32 {
+		metadata.TotalSupply = new(big.Int).SetBytes(output[:32])
+	}
+	return metadata, nil
+}
+
+// DecodeString decodes the output of a function returning string, or bytes32 padded with zeros like early tokens did.
+// It returns an empty string for output which is neither.
+func DecodeString(output []byte) string {
+	var value []byte
+	if len(output) >= 64 {
+		offset, length := new(big.Int).SetBytes(output[:32]), new(big.Int).SetBytes(output[32:64])
+		if offset.IsUint64() && offset.Uint64() == 32 && length.IsUint64() && length.Uint64() <= uint64(len(output)-64) {
+			value = output[64 : 64+length.Uint64()]
+		}
+	}
+	if value == nil && len(output) == 32 {
+		value = output
+	}
+	decoded := strings.TrimRight(string(value), "\x00")
+	if !utf8.ValidString(decoded) {
+		return ""
+	}
+	return decoded
+}
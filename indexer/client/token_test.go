@@ -0,0 +1,49 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodeString(t *testing.T) {
+	stringType, err := abi.NewType("string", "", nil)
+	require.NoError(t, err)
+	output, err := abi.Arguments{{Type: stringType}}.Pack("Wrapped Ether")
+	require.NoError(t, err)
+	require.Equal(t, "Wrapped Ether", DecodeString(output))
+
+	// early tokens like MKR return bytes32
+	require.Equal(t, "MKR", DecodeString(common.RightPadBytes([]byte("MKR"), 32)))
+
+	require.Empty(t, DecodeString(nil))
+	require.Empty(t, DecodeString(common.BigToHash(big.NewInt(18)).Bytes()[:31]))
+	require.Empty(t, DecodeString(common.FromHex("0xff")))
+}
+
+type testRPCError struct {
+	code    int
+	message string
+}
+
+func (e *testRPCError) Error() string  { return e.message }
+func (e *testRPCError) ErrorCode() int { return e.code }
+
+func TestIsExecutionError(t *testing.T) {
+	require.True(t, IsExecutionError(&testRPCError{3, "execution reverted"}))
+	// contracts before solidity 0.4.10 throw an invalid opcode or jump for a missing function
+	require.True(t, IsExecutionError(&testRPCError{-32000, "invalid opcode: INVALID"}))
+	require.True(t, IsExecutionError(&testRPCError{-32000, "invalid jump destination"}))
+	require.True(t, IsExecutionError(&testRPCError{-32015, "VM execution error."}))
+	require.True(t, IsExecutionError(fmt.Errorf("name: %w", &testRPCError{-32000, "stack underflow (0 <=> 1)"})))
+
+	require.False(t, IsExecutionError(nil))
+	require.False(t, IsExecutionError(errors.New("connection refused")))
+	require.False(t, IsExecutionError(&testRPCError{-32000, "header not found"}))
+	require.False(t, IsExecutionError(&testRPCError{-32005, "rate limit exceeded"}))
+}
@@ -1,27 +1,75 @@
 package client
 
+import (
+	"strconv"
+	"strings"
+)
+
 type TraceBlock struct {
-	Action              Action `json:"action"`
-	BlockHash           string `json:"blockHash"`
-	BlockNumber         int    `json:"blockNumber"`
-	Result              Result `json:"result"`
-	Subtraces           int    `json:"subtraces"`
-	TraceAddress        []any  `json:"traceAddress"`
-	TransactionHash     string `json:"transactionHash"`
-	TransactionPosition int    `json:"transactionPosition"`
-	Type                string `json:"type"`
+	Action              Action  `json:"action"`
+	BlockHash           string  `json:"blockHash"`
+	BlockNumber         uint64  `json:"blockNumber"`
+	Result              *Result `json:"result"`
+	Error               string  `json:"error,omitempty"`
+	Subtraces           int     `json:"subtraces"`
+	TraceAddress        []int   `json:"traceAddress"`
+	TransactionHash     string  `json:"transactionHash"`
+	TransactionPosition uint64  `json:"transactionPosition"`
+	Type                string  `json:"type"`
 }
 
 type Action struct {
+	// call, create
 	CallType string `json:"callType"`
 	From     string `json:"from"`
 	Gas      string `json:"gas"`
 	Input    string `json:"input"`
+	Init     string `json:"init"`
 	To       string `json:"to"`
 	Value    string `json:"value"`
+
+	// suicide
+	Address       string `json:"address"`
+	RefundAddress string `json:"refundAddress"`
+	Balance       string `json:"balance"`
+
+	// reward
+	Author     string `json:"author"`
+	RewardType string `json:"rewardType"`
 }
 
 type Result struct {
 	GasUsed string `json:"gasUsed"`
 	Output  string `json:"output"`
+
+	// create
+	Address string `json:"address"`
+	Code    string `json:"code"`
+}
+
+const (
+	TraceTypeCall    = "call"
+	TraceTypeCreate  = "create"
+	TraceTypeSuicide = "suicide"
+	TraceTypeReward  = "reward"
+)
+
+// TracePath returns the trace address as a dot separated string, it is empty for top level traces
+func (t *TraceBlock) TracePath() string {
+	path := make([]string, len(t.TraceAddress))
+	for i, idx := range t.TraceAddress {
+		path[i] = strconv.Itoa(idx)
+	}
+	return strings.Join(path, ".")
+}
+
+// Reverted reports whether the trace or one of its parents failed, in which case its value transfer was reverted
+func (t *TraceBlock) Reverted(failedPaths map[string]struct{}) bool {
+	path := t.TracePath()
+	for failed := range failedPaths {
+		if path == failed || failed == "" || strings.HasPrefix(path, failed+".") {
+			return true
+		}
+	}
+	return false
 }
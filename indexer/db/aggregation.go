@@ -0,0 +1,198 @@
+package db
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// AggregationType is the kind of an Aggregation
+type AggregationType int
+
+const (
+	AggregationTerms AggregationType = iota
+	AggregationSum
+	AggregationMin
+	AggregationMax
+	AggregationDateHistogram
+)
+
+// defaultTermsSize is the number of term buckets returned when Aggregation.Size is not set, like in elasticsearch
+const defaultTermsSize = 10
+
+// Aggregation computes a metric or buckets over the documents matching the QueryParams of DbController.Aggregate
+type Aggregation struct {
+	Name  string
+	Type  AggregationType
+	Field string
+	// Size is the number of term buckets, the buckets with the most documents are returned
+	Size int
+	// Interval is the width of date histogram buckets, the field holds epoch milliseconds
+	Interval time.Duration
+	// SubAggregations are metrics computed for every bucket
+	SubAggregations []Aggregation
+}
+
+// AggregationResult is the result of an Aggregation, metrics set Value and bucket aggregations set Buckets
+type AggregationResult struct {
+	// Value is the metric, min and max are nil when no document has the field
+	Value   *float64
+	Buckets []Bucket
+}
+
+// Bucket is a group of documents of a terms or date histogram aggregation.
+// Terms are keyed by the term, date histograms by the first epoch millisecond of the bucket.
+type Bucket struct {
+	Key             string
+	DocCount        int64
+	SubAggregations map[string]*AggregationResult
+}
+
+// TermsAggregation groups documents by the value of field and returns the size largest groups
+func TermsAggregation(name string, field string, size int, metrics ...Aggregation) Aggregation {
+	return Aggregation{Name: name, Type: AggregationTerms, Field: field, Size: size, SubAggregations: metrics}
+}
+
+// SumAggregation sums a numeric field
+func SumAggregation(name string, field string) Aggregation {
+	return Aggregation{Name: name, Type: AggregationSum, Field: field}
+}
+
+// MinAggregation returns the smallest value of a numeric field
+func MinAggregation(name string, field string) Aggregation {
+	return Aggregation{Name: name, Type: AggregationMin, Field: field}
+}
+
+// MaxAggregation returns the largest value of a numeric field
+func MaxAggregation(name string, field string) Aggregation {
+	return Aggregation{Name: name, Type: AggregationMax, Field: field}
+}
+
+// DateHistogramAggregation groups documents by a field of epoch milliseconds into buckets of interval, empty buckets are omitted
+func DateHistogramAggregation(name string, field string, interval time.Duration, metrics ...Aggregation) Aggregation {
+	return Aggregation{Name: name, Type: AggregationDateHistogram, Field: field, Interval: interval, SubAggregations: metrics}
+}
+
+// isMetric reports whether the aggregation computes a single value
+func (agg Aggregation) isMetric() bool {
+	return agg.Type == AggregationSum || agg.Type == AggregationMin || agg.Type == AggregationMax
+}
+
+// validate checks an aggregation before a backend translates it
+func (agg Aggregation) validate() error {
+	if agg.Name == "" || agg.Field == "" {
+		return fmt.Errorf("aggregation needs a name and a field")
+	}
+	switch agg.Type {
+	case AggregationSum, AggregationMin, AggregationMax:
+		if len(agg.SubAggregations) > 0 {
+			return fmt.Errorf("metric aggregation %s can not have sub aggregations", agg.Name)
+		}
+	case AggregationTerms:
+	case AggregationDateHistogram:
+		if agg.Interval.Milliseconds() <= 0 {
+			return fmt.Errorf("date histogram %s needs an interval of at least a millisecond", agg.Name)
+		}
+	default:
+		return fmt.Errorf("unknown type %d of aggregation %s", agg.Type, agg.Name)
+	}
+	for _, sub := range agg.SubAggregations {
+		if !sub.isMetric() {
+			return fmt.Errorf("sub aggregation %s of %s is not a metric", sub.Name, agg.Name)
+		}
+		if err := sub.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// termsSize returns the number of buckets of a terms aggregation
+func (agg Aggregation) termsSize() int {
+	if agg.Size <= 0 {
+		return defaultTermsSize
+	}
+	return agg.Size
+}
+
+// aggregateMatched computes aggregations over documents a backend has matched
+func aggregateMatched(docs []*matchedDoc, aggregations []Aggregation) (map[string]*AggregationResult, error) {
+	results := make(map[string]*AggregationResult, len(aggregations))
+	for _, agg := range aggregations {
+		if err := agg.validate(); err != nil {
+			return nil, err
+		}
+		results[agg.Name] = aggregateDocs(docs, agg)
+	}
+	return results, nil
+}
+
+// aggregateDocs computes a single validated aggregation
+func aggregateDocs(docs []*matchedDoc, agg Aggregation) *AggregationResult {
+	if agg.isMetric() {
+		var value *float64
+		if agg.Type == AggregationSum {
+			value = new(float64)
+		}
+		for _, doc := range docs {
+			n, ok := doc.fields.Float(agg.Field)
+			switch {
+			case !ok:
+			case value == nil:
+				value = &n
+			case agg.Type == AggregationSum:
+				*value += n
+			case agg.Type == AggregationMin && n < *value, agg.Type == AggregationMax && n > *value:
+				*value = n
+			}
+		}
+		return &AggregationResult{Value: value}
+	}
+
+	groups := make(map[string][]*matchedDoc)
+	keys := make(map[string]uint64)
+	for _, doc := range docs {
+		if agg.Type == AggregationTerms {
+			if doc.fields[agg.Field] == nil && agg.Field != "id" && agg.Field != "_id" {
+				continue
+			}
+			key := fieldValue(agg.Field, doc.id, doc.fields)
+			groups[key] = append(groups[key], doc)
+			continue
+		}
+		n, ok := doc.fields.Uint(agg.Field)
+		if !ok {
+			continue
+		}
+		interval := uint64(agg.Interval.Milliseconds())
+		key := strconv.FormatUint(n-n%interval, 10)
+		groups[key] = append(groups[key], doc)
+		keys[key] = n - n%interval
+	}
+
+	buckets := make([]Bucket, 0, len(groups))
+	for key, group := range groups {
+		bucket := Bucket{Key: key, DocCount: int64(len(group)), SubAggregations: make(map[string]*AggregationResult)}
+		for _, sub := range agg.SubAggregations {
+			bucket.SubAggregations[sub.Name] = aggregateDocs(group, sub)
+		}
+		buckets = append(buckets, bucket)
+	}
+	if agg.Type == AggregationTerms {
+		sort.Slice(buckets, func(i, j int) bool {
+			if buckets[i].DocCount != buckets[j].DocCount {
+				return buckets[i].DocCount > buckets[j].DocCount
+			}
+			return buckets[i].Key < buckets[j].Key
+		})
+		if len(buckets) > agg.termsSize() {
+			buckets = buckets[:agg.termsSize()]
+		}
+	} else {
+		sort.Slice(buckets, func(i, j int) bool {
+			return keys[buckets[i].Key] < keys[buckets[j].Key]
+		})
+	}
+	return &AggregationResult{Buckets: buckets}
+}
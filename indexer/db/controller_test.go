@@ -0,0 +1,292 @@
+package db
+
+import (
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/rabbitprincess/eth-indexer/indexer/schema"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestBalanceChange(blockNumber uint64, account string) *schema.BalanceCHangeHistory {
+	return &schema.BalanceCHangeHistory{
+		BaseEsType:     &schema.BaseEsType{Id: schema.BalanceChangeID(blockNumber, 0, "", schema.Transfer, account)},
+		Account:        account,
+		BlockNumber:    blockNumber,
+		BlockTimestamp: blockNumber * uint64(time.Minute/time.Millisecond),
+		ChangeType:     uint64(schema.Transfer),
+		BalanceBefore:  "0",
+		BalanceAfter:   fmt.Sprint(blockNumber),
+		BalanceChange:  fmt.Sprint(blockNumber),
+	}
+}
+
+func newTestBalance(account string, blockNumber uint64, balance string) *schema.AccountBalance {
+	return &schema.AccountBalance{
+		BaseEsType:     &schema.BaseEsType{Id: schema.AccountBalanceID(account)},
+		Account:        account,
+		BlockNumber:    blockNumber,
+		BlockTimestamp: blockNumber * uint64(time.Minute/time.Millisecond),
+		Balance:        balance,
+	}
+}
+
+// testDbController runs the behaviour every DbController implementation must share
+func testDbController(t *testing.T, controller DbController) {
+	prefix := fmt.Sprintf("test%d_", time.Now().UnixNano())
+	history := prefix + schema.TableBalanceChangeHistory
+	balances := prefix + schema.TableAccountBalance
+
+	// empty indices
+	count, err := controller.Count(QueryParams{IndexName: history})
+	require.NoError(t, err)
+	require.Zero(t, count)
+	doc, err := controller.SelectOne(QueryParams{IndexName: history}, schema.DocTypes[schema.TableBalanceChangeHistory])
+	require.NoError(t, err)
+	require.Nil(t, doc)
+
+	// insert is idempotent
+	for i := 0; i < 2; i++ {
+		bulk := controller.InsertBulk(history)
+		for blockNumber := uint64(1); blockNumber <= 25; blockNumber++ {
+			bulk.Add(newTestBalanceChange(blockNumber, "0xaa"))
+			bulk.Add(newTestBalanceChange(blockNumber, "0xbb"))
+		}
+		require.NoError(t, bulk.Commit())
+	}
+	count, err = controller.Count(QueryParams{IndexName: history})
+	require.NoError(t, err)
+	require.EqualValues(t, 50, count)
+
+	// range and match are combined
+	count, err = controller.Count(QueryParams{
+		IndexName:    history,
+		IntegerRange: &IntegerRangeQuery{Field: "block_number", Min: 10, Max: 19},
+		StringMatch:  &StringMatchQuery{Field: "account", Value: "0xaa"},
+	})
+	require.NoError(t, err)
+	require.EqualValues(t, 10, count)
+
+	// bool queries nest and combine with the shorthands
+	for _, tc := range []struct {
+		params QueryParams
+		count  int64
+	}{
+		{QueryParams{Bool: Filter(Match("account", "0xaa"), Range("block_number", 10, 19))}, 10},
+		{QueryParams{Bool: Filter(Terms("account", "0xaa", "0xbb", "0xcc"), Range("block_number", 1, 5))}, 10},
+		{QueryParams{Bool: &BoolQuery{Should: []Query{Range("block_number", 1, 2), Range("block_number", 24, 25)}}}, 8},
+		{QueryParams{Bool: &BoolQuery{Filter: []Query{Exists("account")}, MustNot: []Query{Match("account", "0xaa")}}}, 25},
+		{QueryParams{Bool: &BoolQuery{Must: []Query{Range("block_number", 1, 10)}, Should: []Query{Match("account", "0xcc")}}}, 20},
+		{QueryParams{Bool: Filter((&BoolQuery{Should: []Query{Match("account", "0xaa"), Range("block_number", 20, 25)}}).Query()), StringMatch: &StringMatchQuery{Field: "account", Value: "0xbb"}}, 6},
+		{QueryParams{Bool: Filter(Terms("account"))}, 0},
+		{QueryParams{Bool: Filter(TimeRange("block_timestamp", time.UnixMilli(10*60000), time.UnixMilli(20*60000)))}, 20},
+	} {
+		tc.params.IndexName = history
+		count, err = controller.Count(tc.params)
+		require.NoError(t, err)
+		require.EqualValues(t, tc.count, count)
+	}
+
+	// aggregations run over the matching documents
+	aggs, err := controller.Aggregate(QueryParams{IndexName: history, Bool: Filter(Range("block_number", 1, 20))},
+		TermsAggregation("accounts", "account", 1, SumAggregation("blocks", "block_number")),
+		SumAggregation("sum", "block_number"),
+		MinAggregation("min", "block_number"),
+		MaxAggregation("max", "block_timestamp"),
+		DateHistogramAggregation("daily", "block_timestamp", 10*time.Minute, MaxAggregation("last", "block_number")),
+	)
+	require.NoError(t, err)
+	require.Len(t, aggs["accounts"].Buckets, 1)
+	require.Equal(t, "0xaa", aggs["accounts"].Buckets[0].Key)
+	require.EqualValues(t, 20, aggs["accounts"].Buckets[0].DocCount)
+	require.EqualValues(t, 210, *aggs["accounts"].Buckets[0].SubAggregations["blocks"].Value)
+	require.EqualValues(t, 420, *aggs["sum"].Value)
+	require.EqualValues(t, 1, *aggs["min"].Value)
+	require.EqualValues(t, 20*60000, *aggs["max"].Value)
+	require.Len(t, aggs["daily"].Buckets, 3)
+	for i, bucket := range aggs["daily"].Buckets {
+		require.Equal(t, fmt.Sprint(i*600000), bucket.Key)
+		require.EqualValues(t, min(i*10+9, 20), *bucket.SubAggregations["last"].Value)
+	}
+	require.EqualValues(t, 18, aggs["daily"].Buckets[0].DocCount)
+
+	aggs, err = controller.Aggregate(QueryParams{IndexName: history, Bool: Filter(Match("account", "0xcc"))},
+		SumAggregation("sum", "block_number"), MinAggregation("min", "block_number"), TermsAggregation("accounts", "account", 0))
+	require.NoError(t, err)
+	require.EqualValues(t, 0, *aggs["sum"].Value)
+	require.Nil(t, aggs["min"].Value)
+	require.Empty(t, aggs["accounts"].Buckets)
+
+	_, err = controller.Aggregate(QueryParams{IndexName: history}, SumAggregation("sum", "block_number"), Aggregation{Name: "bad", Field: "account", Type: AggregationTerms, SubAggregations: []Aggregation{TermsAggregation("nested", "account", 1)}})
+	require.Error(t, err)
+
+	// a range and a match both restrict the selected document
+	doc, err = controller.SelectOne(QueryParams{
+		IndexName:    history,
+		IntegerRange: &IntegerRangeQuery{Field: "block_number", Min: 1, Max: 10},
+		StringMatch:  &StringMatchQuery{Field: "account", Value: "0xbb"},
+		SortField:    "block_number",
+		SortAsc:      false,
+	}, schema.DocTypes[schema.TableBalanceChangeHistory])
+	require.NoError(t, err)
+	require.EqualValues(t, 10, doc.(*schema.BalanceCHangeHistory).BlockNumber)
+	require.Equal(t, "0xbb", doc.(*schema.BalanceCHangeHistory).Account)
+
+	doc, err = controller.SelectOne(QueryParams{
+		IndexName:   history,
+		StringMatch: &StringMatchQuery{Field: "account", Value: "0xbb"},
+		SortField:   "block_number",
+		SortAsc:     false,
+	}, schema.DocTypes[schema.TableBalanceChangeHistory])
+	require.NoError(t, err)
+	require.EqualValues(t, 25, doc.(*schema.BalanceCHangeHistory).BlockNumber)
+	require.Equal(t, schema.BalanceChangeID(25, 0, "", schema.Transfer, "0xbb"), doc.GetID())
+
+	// scroll pages through every document in order
+	scroll := controller.Scroll(QueryParams{IndexName: history, Size: 7, SortField: "block_number", SortAsc: true}, schema.DocTypes[schema.TableBalanceChangeHistory])
+	var scrolled int
+	var last uint64
+	for {
+		doc, err := scroll.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		require.GreaterOrEqual(t, doc.(*schema.BalanceCHangeHistory).BlockNumber, last)
+		last = doc.(*schema.BalanceCHangeHistory).BlockNumber
+		scrolled++
+	}
+	require.Equal(t, 50, scrolled)
+
+	// pages continue from their cursor, ties on the sort field are not skipped nor repeated
+	seen := map[string]bool{}
+	cursor, pages := "", 0
+	for {
+		page, err := controller.SearchPage(QueryParams{IndexName: history, Size: 7, SortField: "block_number", SortAsc: false}, cursor, schema.DocTypes[schema.TableBalanceChangeHistory])
+		require.NoError(t, err)
+		for _, doc := range page.Documents {
+			require.False(t, seen[doc.GetID()])
+			seen[doc.GetID()] = true
+		}
+		pages++
+		if cursor = page.Cursor; cursor == "" {
+			break
+		}
+	}
+	require.Len(t, seen, 50)
+	require.Equal(t, 8, pages)
+
+	page, err := controller.SearchPage(QueryParams{IndexName: history, Size: 3, SortField: "block_number", SortAsc: true, Bool: Filter(Match("account", "0xbb"))}, "", schema.DocTypes[schema.TableBalanceChangeHistory])
+	require.NoError(t, err)
+	require.Len(t, page.Documents, 3)
+	page, err = controller.SearchPage(QueryParams{IndexName: history, Size: 3, SortField: "block_number", SortAsc: true, Bool: Filter(Match("account", "0xbb"))}, page.Cursor, schema.DocTypes[schema.TableBalanceChangeHistory])
+	require.NoError(t, err)
+	require.EqualValues(t, 4, page.Documents[0].(*schema.BalanceCHangeHistory).BlockNumber)
+
+	// From and To bound the sort field
+	page, err = controller.SearchPage(QueryParams{IndexName: history, Size: 100, SortField: "block_number", SortAsc: true, From: 10, To: 19}, "", schema.DocTypes[schema.TableBalanceChangeHistory])
+	require.NoError(t, err)
+	require.NotEmpty(t, page.Documents)
+	for _, doc := range page.Documents {
+		require.GreaterOrEqual(t, doc.(*schema.BalanceCHangeHistory).BlockNumber, uint64(10))
+		require.LessOrEqual(t, doc.(*schema.BalanceCHangeHistory).BlockNumber, uint64(19))
+	}
+
+	_, err = controller.SearchPage(QueryParams{IndexName: history}, "not a cursor", schema.DocTypes[schema.TableBalanceChangeHistory])
+	require.ErrorIs(t, err, ErrInvalidCursor)
+
+	// delete by range
+	deleted, err := controller.Delete(QueryParams{
+		IndexName:    history,
+		IntegerRange: &IntegerRangeQuery{Field: "block_number", Min: 21, Max: 100},
+	})
+	require.NoError(t, err)
+	require.EqualValues(t, 10, deleted)
+
+	// upsert overwrites and multi get skips missing ids
+	bulk := controller.UpsertBulk(balances)
+	bulk.Add(newTestBalance("0xaa", 1, "100"))
+	bulk.Add(newTestBalance("0xbb", 1, "200"))
+	require.NoError(t, bulk.Commit())
+	bulk = controller.UpsertBulk(balances)
+	bulk.Add(newTestBalance("0xaa", 2, "150"))
+	require.NoError(t, bulk.Commit())
+
+	docs, err := controller.MultiGet(balances, []string{"0xaa", "0xcc", "0xbb"}, schema.DocTypes[schema.TableAccountBalance])
+	require.NoError(t, err)
+	require.Len(t, docs, 2)
+	got := map[string]string{}
+	for _, doc := range docs {
+		got[doc.GetID()] = doc.(*schema.AccountBalance).Balance
+	}
+	require.Equal(t, map[string]string{"0xaa": "150", "0xbb": "200"}, got)
+	require.True(t, controller.Exists(balances, "0xaa"))
+	require.False(t, controller.Exists(balances, "0xcc"))
+	doc, err = controller.SelectOne(QueryParams{
+		IndexName: balances,
+		Bool:      Filter(TimeRange("block_timestamp", time.UnixMilli(0), time.UnixMilli(2*60000))),
+	}, schema.DocTypes[schema.TableAccountBalance])
+	require.NoError(t, err)
+	require.Equal(t, "0xbb", doc.GetID())
+
+	// latest upserts never replace a document of a later block, plain upserts like rollbacks do
+	latest := prefix + "latest_" + schema.TableAccountBalance
+	balanceOf := func(account string) *schema.AccountBalance {
+		docs, err := controller.MultiGet(latest, []string{account}, schema.DocTypes[schema.TableAccountBalance])
+		require.NoError(t, err)
+		require.Len(t, docs, 1)
+		return docs[0].(*schema.AccountBalance)
+	}
+	for _, write := range []struct {
+		bulk     BulkInstance
+		block    uint64
+		expected string
+	}{
+		{controller.UpsertLatestBulk(latest), 5, "5"},
+		{controller.UpsertLatestBulk(latest), 3, "5"},
+		{controller.UpsertLatestBulk(latest), 5, "5"},
+		{controller.UpsertLatestBulk(latest), 7, "7"},
+		{controller.UpsertBulk(latest), 4, "4"},
+	} {
+		write.bulk.Add(newTestBalance("0xdd", write.block, fmt.Sprint(write.block)))
+		require.NoError(t, write.bulk.Commit())
+		require.Equal(t, write.expected, balanceOf("0xdd").Balance)
+	}
+
+	// alias swap
+	alias := prefix + "alias_" + schema.TableAccountBalance
+	require.NoError(t, controller.UpdateAlias(alias, balances))
+	exists, indexPrefix, err := controller.GetExistingIndexPrefix(alias, schema.TableAccountBalance)
+	require.NoError(t, err)
+	require.True(t, exists)
+	require.Equal(t, prefix, indexPrefix)
+	count, err = controller.Count(QueryParams{IndexName: alias})
+	require.NoError(t, err)
+	require.EqualValues(t, 2, count)
+
+	// writes through an alias go to the index behind it
+	bulk = controller.UpsertBulk(alias)
+	bulk.Add(newTestBalance("0xcc", 3, "300"))
+	require.NoError(t, bulk.Commit())
+	count, err = controller.Count(QueryParams{IndexName: balances})
+	require.NoError(t, err)
+	require.EqualValues(t, 3, count)
+
+	// an index written under the alias name before aliases were used is retired by the swap
+	bare := prefix + "bare_" + schema.TableAccountBalance
+	bulk = controller.UpsertBulk(bare)
+	bulk.Add(newTestBalance("0xdd", 4, "400"))
+	require.NoError(t, bulk.Commit())
+	versioned := prefix + "v1_" + schema.TableAccountBalance
+	require.NoError(t, controller.CreateIndex(versioned, schema.TableAccountBalance))
+	require.NoError(t, controller.UpdateAlias(bare, versioned))
+	count, err = controller.Count(QueryParams{IndexName: bare})
+	require.NoError(t, err)
+	require.Zero(t, count)
+	exists, indexPrefix, err = controller.GetExistingIndexPrefix(bare, schema.TableAccountBalance)
+	require.NoError(t, err)
+	require.True(t, exists)
+	require.Equal(t, prefix+"v1_", indexPrefix)
+}
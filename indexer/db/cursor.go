@@ -0,0 +1,64 @@
+package db
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+
+	"github.com/rabbitprincess/eth-indexer/indexer/schema"
+)
+
+// defaultPageSize is the page size of SearchPage and scrolls which do not set QueryParams.Size
+const defaultPageSize = 1000
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Page is a page of documents returned by SearchPage
+type Page struct {
+	Documents []schema.DocType
+	// Cursor continues the search after the last document, it is empty on the last page
+	Cursor string
+}
+
+// pageCursor is the state of a paginated search, handed to clients as an opaque url safe token
+type pageCursor struct {
+	PIT   string `json:"pit,omitempty"` // elasticsearch point in time the pages are read from
+	After []any  `json:"after"`         // sort values of the last returned document
+}
+
+// encode returns the token of the cursor
+func (c *pageCursor) encode() (string, error) {
+	raw, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// decodeCursor parses a token returned with a previous page, it returns nil for the empty token of the first page.
+// Numbers are kept as json.Number so sort values round trip exactly.
+func decodeCursor(token string) (*pageCursor, error) {
+	if token == "" {
+		return nil, nil
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	c := new(pageCursor)
+	if err = decoder.Decode(c); err != nil {
+		return nil, ErrInvalidCursor
+	}
+	return c, nil
+}
+
+// pageSize returns the size of a page of params
+func pageSize(params QueryParams) int {
+	if params.Size <= 0 {
+		return defaultPageSize
+	}
+	return params.Size
+}
@@ -1,21 +1,62 @@
 package db
 
-import "github.com/rabbitprincess/eth-indexer/indexer/schema"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/rabbitprincess/eth-indexer/indexer/schema"
+	"github.com/rs/zerolog"
+)
 
 type DbController interface {
 	Exists(indexName string, id string) bool
 	Insert(document schema.DocType, indexName string) error
 	InsertBulk(indexName string) BulkInstance
+	UpsertBulk(indexName string) BulkInstance
+	UpsertLatestBulk(indexName string) BulkInstance
 	Update(document schema.DocType, indexName string, id string) error
 	Delete(params QueryParams) (uint64, error)
 	Count(params QueryParams) (int64, error)
 	SelectOne(params QueryParams, createDocument CreateDocFunction) (schema.DocType, error)
+	MultiGet(indexName string, ids []string, createDocument CreateDocFunction) ([]schema.DocType, error)
 	Scroll(params QueryParams, createDocument CreateDocFunction) ScrollInstance
+	SearchPage(params QueryParams, cursor string, createDocument CreateDocFunction) (*Page, error)
+	Aggregate(params QueryParams, aggregations ...Aggregation) (map[string]*AggregationResult, error)
 	GetExistingIndexPrefix(aliasName string, documentType string) (bool, string, error)
 	CreateIndex(indexName string, documentType string) error
 	UpdateAlias(aliasName string, indexName string) error
 }
 
+// NewDbController creates the controller of the database addressed by dbURL.
+// postgres:// and postgresql:// urls select PostgreSQL, sqlite:// urls and paths of .db, .sqlite or .sqlite3 files
+// select an embedded SQLite database, pebble:// urls an embedded pebble store, memory:// an in-memory database
+// which is lost on exit, any other url Elasticsearch. An empty url is an error.
+func NewDbController(ctx context.Context, logger *zerolog.Logger, dbURL string) (DbController, error) {
+	switch {
+	case dbURL == "":
+		return nil, errors.New("no database url")
+	case strings.HasPrefix(dbURL, "postgres://"), strings.HasPrefix(dbURL, "postgresql://"):
+		return NewPostgresDbController(ctx, logger, dbURL)
+	case strings.HasPrefix(dbURL, "sqlite://"):
+		return NewSqliteDbController(ctx, logger, strings.TrimPrefix(dbURL, "sqlite://"))
+	case strings.HasPrefix(dbURL, "memory://"):
+		return NewMemoryDbController(), nil
+	case strings.HasPrefix(dbURL, "pebble://"):
+		return NewPebbleDbController(ctx, logger, strings.TrimPrefix(dbURL, "pebble://"))
+	case strings.HasSuffix(dbURL, ".db"), strings.HasSuffix(dbURL, ".sqlite"), strings.HasSuffix(dbURL, ".sqlite3"):
+		return NewSqliteDbController(ctx, logger, dbURL)
+	default:
+		es, err := NewElasticsearchDbController(ctx, logger, dbURL)
+		if err != nil {
+			return nil, err
+		}
+		return es, nil
+	}
+}
+
 type IntegerRangeQuery struct {
 	Field string
 	Min   uint64
@@ -28,16 +69,19 @@ type StringMatchQuery struct {
 }
 
 type QueryParams struct {
-	IndexName    string
-	TypeName     string
-	From         int
-	To           int
+	IndexName string
+	TypeName  string
+	// From is the offset of SelectOne, scrolls and pages use From and To as bounds of the sort field
+	From         uint64
+	To           uint64
 	Size         int
 	SortField    string
 	SortAsc      bool
 	SelectFields []string
 	IntegerRange *IntegerRangeQuery
 	StringMatch  *StringMatchQuery
+	// Bool combines any number of conditions, IntegerRange and StringMatch are shorthands for filters next to it
+	Bool *BoolQuery
 }
 
 type CreateDocFunction = func() schema.DocType
@@ -50,3 +94,27 @@ type BulkInstance interface {
 	Add(document schema.DocType)
 	Commit() error
 }
+
+// BulkItemError describes a single document rejected by a bulk commit
+type BulkItemError struct {
+	Index  string
+	Id     string
+	Status int
+	Type   string
+	Reason string
+}
+
+// Retryable reports whether the document was rejected by a transient condition of the database
+func (e BulkItemError) Retryable() bool {
+	return e.Status == http.StatusTooManyRequests || e.Status == http.StatusServiceUnavailable
+}
+
+// BulkError is returned by BulkInstance.Commit when some documents could not be written
+type BulkError struct {
+	Items []BulkItemError
+}
+
+func (e *BulkError) Error() string {
+	first := e.Items[0]
+	return fmt.Sprintf("bulk commit failed for %d documents, first: index=%s id=%s status=%d %s: %s", len(e.Items), first.Index, first.Id, first.Status, first.Type, first.Reason)
+}
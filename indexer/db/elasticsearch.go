@@ -8,7 +8,11 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/olivere/elastic/v7"
@@ -20,6 +24,17 @@ import (
 type EsDBController struct {
 	logger *zerolog.Logger
 	client *elastic.Client
+
+	mtx        sync.Mutex
+	partitions map[string]*esPartitions // partitioned alias to its partitions
+}
+
+// esPartitions are the partitions behind a partitioned alias
+type esPartitions struct {
+	Partitioning
+	documentType string
+	base         string   // name the partitions are named after, see partitionMeta
+	indices      []string // cached indices of the alias, nil until read
 }
 
 // NewElasticsearchDbController creates a new instance of ElasticsearchDbController
@@ -33,8 +48,9 @@ func NewElasticsearchDbController(ctx context.Context, logger *zerolog.Logger, e
 		return nil, err
 	}
 	controller := &EsDBController{
-		logger: logger,
-		client: client,
+		logger:     logger,
+		client:     client,
+		partitions: make(map[string]*esPartitions),
 	}
 
 	retry := 0
@@ -90,31 +106,86 @@ func (esdb *EsDBController) Exists(indexName string, id string) bool {
 }
 
 func (esdb *EsDBController) Update(document schema.DocType, indexName string, id string) error {
-	_, err := esdb.client.Update().Index(indexName).Id(id).Doc(document).Upsert(document).Do(context.Background())
+	index := esdb.writeIndex(indexName, document)
+	_, err := esdb.client.Update().Index(index).Id(id).Doc(document).Upsert(document).Do(context.Background())
+	esdb.written(indexName, index)
 	if errConflict, ok := err.(*elastic.Error); ok && errConflict.Status == 409 {
 		return nil // ignore version conflict exception
 	}
 	return err
 }
 
+// esQuery translates the conditions of params, documents are filtered without scoring
+func esQuery(params QueryParams) elastic.Query {
+	q := params.query()
+	if q == nil {
+		return elastic.NewMatchAllQuery()
+	}
+	return esBoolQuery(q)
+}
+
+// esBoolQuery translates a bool query
+func esBoolQuery(q *BoolQuery) *elastic.BoolQuery {
+	query := elastic.NewBoolQuery()
+	for _, must := range q.Must {
+		query = query.Must(esCondition(must))
+	}
+	for _, filter := range q.Filter {
+		query = query.Filter(esCondition(filter))
+	}
+	for _, should := range q.Should {
+		query = query.Should(esCondition(should))
+	}
+	for _, mustNot := range q.MustNot {
+		query = query.MustNot(esCondition(mustNot))
+	}
+	return query
+}
+
+// esCondition translates a single condition of a bool query
+func esCondition(q Query) elastic.Query {
+	switch {
+	case q.Range != nil:
+		return elastic.NewRangeQuery(q.Range.Field).Gte(q.Range.Min).Lte(q.Range.Max)
+	case q.Match != nil:
+		return elastic.NewTermQuery(esField(q.Match.Field), q.Match.Value)
+	case q.Terms != nil:
+		values := make([]interface{}, len(q.Terms.Values))
+		for i, value := range q.Terms.Values {
+			values[i] = value
+		}
+		return elastic.NewTermsQuery(esField(q.Terms.Field), values...)
+	case q.Exists != nil:
+		return elastic.NewExistsQuery(esField(q.Exists.Field))
+	case q.Bool != nil:
+		return esBoolQuery(q.Bool)
+	}
+	return elastic.NewMatchAllQuery()
+}
+
+// esField maps the id field the other backends accept to the elasticsearch metadata field
+func esField(field string) string {
+	if field == "id" {
+		return "_id"
+	}
+	return field
+}
+
 // Insert inserts a single document using the updata params
 // It returns the number of inserted documents (1) or an error
 func (esdb *EsDBController) Insert(document schema.DocType, indexName string) error {
-	_, err := esdb.client.Index().Index(indexName).OpType("index").Id(document.GetID()).BodyJson(document).Do(context.Background())
+	index := esdb.writeIndex(indexName, document)
+	_, err := esdb.client.Index().Index(index).OpType("index").Id(document.GetID()).BodyJson(document).Do(context.Background())
+	esdb.written(indexName, index)
 	return err
 }
 
 // Delete removes documents specified by the query params
 func (esdb *EsDBController) Delete(params QueryParams) (uint64, error) {
-	var query elastic.Query
-	if params.IntegerRange != nil {
-		query = elastic.NewRangeQuery(params.IntegerRange.Field).From(params.IntegerRange.Min).To(params.IntegerRange.Max)
-	} else if params.StringMatch != nil {
-		query = elastic.NewMatchQuery(params.StringMatch.Field, params.StringMatch.Value)
-	}
-
-	res, err := esdb.client.DeleteByQuery().Index(params.IndexName).Query(query).Do(context.Background())
-	if err != nil {
+	res, err := esdb.client.DeleteByQuery(esdb.indices(params)...).Query(esQuery(params)).Do(context.Background())
+	if elastic.IsNotFound(err) {
+		return 0, nil // index not created yet
+	} else if err != nil {
 		return 0, err
 	}
 	return uint64(res.Deleted), nil
@@ -122,32 +193,24 @@ func (esdb *EsDBController) Delete(params QueryParams) (uint64, error) {
 
 // Count returns the number of indexed documents
 func (esdb *EsDBController) Count(params QueryParams) (int64, error) {
-	var query elastic.Query
-	if params.IntegerRange != nil {
-		query = elastic.NewRangeQuery(params.IntegerRange.Field).From(params.IntegerRange.Min).To(params.IntegerRange.Max)
-	} else if params.StringMatch != nil {
-		query = elastic.NewMatchQuery(params.StringMatch.Field, params.StringMatch.Value)
+	count, err := esdb.client.Count(esdb.indices(params)...).Query(esQuery(params)).Do(context.Background())
+	if elastic.IsNotFound(err) {
+		return 0, nil // index not created yet
 	}
-	return esdb.client.Count(params.IndexName).Query(query).Do(context.Background())
+	return count, err
 }
 
 // SelectOne selects a single document
 func (esdb *EsDBController) SelectOne(params QueryParams, createDocument CreateDocFunction) (schema.DocType, error) {
-	service := esdb.client.Search().Index(params.IndexName)
-	if params.IntegerRange != nil {
-		query := elastic.NewRangeQuery(params.IntegerRange.Field).From(params.IntegerRange.Min).To(params.IntegerRange.Max)
-		service = service.Query(query)
-	}
-	if params.StringMatch != nil {
-		query := elastic.NewMatchQuery(params.StringMatch.Field, params.StringMatch.Value)
-		service = service.Query(query)
-	}
+	service := esdb.search(params).Query(esQuery(params))
 	if params.SortField != "" {
-		service = service.Sort(params.SortField, params.SortAsc).From(params.From)
+		service = service.Sort(params.SortField, params.SortAsc).From(int(params.From))
 	}
 
 	res, err := service.Size(1).Do(context.Background())
-	if err != nil {
+	if elastic.IsNotFound(err) {
+		return nil, nil // index not created yet
+	} else if err != nil {
 		return nil, err
 	}
 	if res == nil || res.TotalHits() == 0 || len(res.Hits.Hits) == 0 {
@@ -164,8 +227,47 @@ func (esdb *EsDBController) SelectOne(params QueryParams, createDocument CreateD
 	return document, nil
 }
 
-// UpdateAlias updates an alias with a new index name and delete stale indices
+// MultiGet fetches documents by id in a single round trip, ids which are not found are skipped
+func (esdb *EsDBController) MultiGet(indexName string, ids []string, createDocument CreateDocFunction) ([]schema.DocType, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	service := esdb.client.Mget()
+	for _, id := range ids {
+		service = service.Add(elastic.NewMultiGetItem().Index(indexName).Id(id))
+	}
+	res, err := service.Do(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	documents := make([]schema.DocType, 0, len(res.Docs))
+	for _, hit := range res.Docs {
+		if hit.Error != nil {
+			if hit.Error.Type == "index_not_found_exception" {
+				continue // index not created yet
+			}
+			return nil, fmt.Errorf("failed to get document %s: %s", hit.Id, hit.Error.Reason)
+		}
+		if !hit.Found {
+			continue
+		}
+		document := createDocument()
+		if err := json.Unmarshal(hit.Source, document); err != nil {
+			return nil, err
+		}
+		document.SetID(hit.Id)
+		documents = append(documents, document)
+	}
+	return documents, nil
+}
+
+// UpdateAlias updates an alias with a new index name and delete stale indices.
+// A partitioned alias updated with another partitioned alias takes over its partitions, see swapPartitions.
 func (esdb *EsDBController) UpdateAlias(aliasName string, indexName string) error {
+	if partitions := esdb.partitioned(indexName); partitions != nil {
+		return esdb.swapPartitions(aliasName, indexName, partitions)
+	}
 	ctx := context.Background()
 	svc := esdb.client.Alias()
 	res, err := esdb.client.Aliases().Index("_all").Do(ctx)
@@ -179,6 +281,12 @@ func (esdb *EsDBController) UpdateAlias(aliasName string, indexName string) erro
 		for _, indexName := range indices {
 			svc.Remove(indexName, aliasName)
 		}
+	} else if exists, err := esdb.client.IndexExists(aliasName).Do(ctx); err != nil {
+		return err
+	} else if exists {
+		// An index written under the alias name before aliases were used is removed in the same request,
+		// the alias can not be created while it exists
+		svc.Action(elastic.NewAliasRemoveIndexAction(aliasName))
 	}
 
 	// Add new alias
@@ -188,6 +296,7 @@ func (esdb *EsDBController) UpdateAlias(aliasName string, indexName string) erro
 	for _, indexName := range indices {
 		esdb.client.DeleteIndex(indexName).Do(ctx)
 	}
+	esdb.invalidatePartitions(aliasName)
 	return err
 }
 
@@ -205,9 +314,19 @@ func (esdb *EsDBController) GetExistingIndexPrefix(aliasName string, documentTyp
 	return false, "", nil
 }
 
-// CreateIndex creates index according to documentType definition
+// CreateIndex creates index according to documentType definition, an existing index or alias is left as is.
+// The partitions of a partitioned alias are created by their first write.
 func (esdb *EsDBController) CreateIndex(indexName string, documentType string) error {
-	createIndex, err := esdb.client.CreateIndex(indexName).BodyString(schema.EsSchema[documentType]).Do(context.Background())
+	ctx := context.Background()
+	if esdb.partitioned(indexName) != nil {
+		return nil
+	}
+	if exists, err := esdb.client.IndexExists(indexName).Do(ctx); err != nil {
+		return err
+	} else if exists {
+		return nil
+	}
+	createIndex, err := esdb.client.CreateIndex(indexName).BodyString(schema.EsSchema[documentType]).Do(ctx)
 	if err != nil {
 		return err
 	}
@@ -217,90 +336,679 @@ func (esdb *EsDBController) CreateIndex(indexName string, documentType string) e
 	return nil
 }
 
-// Scroll creates a new scroll instance with the specified query and unmarshal function
-func (esdb *EsDBController) Scroll(params QueryParams, createDocument CreateDocFunction) ScrollInstance {
-	fsc := elastic.NewFetchSourceContext(true).Include(params.SelectFields...)
+// esMappings returns the mappings of the documentType definition
+func esMappings(documentType string) (map[string]interface{}, error) {
+	var definition struct {
+		Mappings map[string]interface{} `json:"mappings"`
+	}
+	if err := json.Unmarshal([]byte(schema.EsSchema[documentType]), &definition); err != nil {
+		return nil, err
+	}
+	return definition.Mappings, nil
+}
+
+// PutMapping adds the fields of the documentType definition which an existing index lacks
+func (esdb *EsDBController) PutMapping(indexName string, documentType string) error {
+	mappings, err := esMappings(documentType)
+	if err != nil {
+		return err
+	}
+	putMapping, err := esdb.client.PutMapping().Index(indexName).BodyJson(mappings).Do(context.Background())
+	if err != nil {
+		return err
+	}
+	if !putMapping.Acknowledged {
+		return errors.New("PutMapping not acknowledged")
+	}
+	return nil
+}
+
+// UpdateByQuery runs a painless script on every document matching params and returns the number of updated documents.
+// Documents changed concurrently are skipped, so a migration can be rerun until it updates nothing.
+func (esdb *EsDBController) UpdateByQuery(params QueryParams, script string) (uint64, error) {
+	res, err := esdb.client.UpdateByQuery(esdb.indices(params)...).
+		Query(esQuery(params)).
+		Script(elastic.NewScript(script).Lang("painless")).
+		Conflicts("proceed").
+		Slices("auto").
+		Refresh("true").
+		Do(context.Background())
+	if elastic.IsNotFound(err) {
+		return 0, nil // index not created yet
+	} else if err != nil {
+		return 0, err
+	}
+	return uint64(res.Updated), nil
+}
 
-	scroll := esdb.client.Scroll(params.IndexName)
+// SetPartitioning splits the documents written to aliasName into partitions. It puts the index template of the
+// partitions, and for rollover the ILM policy and the first write index, updating them if the alias is partitioned.
+// The template persists the partitioning for later runs, see RestorePartitioning.
+// An index already existing under the alias name is not partitioned, reindex it instead.
+func (esdb *EsDBController) SetPartitioning(aliasName string, documentType string, partitioning Partitioning) error {
+	if err := partitioning.validate(); err != nil {
+		return err
+	}
+	ctx := context.Background()
+	meta, err := esdb.loadPartitioning(ctx, aliasName)
+	if err != nil {
+		return err
+	}
+	base := aliasName
+	if meta != nil {
+		base = meta.Base // partitions of a reindex keep their names
+	}
+	res, err := esdb.client.Aliases().Index("_all").Do(ctx)
+	if err != nil {
+		return err
+	}
+	isAlias := len(res.IndicesByAlias(aliasName)) > 0
+	if !isAlias {
+		if exists, err := esdb.client.IndexExists(aliasName).Do(ctx); err != nil {
+			return err
+		} else if exists {
+			return fmt.Errorf("index %s exists and can not be partitioned, reindex it", aliasName)
+		}
+	}
+
+	mappings, err := esMappings(documentType)
+	if err != nil {
+		return err
+	}
+	if partitioning.Mode == PartitionRollover {
+		if _, err = esdb.client.XPackIlmPutLifecycle().Policy(aliasName).BodyJson(partitioning.policy()).Do(ctx); err != nil {
+			return err
+		}
+	}
+	if err = esdb.putPartitionTemplate(ctx, aliasName, base, documentType, partitioning, mappings); err != nil {
+		return err
+	}
+	if partitioning.Mode == PartitionRollover && !isAlias {
+		_, err = esdb.client.CreateIndex(rolloverIndex(base)).BodyJson(map[string]interface{}{
+			"aliases": map[string]interface{}{aliasName: map[string]interface{}{"is_write_index": true}},
+		}).Do(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	esdb.mtx.Lock()
+	defer esdb.mtx.Unlock()
+	esdb.partitions[aliasName] = &esPartitions{Partitioning: partitioning, documentType: documentType, base: base}
+	return nil
+}
+
+// RestorePartitioning partitions aliasName like an earlier run did, as persisted in the index template of its
+// partitions, so that runs without the partitioning settings keep writing to the partitions.
+// It reports whether aliasName is partitioned.
+func (esdb *EsDBController) RestorePartitioning(aliasName string, documentType string) (bool, error) {
+	meta, err := esdb.loadPartitioning(context.Background(), aliasName)
+	if err != nil || meta == nil {
+		return false, err
+	}
+	esdb.mtx.Lock()
+	defer esdb.mtx.Unlock()
+	esdb.partitions[aliasName] = &esPartitions{Partitioning: meta.Partitioning, documentType: documentType, base: meta.Base}
+	return true, nil
+}
+
+// GetPartitioning returns the partitioning of a partitioned alias, nil for any other index
+func (esdb *EsDBController) GetPartitioning(aliasName string) *Partitioning {
+	partitions := esdb.partitioned(aliasName)
+	if partitions == nil {
+		return nil
+	}
+	partitioning := partitions.Partitioning
+	return &partitioning
+}
+
+// loadPartitioning reads the partitioning persisted in the index template of aliasName, nil if there is none
+func (esdb *EsDBController) loadPartitioning(ctx context.Context, aliasName string) (*partitionMeta, error) {
+	res, err := esdb.client.IndexGetIndexTemplate(aliasName).Do(ctx)
+	if elastic.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	template, ok := res.IndexTemplates.ByName(aliasName)
+	if !ok || template.IndexTemplate == nil {
+		return nil, nil
+	}
+	return decodePartitionMeta(template.IndexTemplate.Meta)
+}
+
+// putPartitionTemplate puts the index template of the partitions of aliasName named after base
+func (esdb *EsDBController) putPartitionTemplate(ctx context.Context, aliasName, base, documentType string, partitioning Partitioning, mappings map[string]interface{}) error {
+	putTemplate, err := esdb.client.IndexPutIndexTemplate(aliasName).
+		BodyJson(partitioning.template(aliasName, base, documentType, mappings)).
+		Do(ctx)
+	if err != nil {
+		return err
+	}
+	if !putTemplate.Acknowledged {
+		return errors.New("PutIndexTemplate not acknowledged")
+	}
+	return nil
+}
+
+// swapPartitions points the partitioned alias aliasName to the partitions of the partitioned alias target, which
+// a reindex created with the same partitioning, and retires the old partitions. The template of aliasName takes
+// over the partitions of target, so that partitions created later are named after target as well.
+func (esdb *EsDBController) swapPartitions(aliasName string, target string, partitions *esPartitions) error {
+	ctx := context.Background()
+	res, err := esdb.client.Aliases().Index("_all").Do(ctx)
+	if err != nil {
+		return err
+	}
+	oldIndices, newIndices := res.IndicesByAlias(aliasName), res.IndicesByAlias(target)
+	sort.Strings(newIndices)
+
+	// the templates of both match the partitions of target with the same priority, the one of target goes first
+	mappings, err := esMappings(partitions.documentType)
+	if err != nil {
+		return err
+	}
+	if _, err = esdb.client.IndexDeleteIndexTemplate(target).Do(ctx); err != nil && !elastic.IsNotFound(err) {
+		return err
+	}
+	if partitions.Mode == PartitionRollover {
+		if _, err = esdb.client.XPackIlmPutLifecycle().Policy(aliasName).BodyJson(partitions.policy()).Do(ctx); err != nil {
+			return err
+		}
+	}
+	if err = esdb.putPartitionTemplate(ctx, aliasName, partitions.base, partitions.documentType, partitions.Partitioning, mappings); err != nil {
+		return err
+	}
+
+	svc := esdb.client.Alias()
+	for _, index := range oldIndices {
+		svc.Remove(index, aliasName)
+	}
+	for i, index := range newIndices {
+		add := elastic.NewAliasAddAction(aliasName).Index(index)
+		if partitions.Mode == PartitionRollover {
+			// the newest index of a rollover alias is its write index
+			add = add.IsWriteIndex(i == len(newIndices)-1)
+		}
+		svc.Action(add, elastic.NewAliasRemoveAction(target).Index(index))
+	}
+	if _, err = svc.Do(ctx); err != nil {
+		return err
+	}
+	if partitions.Mode == PartitionRollover && len(newIndices) > 0 {
+		_, err = esdb.client.IndexPutSettings(newIndices...).BodyJson(map[string]interface{}{
+			"index.lifecycle.name":           aliasName,
+			"index.lifecycle.rollover_alias": aliasName,
+		}).Do(ctx)
+		if err != nil {
+			return err
+		}
+		if _, err = esdb.client.XPackIlmDeleteLifecycle().Policy(target).Do(ctx); err != nil && !elastic.IsNotFound(err) {
+			return err
+		}
+	}
+	for _, index := range oldIndices {
+		esdb.client.DeleteIndex(index).Do(ctx)
+	}
+
+	esdb.mtx.Lock()
+	defer esdb.mtx.Unlock()
+	esdb.partitions[aliasName] = &esPartitions{Partitioning: partitions.Partitioning, documentType: partitions.documentType, base: partitions.base}
+	delete(esdb.partitions, target)
+	return nil
+}
+
+// partitioned returns the partitions of a partitioned alias, nil for any other index
+func (esdb *EsDBController) partitioned(indexName string) *esPartitions {
+	esdb.mtx.Lock()
+	defer esdb.mtx.Unlock()
+	return esdb.partitions[indexName]
+}
+
+// invalidatePartitions drops the cached indices of a partitioned alias after they changed
+func (esdb *EsDBController) invalidatePartitions(aliasName string) {
+	esdb.mtx.Lock()
+	defer esdb.mtx.Unlock()
+	if partitions := esdb.partitions[aliasName]; partitions != nil {
+		partitions.indices = nil
+	}
+}
+
+// indices returns the indices a query on params searches, the partitions of a partitioned alias
+// which may hold matching documents, or the index of params
+func (esdb *EsDBController) indices(params QueryParams) []string {
+	partitions := esdb.partitioned(params.IndexName)
+	if partitions == nil || partitions.Mode == PartitionRollover {
+		return []string{params.IndexName}
+	}
+
+	esdb.mtx.Lock()
+	indices := partitions.indices
+	esdb.mtx.Unlock()
+	if indices == nil {
+		res, err := esdb.client.Aliases().Index("_all").Do(context.Background())
+		if err != nil {
+			esdb.logger.Warn().Err(err).Str("alias", params.IndexName).Msg("failed to read partitions, searching the alias")
+			return []string{params.IndexName}
+		}
+		indices = res.IndicesByAlias(params.IndexName)
+		esdb.mtx.Lock()
+		partitions.indices = indices
+		esdb.mtx.Unlock()
+	}
+	routed := partitions.route(partitions.base, partitions.documentType, indices, params)
+	if len(routed) == 0 {
+		return []string{params.IndexName} // the filters of the query apply on the whole alias
+	}
+	return routed
+}
+
+// search creates a search on the indices of params. The shards of partitions are prefiltered,
+// skipping the ones whose range of the searched fields does not match before searching them.
+func (esdb *EsDBController) search(params QueryParams) *elastic.SearchService {
+	service := esdb.client.Search().Index(esdb.indices(params)...)
+	if esdb.partitioned(params.IndexName) != nil {
+		service = service.PreFilterShardSize(1)
+	}
+	return service
+}
+
+// writeIndex returns the partition a document written to indexName belongs to, or indexName.
+// Rollover partitions are written through the alias to its write index.
+func (esdb *EsDBController) writeIndex(indexName string, document schema.DocType) string {
+	partitions := esdb.partitioned(indexName)
+	if partitions == nil || partitions.Mode == PartitionRollover {
+		return indexName
+	}
+	block, ok := document.(blockDocument)
+	if !ok {
+		return indexName
+	}
+	value := block.GetBlockNumber()
+	if partitions.Mode == PartitionMonth {
+		value = block.GetBlockTimestamp()
+	}
+	return partitionIndex(partitions.base, partitions.documentType, partitions.key(value))
+}
+
+// written drops the cached indices of a partitioned alias once a partition they lack was written, and so created
+func (esdb *EsDBController) written(aliasName string, partition string) {
+	esdb.mtx.Lock()
+	defer esdb.mtx.Unlock()
+	partitions := esdb.partitions[aliasName]
+	if partitions != nil && partitions.indices != nil && !slices.Contains(partitions.indices, partition) {
+		partitions.indices = nil
+	}
+}
+
+// esPitKeepAlive is how long a point in time is kept open between two pages
+const esPitKeepAlive = "5m"
+
+// scrollQuery returns the query of params with the From and To bounds a scroll puts on its sort field
+func scrollQuery(params QueryParams) elastic.Query {
+	query := esQuery(params)
+	if params.SortField == "" || (params.From == 0 && params.To == 0) {
+		return query
+	}
+	sortRange := elastic.NewRangeQuery(params.SortField)
+	if params.From != 0 {
+		sortRange = sortRange.Gte(params.From)
+	}
+	if params.To != 0 {
+		sortRange = sortRange.Lte(params.To)
+	}
+	return elastic.NewBoolQuery().Filter(query, sortRange)
+}
+
+// SearchPage returns the page of matching documents following cursor.
+// The first page opens a point in time, the following pages read the same snapshot with search_after,
+// so pages are consistent and not limited by index.max_result_window. The point in time is closed after the last page.
+func (esdb *EsDBController) SearchPage(params QueryParams, cursor string, createDocument CreateDocFunction) (*Page, error) {
+	ctx := context.Background()
+	c, err := decodeCursor(cursor)
+	if err != nil {
+		return nil, err
+	}
+	if c == nil {
+		pit, err := esdb.client.OpenPointInTime(esdb.indices(params)...).KeepAlive(esPitKeepAlive).Do(ctx)
+		if elastic.IsNotFound(err) {
+			return &Page{}, nil // index not created yet
+		} else if err != nil {
+			return nil, err
+		}
+		c = &pageCursor{PIT: pit.Id}
+	} else if c.PIT == "" {
+		return nil, ErrInvalidCursor
+	}
+
+	size := pageSize(params)
+	service := esdb.client.Search().
+		PointInTime(elastic.NewPointInTimeWithKeepAlive(c.PIT, esPitKeepAlive)).
+		Query(scrollQuery(params)).
+		Size(size).
+		FetchSourceContext(elastic.NewFetchSourceContext(true).Include(params.SelectFields...))
 	if params.SortField != "" {
-		query := elastic.NewRangeQuery(params.SortField)
-		if params.From != 0 {
-			query = query.From(params.From)
+		service = service.Sort(params.SortField, params.SortAsc)
+	}
+	service = service.Sort("_shard_doc", params.SortAsc) // tiebreaker of the point in time
+	if len(c.After) > 0 {
+		service = service.SearchAfter(c.After...)
+	}
+	res, err := service.Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &Page{Documents: make([]schema.DocType, 0, len(res.Hits.Hits))}
+	for _, hit := range res.Hits.Hits {
+		document := createDocument()
+		if err := json.Unmarshal(hit.Source, document); err != nil {
+			return nil, err
+		}
+		document.SetID(hit.Id)
+		page.Documents = append(page.Documents, document)
+	}
+	if res.PitId != "" {
+		c.PIT = res.PitId
+	}
+	if len(res.Hits.Hits) < size {
+		_, err = esdb.client.ClosePointInTime(c.PIT).Do(ctx)
+		if err != nil && !elastic.IsNotFound(err) {
+			esdb.logger.Warn().Err(err).Msg("failed to close point in time")
+		}
+		return page, nil
+	}
+	c.After = res.Hits.Hits[len(res.Hits.Hits)-1].Sort
+	page.Cursor, err = c.encode()
+	return page, err
+}
+
+// Aggregate computes aggregations over the documents matching params in a single search without hits
+func (esdb *EsDBController) Aggregate(params QueryParams, aggregations ...Aggregation) (map[string]*AggregationResult, error) {
+	service := esdb.search(params).Query(esQuery(params)).Size(0)
+	for _, agg := range aggregations {
+		if err := agg.validate(); err != nil {
+			return nil, err
+		}
+		service = service.Aggregation(agg.Name, esAggregation(agg))
+	}
+	res, err := service.Do(context.Background())
+	if elastic.IsNotFound(err) {
+		res = &elastic.SearchResult{} // index not created yet, aggregate no documents
+	} else if err != nil {
+		return nil, err
+	}
+
+	results := make(map[string]*AggregationResult, len(aggregations))
+	for _, agg := range aggregations {
+		results[agg.Name] = esAggregationResult(res.Aggregations, agg)
+	}
+	return results, nil
+}
+
+// esAggregation translates a validated aggregation
+func esAggregation(agg Aggregation) elastic.Aggregation {
+	switch agg.Type {
+	case AggregationSum:
+		return elastic.NewSumAggregation().Field(agg.Field)
+	case AggregationMin:
+		return elastic.NewMinAggregation().Field(agg.Field)
+	case AggregationMax:
+		return elastic.NewMaxAggregation().Field(agg.Field)
+	case AggregationTerms:
+		terms := elastic.NewTermsAggregation().Field(agg.Field).Size(agg.termsSize())
+		for _, sub := range agg.SubAggregations {
+			terms = terms.SubAggregation(sub.Name, esAggregation(sub))
+		}
+		return terms
+	default:
+		histogram := elastic.NewDateHistogramAggregation().Field(agg.Field).
+			FixedInterval(fmt.Sprintf("%dms", agg.Interval.Milliseconds())).
+			MinDocCount(1)
+		for _, sub := range agg.SubAggregations {
+			histogram = histogram.SubAggregation(sub.Name, esAggregation(sub))
+		}
+		return histogram
+	}
+}
+
+// esAggregationResult reads the result of an aggregation, a missing result is the result of no documents
+func esAggregationResult(aggs elastic.Aggregations, agg Aggregation) *AggregationResult {
+	result := new(AggregationResult)
+	switch agg.Type {
+	case AggregationSum, AggregationMin, AggregationMax:
+		var metric *elastic.AggregationValueMetric
+		switch agg.Type {
+		case AggregationSum:
+			metric, _ = aggs.Sum(agg.Name)
+		case AggregationMin:
+			metric, _ = aggs.Min(agg.Name)
+		default:
+			metric, _ = aggs.Max(agg.Name)
+		}
+		if metric != nil {
+			result.Value = metric.Value
+		}
+		if result.Value == nil && agg.Type == AggregationSum {
+			result.Value = new(float64)
+		}
+	case AggregationTerms:
+		terms, _ := aggs.Terms(agg.Name)
+		if terms == nil {
+			break
+		}
+		for _, item := range terms.Buckets {
+			key := item.KeyNumber.String()
+			if k, ok := item.Key.(string); ok {
+				key = k
+			}
+			result.Buckets = append(result.Buckets, esBucket(key, item.DocCount, item.Aggregations, agg))
 		}
-		if params.To != 0 {
-			query = query.To(params.To)
+	default:
+		histogram, _ := aggs.DateHistogram(agg.Name)
+		if histogram == nil {
+			break
+		}
+		for _, item := range histogram.Buckets {
+			key := strconv.FormatInt(int64(item.Key), 10)
+			result.Buckets = append(result.Buckets, esBucket(key, item.DocCount, item.Aggregations, agg))
 		}
-		scroll = scroll.Query(query)
 	}
-	if params.StringMatch != nil {
-		scroll = scroll.Query(elastic.NewMatchQuery(params.StringMatch.Field, params.StringMatch.Value))
+	return result
+}
+
+// esBucket reads a bucket and its sub aggregations
+func esBucket(key string, docCount int64, aggs elastic.Aggregations, agg Aggregation) Bucket {
+	bucket := Bucket{Key: key, DocCount: docCount, SubAggregations: make(map[string]*AggregationResult, len(agg.SubAggregations))}
+	for _, sub := range agg.SubAggregations {
+		bucket.SubAggregations[sub.Name] = esAggregationResult(aggs, sub)
 	}
+	return bucket
+}
 
-	scroll = scroll.Size(params.Size).Sort(params.SortField, params.SortAsc).FetchSourceContext(fsc)
+// Scroll creates a new scroll instance with the specified query and unmarshal function,
+// it reads the pages of SearchPage
+func (esdb *EsDBController) Scroll(params QueryParams, createDocument CreateDocFunction) ScrollInstance {
 	return &EsScrollInstance{
-		scrollService:  scroll,
-		ctx:            context.Background(),
+		esdb:           esdb,
+		params:         params,
 		createDocument: createDocument,
 	}
 }
 
 // EsScrollInstance is an instance of a scroll for ES
 type EsScrollInstance struct {
-	scrollService  *elastic.ScrollService
-	result         *elastic.SearchResult
-	current        int
-	currentLength  int
-	ctx            context.Context
+	esdb           *EsDBController
+	params         QueryParams
 	createDocument CreateDocFunction
+
+	page    *Page
+	current int
 }
 
 // Next returns the next document of a scroll or io.EOF
 func (scroll *EsScrollInstance) Next() (schema.DocType, error) {
-	// Load next part of scroll
-	if scroll.result == nil || scroll.current >= scroll.currentLength {
-		result, err := scroll.scrollService.Do(scroll.ctx)
+	// Load next page
+	if scroll.page == nil || scroll.current >= len(scroll.page.Documents) {
+		if scroll.page != nil && scroll.page.Cursor == "" {
+			return nil, io.EOF
+		}
+		cursor := ""
+		if scroll.page != nil {
+			cursor = scroll.page.Cursor
+		}
+		page, err := scroll.esdb.SearchPage(scroll.params, cursor, scroll.createDocument)
 		if err != nil {
-			return nil, err // returns io.EOF when scroll is done
+			return nil, err
+		}
+		scroll.page, scroll.current = page, 0
+		if len(page.Documents) == 0 {
+			return nil, io.EOF
 		}
-		scroll.result = result
-		scroll.current = 0
-		scroll.currentLength = len(result.Hits.Hits)
 	}
 
 	// Return next document
-	if scroll.current < scroll.currentLength {
-		hit := scroll.result.Hits.Hits[scroll.current]
-		scroll.current++
+	document := scroll.page.Documents[scroll.current]
+	scroll.current++
+	return document, nil
+}
 
-		unmarshalled := scroll.createDocument()
-		if err := json.Unmarshal([]byte(hit.Source), unmarshalled); err != nil {
-			return nil, err
-		}
-		unmarshalled.SetID(hit.Id)
-		return unmarshalled, nil
+// InsertBulk creates a bulk instance which creates documents, skipping the ones that already exist
+func (esdb *EsDBController) InsertBulk(indexName string) BulkInstance {
+	return &EsBulkInstance{
+		esdb:   esdb,
+		logger: esdb.logger,
+		index:  indexName,
+		bulk:   esdb.client.Bulk().Index(indexName),
+		ctx:    context.Background(),
 	}
-	return nil, io.EOF
 }
 
-func (esdb *EsDBController) InsertBulk(indexName string) BulkInstance {
+// UpsertBulk creates a bulk instance which creates documents or overwrites the existing ones
+func (esdb *EsDBController) UpsertBulk(indexName string) BulkInstance {
+	return &EsBulkInstance{
+		esdb:   esdb,
+		logger: esdb.logger,
+		index:  indexName,
+		bulk:   esdb.client.Bulk().Index(indexName),
+		ctx:    context.Background(),
+		upsert: true,
+	}
+}
+
+// UpsertLatestBulk creates a bulk instance which creates documents or overwrites the existing ones of the same or
+// an earlier block, so that a late write never replaces a newer document
+func (esdb *EsDBController) UpsertLatestBulk(indexName string) BulkInstance {
 	return &EsBulkInstance{
-		bulk: esdb.client.Bulk().Index(indexName),
-		ctx:  context.Background(),
+		esdb:   esdb,
+		logger: esdb.logger,
+		index:  indexName,
+		bulk:   esdb.client.Bulk().Index(indexName),
+		ctx:    context.Background(),
+		upsert: true,
+		latest: true,
 	}
 }
 
+// esLatestScript overwrites a stored document unless it is of a later block, the upsert creates missing documents
+const esLatestScript = "if (ctx._source." + latestField + " != null && ctx._source." + latestField + " > params.doc." + latestField + ") { ctx.op = 'noop' } else { ctx._source.putAll(params.doc) }"
+
+const (
+	bulkMaxRetry     = 5
+	bulkRetryBackoff = 200 * time.Millisecond
+)
+
 type EsBulkInstance struct {
-	bulk *elastic.BulkService
-	ctx  context.Context
+	esdb      *EsDBController
+	logger    *zerolog.Logger
+	index     string
+	bulk      *elastic.BulkService
+	ctx       context.Context
+	upsert    bool
+	latest    bool
+	requests  []elastic.BulkableRequest
+	documents []schema.DocType
+
+	// partitions written by the bulk when index is a partitioned alias
+	partitions map[string]struct{}
 }
 
 func (bulk *EsBulkInstance) Add(document schema.DocType) {
-	req := elastic.NewBulkIndexRequest().OpType("create").Id(document.GetID()).Doc(document)
-	// req := elastic.NewBulkUpdateRequest().Id(document.GetID()).Doc(document).DocAsUpsert(true)
-	bulk.bulk.Add(req)
+	var req elastic.BulkableRequest
+	index := bulk.esdb.writeIndex(bulk.index, document)
+	if bulk.latest {
+		script := elastic.NewScript(esLatestScript).Param("doc", document)
+		req = elastic.NewBulkUpdateRequest().Index(index).Id(document.GetID()).Script(script).Upsert(document)
+	} else if bulk.upsert {
+		req = elastic.NewBulkUpdateRequest().Index(index).Id(document.GetID()).Doc(document).DocAsUpsert(true)
+	} else {
+		req = elastic.NewBulkIndexRequest().Index(index).OpType("create").Id(document.GetID()).Doc(document)
+	}
+	bulk.requests = append(bulk.requests, req)
+	bulk.documents = append(bulk.documents, document)
+	if index != bulk.index {
+		if bulk.partitions == nil {
+			bulk.partitions = make(map[string]struct{})
+		}
+		bulk.partitions[index] = struct{}{}
+	}
 }
 
+// Commit sends the bulk and inspects every item of the response.
+// Items rejected with a retryable status are resent with backoff, documents which already exist are skipped,
+// and any other rejection is returned as a *BulkError.
 func (bulk *EsBulkInstance) Commit() error {
-	_, err := bulk.bulk.Do(bulk.ctx)
-	return err
+	requests, documents := bulk.requests, bulk.documents
+	bulk.requests, bulk.documents = nil, nil
+	defer func() {
+		for partition := range bulk.partitions {
+			bulk.esdb.written(bulk.index, partition)
+		}
+		bulk.partitions = nil
+	}()
+
+	for retry := 0; len(requests) > 0; retry++ {
+		bulk.bulk.Add(requests...)
+		res, err := bulk.bulk.Do(bulk.ctx)
+		if err != nil {
+			bulk.bulk.Reset()
+			return err
+		}
+
+		var failed []BulkItemError
+		var retryRequests []elastic.BulkableRequest
+		var retryDocuments []schema.DocType
+		for idx, item := range res.Items {
+			for _, result := range item {
+				if result.Error == nil || (!bulk.upsert && result.Status == http.StatusConflict) {
+					continue // written, or already written by a previous run
+				}
+				itemErr := BulkItemError{
+					Index:  result.Index,
+					Id:     result.Id,
+					Status: result.Status,
+					Type:   result.Error.Type,
+					Reason: result.Error.Reason,
+				}
+				if itemErr.Retryable() && retry < bulkMaxRetry {
+					retryRequests = append(retryRequests, requests[idx])
+					retryDocuments = append(retryDocuments, documents[idx])
+					continue
+				}
+				doc, _ := json.Marshal(documents[idx])
+				bulk.logger.Error().Str("index", itemErr.Index).Str("id", itemErr.Id).Int("status", itemErr.Status).
+					Str("type", itemErr.Type).Str("reason", itemErr.Reason).RawJSON("document", doc).Msg("bulk item rejected")
+				failed = append(failed, itemErr)
+			}
+		}
+		if len(failed) > 0 {
+			return &BulkError{Items: failed}
+		}
+		if len(retryRequests) > 0 {
+			bulk.logger.Warn().Int("retry", retry+1).Int("items", len(retryRequests)).Msg("bulk items throttled, retrying")
+			time.Sleep(bulkRetryBackoff << retry)
+		}
+		requests, documents = retryRequests, retryDocuments
+	}
+	return nil
 }
@@ -0,0 +1,44 @@
+package db
+
+import (
+	"io"
+)
+
+const exportBatchSize = 5000
+
+// Export copies every document of indexName from src into the index of the same name in dst,
+// e.g. to publish a range backfilled into an embedded store to elasticsearch.
+// Documents which already exist in dst are skipped, so an interrupted export can be restarted.
+func Export(src DbController, dst DbController, indexName string, createDocument CreateDocFunction) (uint64, error) {
+	scroll := src.Scroll(QueryParams{
+		IndexName: indexName,
+		Size:      exportBatchSize,
+		SortField: "block_number",
+		SortAsc:   true,
+	}, createDocument)
+
+	var exported uint64
+	bulk := dst.InsertBulk(indexName)
+	pending := 0
+	for {
+		doc, err := scroll.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return exported, err
+		}
+		bulk.Add(doc)
+		pending++
+		if pending == exportBatchSize {
+			if err = bulk.Commit(); err != nil {
+				return exported, err
+			}
+			exported += uint64(pending)
+			pending = 0
+		}
+	}
+	if err := bulk.Commit(); err != nil {
+		return exported, err
+	}
+	return exported + uint64(pending), nil
+}
@@ -0,0 +1,306 @@
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/rabbitprincess/eth-indexer/indexer/schema"
+)
+
+// docFields holds the json fields of a document, backends without a query engine evaluate QueryParams on it
+type docFields map[string]any
+
+// decodeFields decodes the json source of a document, numbers are kept as json.Number to stay exact
+func decodeFields(source []byte) (docFields, error) {
+	decoder := json.NewDecoder(bytes.NewReader(source))
+	decoder.UseNumber()
+	fields := make(docFields)
+	if err := decoder.Decode(&fields); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
+
+// String returns a field as string, numbers are formatted in decimal
+func (f docFields) String(field string) string {
+	switch v := f[field].(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	return ""
+}
+
+// Uint returns a numeric field, ok is false if the field is missing or not an unsigned integer
+func (f docFields) Uint(field string) (uint64, bool) {
+	switch v := f[field].(type) {
+	case json.Number:
+		n, err := strconv.ParseUint(v.String(), 10, 64)
+		return n, err == nil
+	case string:
+		n, err := strconv.ParseUint(v, 10, 64)
+		return n, err == nil
+	}
+	return 0, false
+}
+
+// Float returns a numeric field as float64, ok is false if the field is missing or not a number
+func (f docFields) Float(field string) (float64, bool) {
+	switch v := f[field].(type) {
+	case json.Number:
+		n, err := v.Float64()
+		return n, err == nil
+	case string:
+		n, err := strconv.ParseFloat(v, 64)
+		return n, err == nil
+	}
+	return 0, false
+}
+
+// latestField orders the writes of UpsertLatestBulk, a document never replaces one of a later block
+const latestField = "block_number"
+
+// supersedes reports whether the stored document is of a later block than the written one and is kept
+func supersedes(stored, written docFields) bool {
+	storedBlock, ok := stored.Uint(latestField)
+	if !ok {
+		return false
+	}
+	writtenBlock, _ := written.Uint(latestField)
+	return storedBlock > writtenBlock
+}
+
+// matchParams reports whether a document with id and fields matches the conditions of params
+func matchParams(params QueryParams, id string, fields docFields) bool {
+	return matchBool(params.query(), id, fields)
+}
+
+// matchBool evaluates a bool query on a document, a nil query matches every document
+func matchBool(q *BoolQuery, id string, fields docFields) bool {
+	if q == nil {
+		return true
+	}
+	for _, query := range q.Must {
+		if !matchQuery(query, id, fields) {
+			return false
+		}
+	}
+	for _, query := range q.Filter {
+		if !matchQuery(query, id, fields) {
+			return false
+		}
+	}
+	for _, query := range q.MustNot {
+		if matchQuery(query, id, fields) {
+			return false
+		}
+	}
+	if len(q.Should) == 0 || len(q.Must) > 0 || len(q.Filter) > 0 {
+		return true
+	}
+	for _, query := range q.Should {
+		if matchQuery(query, id, fields) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchQuery evaluates a single condition on a document
+func matchQuery(query Query, id string, fields docFields) bool {
+	switch {
+	case query.Range != nil:
+		n, ok := fields.Uint(query.Range.Field)
+		return ok && n >= query.Range.Min && n <= query.Range.Max
+	case query.Match != nil:
+		return fieldValue(query.Match.Field, id, fields) == query.Match.Value
+	case query.Terms != nil:
+		value := fieldValue(query.Terms.Field, id, fields)
+		for _, term := range query.Terms.Values {
+			if value == term {
+				return true
+			}
+		}
+		return false
+	case query.Exists != nil:
+		if query.Exists.Field == "id" || query.Exists.Field == "_id" {
+			return true
+		}
+		return fields[query.Exists.Field] != nil
+	case query.Bool != nil:
+		return matchBool(query.Bool, id, fields)
+	}
+	return true
+}
+
+// fieldValue returns a field as string, id and _id address the document id
+func fieldValue(field string, id string, fields docFields) string {
+	if field == "id" || field == "_id" {
+		return id
+	}
+	return fields.String(field)
+}
+
+// matchScrollRange reports whether a document is within the From and To bounds a scroll puts on its sort field
+func matchScrollRange(params QueryParams, fields docFields) bool {
+	if params.SortField == "" || (params.From == 0 && params.To == 0) {
+		return true
+	}
+	n, ok := fields.Uint(params.SortField)
+	if !ok {
+		return false
+	}
+	return (params.From == 0 || n >= params.From) && (params.To == 0 || n <= params.To)
+}
+
+// scrollMatched keeps the documents within the scroll range of params and sorts them
+func scrollMatched(params QueryParams, docs []*matchedDoc) []*matchedDoc {
+	matched := docs[:0]
+	for _, doc := range docs {
+		if matchScrollRange(params, doc.fields) {
+			matched = append(matched, doc)
+		}
+	}
+	sortMatched(params, matched)
+	return matched
+}
+
+// pageMatched returns the page of scrolled documents following the cursor, which holds the sort value and id of the last document
+func pageMatched(params QueryParams, docs []*matchedDoc, cursor string, createDocument CreateDocFunction) (*Page, error) {
+	c, err := decodeCursor(cursor)
+	if err != nil {
+		return nil, err
+	}
+	start := 0
+	if c != nil {
+		if len(c.After) != 2 {
+			return nil, ErrInvalidCursor
+		}
+		lastID, ok := c.After[1].(string)
+		if !ok {
+			return nil, ErrInvalidCursor
+		}
+		last := docFields{params.SortField: c.After[0]}
+		for start < len(docs) {
+			cmp := 0
+			if params.SortField != "" {
+				cmp = compareFields(docs[start].fields, last, params.SortField)
+			}
+			if cmp == 0 {
+				cmp = strings.Compare(docs[start].id, lastID)
+			}
+			if (params.SortAsc && cmp > 0) || (!params.SortAsc && cmp < 0) {
+				break
+			}
+			start++
+		}
+	}
+
+	end := min(start+pageSize(params), len(docs))
+	page := &Page{Documents: make([]schema.DocType, 0, end-start)}
+	for _, doc := range docs[start:end] {
+		document, err := unmarshalMatched(doc, createDocument)
+		if err != nil {
+			return nil, err
+		}
+		page.Documents = append(page.Documents, document)
+	}
+	if end < len(docs) {
+		last := docs[end-1]
+		next := &pageCursor{After: []any{last.fields[params.SortField], last.id}}
+		if page.Cursor, err = next.encode(); err != nil {
+			return nil, err
+		}
+	}
+	return page, nil
+}
+
+// matchedDoc is a document found by a backend scanning its records
+type matchedDoc struct {
+	id     string
+	source []byte
+	fields docFields
+}
+
+// compareFields orders two values of a field, numbers numerically and anything else as strings
+func compareFields(a, b docFields, field string) int {
+	an, aok := a.Uint(field)
+	bn, bok := b.Uint(field)
+	if aok && bok {
+		switch {
+		case an < bn:
+			return -1
+		case an > bn:
+			return 1
+		}
+		return 0
+	}
+	as, bs := a.String(field), b.String(field)
+	switch {
+	case as < bs:
+		return -1
+	case as > bs:
+		return 1
+	}
+	return 0
+}
+
+// sortMatched sorts documents by the sort field of params, the id breaks ties like in the sql backends
+func sortMatched(params QueryParams, docs []*matchedDoc) {
+	sort.SliceStable(docs, func(i, j int) bool {
+		cmp := 0
+		if params.SortField != "" {
+			cmp = compareFields(docs[i].fields, docs[j].fields, params.SortField)
+		}
+		if cmp == 0 {
+			switch {
+			case docs[i].id < docs[j].id:
+				cmp = -1
+			case docs[i].id > docs[j].id:
+				cmp = 1
+			}
+		}
+		if params.SortAsc {
+			return cmp < 0
+		}
+		return cmp > 0
+	})
+}
+
+// unmarshalMatched creates a document from its source
+func unmarshalMatched(doc *matchedDoc, createDocument CreateDocFunction) (schema.DocType, error) {
+	document := createDocument()
+	if err := json.Unmarshal(doc.source, document); err != nil {
+		return nil, err
+	}
+	document.SetID(doc.id)
+	return document, nil
+}
+
+// matchedScrollInstance scrolls through documents a backend has already matched and sorted
+type matchedScrollInstance struct {
+	docs           []*matchedDoc
+	current        int
+	err            error
+	createDocument CreateDocFunction
+}
+
+// Next returns the next document of a scroll or io.EOF
+func (scroll *matchedScrollInstance) Next() (schema.DocType, error) {
+	if scroll.err != nil {
+		return nil, scroll.err
+	}
+	if scroll.current >= len(scroll.docs) {
+		return nil, io.EOF
+	}
+	doc := scroll.docs[scroll.current]
+	scroll.current++
+	return unmarshalMatched(doc, scroll.createDocument)
+}
@@ -0,0 +1,312 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/rabbitprincess/eth-indexer/indexer/schema"
+)
+
+// MemoryDBController implements DbController in memory, for tests and dry runs.
+// Documents are kept as json like elasticsearch keeps their source, so they are copied on every read and write.
+type MemoryDBController struct {
+	mtx     sync.RWMutex
+	indices map[string]map[string][]byte
+	aliases map[string]string
+}
+
+// NewMemoryDbController creates an empty MemoryDBController
+func NewMemoryDbController() *MemoryDBController {
+	return &MemoryDBController{
+		indices: make(map[string]map[string][]byte),
+		aliases: make(map[string]string),
+	}
+}
+
+// resolve returns the index behind indexName if it is an alias, the caller holds the lock
+func (m *MemoryDBController) resolve(indexName string) string {
+	if index, ok := m.aliases[indexName]; ok {
+		return index
+	}
+	return indexName
+}
+
+// scan finds the documents matching params
+func (m *MemoryDBController) scan(params QueryParams) ([]*matchedDoc, error) {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	var docs []*matchedDoc
+	for id, source := range m.indices[m.resolve(params.IndexName)] {
+		fields, err := decodeFields(source)
+		if err != nil {
+			return nil, err
+		}
+		if matchParams(params, id, fields) {
+			docs = append(docs, &matchedDoc{id: id, source: source, fields: fields})
+		}
+	}
+	return docs, nil
+}
+
+// write stores documents, existing documents are only overwritten if upsert is set,
+// and with latest only by documents of the same or a later block
+func (m *MemoryDBController) write(indexName string, documents []schema.DocType, upsert, latest bool) error {
+	sources := make([][]byte, len(documents))
+	for i, document := range documents {
+		source, err := json.Marshal(document)
+		if err != nil {
+			return err
+		}
+		sources[i] = source
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	index := m.resolve(indexName)
+	if m.indices[index] == nil {
+		m.indices[index] = make(map[string][]byte)
+	}
+	for i, document := range documents {
+		stored, exists := m.indices[index][document.GetID()]
+		if exists && !upsert {
+			continue
+		}
+		if exists && latest {
+			storedFields, err := decodeFields(stored)
+			if err != nil {
+				return err
+			}
+			fields, err := decodeFields(sources[i])
+			if err != nil {
+				return err
+			}
+			if supersedes(storedFields, fields) {
+				continue
+			}
+		}
+		m.indices[index][document.GetID()] = sources[i]
+	}
+	return nil
+}
+
+func (m *MemoryDBController) Exists(indexName string, id string) bool {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	_, exists := m.indices[m.resolve(indexName)][id]
+	return exists
+}
+
+// Insert inserts a single document, overwriting the document with the same id
+func (m *MemoryDBController) Insert(document schema.DocType, indexName string) error {
+	return m.write(indexName, []schema.DocType{document}, true, false)
+}
+
+// Update creates or overwrites the document with id
+func (m *MemoryDBController) Update(document schema.DocType, indexName string, id string) error {
+	document.SetID(id)
+	return m.Insert(document, indexName)
+}
+
+// Delete removes documents specified by the query params
+func (m *MemoryDBController) Delete(params QueryParams) (uint64, error) {
+	docs, err := m.scan(params)
+	if err != nil {
+		return 0, err
+	}
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	index := m.resolve(params.IndexName)
+	for _, doc := range docs {
+		delete(m.indices[index], doc.id)
+	}
+	return uint64(len(docs)), nil
+}
+
+// Count returns the number of documents matching the query params
+func (m *MemoryDBController) Count(params QueryParams) (int64, error) {
+	docs, err := m.scan(params)
+	return int64(len(docs)), err
+}
+
+// SelectOne selects a single document
+func (m *MemoryDBController) SelectOne(params QueryParams, createDocument CreateDocFunction) (schema.DocType, error) {
+	docs, err := m.scan(params)
+	if err != nil {
+		return nil, err
+	}
+	sortMatched(params, docs)
+	if params.From >= uint64(len(docs)) {
+		return nil, nil
+	}
+	return unmarshalMatched(docs[params.From], createDocument)
+}
+
+// MultiGet fetches documents by id, ids which are not found are skipped
+func (m *MemoryDBController) MultiGet(indexName string, ids []string, createDocument CreateDocFunction) ([]schema.DocType, error) {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	index := m.indices[m.resolve(indexName)]
+	documents := make([]schema.DocType, 0, len(ids))
+	for _, id := range ids {
+		source, exists := index[id]
+		if !exists {
+			continue
+		}
+		document, err := unmarshalMatched(&matchedDoc{id: id, source: source}, createDocument)
+		if err != nil {
+			return nil, err
+		}
+		documents = append(documents, document)
+	}
+	return documents, nil
+}
+
+// Scroll creates a new scroll instance over the sorted matching documents
+func (m *MemoryDBController) Scroll(params QueryParams, createDocument CreateDocFunction) ScrollInstance {
+	docs, err := m.scan(params)
+	if err == nil {
+		docs = scrollMatched(params, docs)
+	}
+	return &matchedScrollInstance{
+		docs:           docs,
+		err:            err,
+		createDocument: createDocument,
+	}
+}
+
+// Aggregate computes aggregations over the documents matching params
+func (m *MemoryDBController) Aggregate(params QueryParams, aggregations ...Aggregation) (map[string]*AggregationResult, error) {
+	docs, err := m.scan(params)
+	if err != nil {
+		return nil, err
+	}
+	return aggregateMatched(docs, aggregations)
+}
+
+// SearchPage returns the page of matching documents following cursor
+func (m *MemoryDBController) SearchPage(params QueryParams, cursor string, createDocument CreateDocFunction) (*Page, error) {
+	docs, err := m.scan(params)
+	if err != nil {
+		return nil, err
+	}
+	return pageMatched(params, scrollMatched(params, docs), cursor, createDocument)
+}
+
+// UpdateAlias points the alias to indexName and deletes the index it pointed to before
+func (m *MemoryDBController) UpdateAlias(aliasName string, indexName string) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	oldIndex, ok := m.aliases[aliasName]
+	if !ok {
+		oldIndex = aliasName // an index written under the alias name before aliases were used
+	}
+	if oldIndex != indexName {
+		delete(m.indices, oldIndex)
+	}
+	m.aliases[aliasName] = indexName
+	return nil
+}
+
+// GetExistingIndexPrefix checks for the index behind an alias and returns its prefix, if any
+func (m *MemoryDBController) GetExistingIndexPrefix(aliasName string, documentType string) (bool, string, error) {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	if index, ok := m.aliases[aliasName]; ok {
+		return true, strings.TrimSuffix(index, documentType), nil
+	}
+	return false, "", nil
+}
+
+// CreateIndex creates an empty index
+func (m *MemoryDBController) CreateIndex(indexName string, documentType string) error {
+	if !strings.HasSuffix(indexName, documentType) {
+		return fmt.Errorf("index %s is not named after document type %s", indexName, documentType)
+	}
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if m.indices[indexName] == nil {
+		m.indices[indexName] = make(map[string][]byte)
+	}
+	return nil
+}
+
+// Dump writes every document as a json line of index, id and source, ordered by index and id
+func (m *MemoryDBController) Dump(w io.Writer) error {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	indices := make([]string, 0, len(m.indices))
+	for index := range m.indices {
+		indices = append(indices, index)
+	}
+	sort.Strings(indices)
+
+	encoder := json.NewEncoder(w)
+	for _, index := range indices {
+		ids := make([]string, 0, len(m.indices[index]))
+		for id := range m.indices[index] {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			err := encoder.Encode(struct {
+				Index  string          `json:"index"`
+				Id     string          `json:"id"`
+				Source json.RawMessage `json:"source"`
+			}{index, id, m.indices[index][id]})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// InsertBulk creates a bulk instance which creates documents, skipping the ones that already exist
+func (m *MemoryDBController) InsertBulk(indexName string) BulkInstance {
+	return &MemoryBulkInstance{
+		m:         m,
+		indexName: indexName,
+	}
+}
+
+// UpsertBulk creates a bulk instance which creates documents or overwrites the existing ones
+func (m *MemoryDBController) UpsertBulk(indexName string) BulkInstance {
+	return &MemoryBulkInstance{
+		m:         m,
+		indexName: indexName,
+		upsert:    true,
+	}
+}
+
+// UpsertLatestBulk creates a bulk instance which creates documents or overwrites the existing ones of the same or
+// an earlier block, so that a late write never replaces a newer document
+func (m *MemoryDBController) UpsertLatestBulk(indexName string) BulkInstance {
+	return &MemoryBulkInstance{
+		m:         m,
+		indexName: indexName,
+		upsert:    true,
+		latest:    true,
+	}
+}
+
+type MemoryBulkInstance struct {
+	m         *MemoryDBController
+	indexName string
+	upsert    bool
+	latest    bool
+	documents []schema.DocType
+}
+
+func (bulk *MemoryBulkInstance) Add(document schema.DocType) {
+	bulk.documents = append(bulk.documents, document)
+}
+
+func (bulk *MemoryBulkInstance) Commit() error {
+	documents := bulk.documents
+	bulk.documents = nil
+	return bulk.m.write(bulk.indexName, documents, bulk.upsert, bulk.latest)
+}
@@ -0,0 +1,24 @@
+package db
+
+import (
+	"context"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemory(t *testing.T) {
+	testDbController(t, NewMemoryDbController())
+}
+
+func TestNewDbController(t *testing.T) {
+	logger := zerolog.Nop()
+	controller, err := NewDbController(context.Background(), &logger, "memory://")
+	require.NoError(t, err)
+	require.IsType(t, &MemoryDBController{}, controller)
+
+	controller, err = NewDbController(context.Background(), &logger, "")
+	require.Error(t, err)
+	require.Nil(t, controller)
+}
@@ -0,0 +1,225 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PartitionMode selects how the documents of a partitioned alias are split into indices
+type PartitionMode string
+
+const (
+	// PartitionBlocks splits documents into indices of a fixed number of blocks
+	PartitionBlocks PartitionMode = "blocks"
+	// PartitionMonth splits documents into indices of a calendar month of their block timestamp
+	PartitionMonth PartitionMode = "month"
+	// PartitionRollover writes to the newest index of the alias, an ILM policy rolls it over on its conditions
+	PartitionRollover PartitionMode = "rollover"
+)
+
+// maxRoutedPartitions is the number of partitions above which a query searches the whole alias instead
+const maxRoutedPartitions = 64
+
+// Partitioning splits an index into partitions behind its alias. The partitions are created from an index template
+// carrying the mappings of the document type and the shard and replica counts, which also persists the partitioning.
+type Partitioning struct {
+	Mode PartitionMode `json:"mode"`
+	// Blocks is the number of blocks of a partition of PartitionBlocks
+	Blocks   uint64 `json:"blocks,omitempty"`
+	Shards   int    `json:"shards,omitempty"`
+	Replicas int    `json:"replicas,omitempty"`
+	// Rollover conditions of PartitionRollover, at least one is required
+	RolloverMaxSize string `json:"rollover_max_size,omitempty"` // e.g. "50gb"
+	RolloverMaxDocs int64  `json:"rollover_max_docs,omitempty"`
+	RolloverMaxAge  string `json:"rollover_max_age,omitempty"` // e.g. "30d"
+}
+
+// partitionMeta is the _meta of the index template of a partitioned alias
+type partitionMeta struct {
+	Partitioning Partitioning `json:"partitioning"`
+	// Base is the name the partitions are named after, the alias unless it was reindexed into the partitions of
+	// a versioned alias
+	Base string `json:"base"`
+}
+
+// decodePartitionMeta reads the partitioning persisted in the _meta of an index template, nil if it holds none
+func decodePartitionMeta(meta map[string]interface{}) (*partitionMeta, error) {
+	if meta["partitioning"] == nil {
+		return nil, nil
+	}
+	source, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+	var decoded partitionMeta
+	if err = json.Unmarshal(source, &decoded); err != nil {
+		return nil, err
+	}
+	if err = decoded.Partitioning.validate(); err != nil {
+		return nil, err
+	}
+	return &decoded, nil
+}
+
+func (p Partitioning) validate() error {
+	switch p.Mode {
+	case PartitionBlocks:
+		if p.Blocks == 0 {
+			return errors.New("block partitions require the number of blocks of a partition")
+		}
+	case PartitionMonth:
+	case PartitionRollover:
+		if p.RolloverMaxSize == "" && p.RolloverMaxDocs == 0 && p.RolloverMaxAge == "" {
+			return errors.New("rollover partitions require a rollover condition")
+		}
+	default:
+		return fmt.Errorf("unknown partition mode %q", p.Mode)
+	}
+	if p.Shards < 0 || p.Replicas < 0 {
+		return errors.New("shard and replica counts must not be negative")
+	}
+	return nil
+}
+
+// field is the document field the partitions are split by
+func (p Partitioning) field() string {
+	if p.Mode == PartitionMonth {
+		return "block_timestamp"
+	}
+	return "block_number"
+}
+
+// blockDocument is implemented by the documents of a block, partitioned indices are split by their block
+type blockDocument interface {
+	GetBlockNumber() uint64
+	GetBlockTimestamp() uint64
+}
+
+// key returns the partition key of the block number or timestamp value.
+// Block keys are the zero padded first block of the partition, month keys the year and month.
+func (p Partitioning) key(value uint64) string {
+	if p.Mode == PartitionMonth {
+		return time.UnixMilli(int64(value)).UTC().Format("m200601")
+	}
+	return fmt.Sprintf("b%012d", value/p.Blocks*p.Blocks)
+}
+
+// bounds returns the values of the partition key, the end is exclusive
+func (p Partitioning) bounds(key string) (start, end uint64, ok bool) {
+	if p.Mode == PartitionMonth {
+		month, err := time.Parse("m200601", key)
+		if err != nil {
+			return 0, 0, false
+		}
+		return uint64(month.UnixMilli()), uint64(month.AddDate(0, 1, 0).UnixMilli()), true
+	}
+	if !strings.HasPrefix(key, "b") {
+		return 0, 0, false
+	}
+	start, err := strconv.ParseUint(key[1:], 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return start, start + p.Blocks, true
+}
+
+// partitionIndex names the partition of key after base, the key goes between the prefix and the document type
+// like the version of a reindex, e.g. b000001000000_balance_change_history
+func partitionIndex(base, documentType, key string) string {
+	return strings.TrimSuffix(base, documentType) + key + "_" + documentType
+}
+
+// rolloverIndex names the first index of a rollover alias after base, ILM requires a numeric suffix it increments
+func rolloverIndex(base string) string {
+	return base + "-000001"
+}
+
+// indexPattern matches the partitions named after base
+func (p Partitioning) indexPattern(base, documentType string) string {
+	if p.Mode == PartitionRollover {
+		return base + "-*"
+	}
+	return partitionIndex(base, documentType, p.key(0)[:1]+"*")
+}
+
+// route returns the partitions named after base of indices which may hold documents matching params.
+// Indices which are not such partitions are always searched, nil means the whole alias is searched.
+func (p Partitioning) route(base, documentType string, indices []string, params QueryParams) []string {
+	if p.Mode == PartitionRollover || len(indices) == 0 {
+		return nil // rolled over indices are skipped by the can_match phase of the search
+	}
+	bounds := params.filterRange(p.field())
+	if bounds == nil {
+		return nil
+	}
+	prefix, suffix := strings.TrimSuffix(base, documentType), "_"+documentType
+	var routed []string
+	for _, index := range indices {
+		key := strings.TrimSuffix(strings.TrimPrefix(index, prefix), suffix)
+		start, end, ok := p.bounds(key)
+		if !ok || (start <= bounds.Max && bounds.Min < end) {
+			routed = append(routed, index)
+		}
+	}
+	if len(routed) > maxRoutedPartitions {
+		return nil
+	}
+	sort.Strings(routed)
+	return routed
+}
+
+// template returns the index template of the partitions named after base, block and month partitions join the alias
+// on creation. Its _meta persists the partitioning, see decodePartitionMeta.
+func (p Partitioning) template(aliasName, base, documentType string, mappings map[string]interface{}) map[string]interface{} {
+	settings := map[string]interface{}{}
+	if p.Shards > 0 {
+		settings["number_of_shards"] = p.Shards
+	}
+	if p.Replicas > 0 {
+		settings["number_of_replicas"] = p.Replicas
+	}
+	template := map[string]interface{}{
+		"settings": settings,
+		"mappings": mappings,
+	}
+	if p.Mode == PartitionRollover {
+		settings["index.lifecycle.name"] = aliasName
+		settings["index.lifecycle.rollover_alias"] = aliasName
+	} else {
+		template["aliases"] = map[string]interface{}{aliasName: map[string]interface{}{}}
+	}
+	return map[string]interface{}{
+		"index_patterns": []string{p.indexPattern(base, documentType)},
+		"priority":       100,
+		"template":       template,
+		"_meta":          partitionMeta{Partitioning: p, Base: base},
+	}
+}
+
+// policy returns the ILM policy rolling over the write index of a rollover alias
+func (p Partitioning) policy() map[string]interface{} {
+	rollover := map[string]interface{}{}
+	if p.RolloverMaxSize != "" {
+		rollover["max_size"] = p.RolloverMaxSize
+	}
+	if p.RolloverMaxDocs > 0 {
+		rollover["max_docs"] = p.RolloverMaxDocs
+	}
+	if p.RolloverMaxAge != "" {
+		rollover["max_age"] = p.RolloverMaxAge
+	}
+	return map[string]interface{}{
+		"policy": map[string]interface{}{
+			"phases": map[string]interface{}{
+				"hot": map[string]interface{}{
+					"actions": map[string]interface{}{"rollover": rollover},
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,101 @@
+package db
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/rabbitprincess/eth-indexer/indexer/schema"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPartitioningRoute(t *testing.T) {
+	alias, docType := "mainnet_"+schema.TableBalanceChangeHistory, schema.TableBalanceChangeHistory
+	blocks := Partitioning{Mode: PartitionBlocks, Blocks: 1000}
+	require.NoError(t, blocks.validate())
+	require.Equal(t, "b000000002000", blocks.key(2999))
+	require.Equal(t, "mainnet_b000000002000_balance_change_history", partitionIndex(alias, docType, blocks.key(2999)))
+
+	indices := []string{
+		partitionIndex(alias, docType, blocks.key(0)),
+		partitionIndex(alias, docType, blocks.key(1000)),
+		partitionIndex(alias, docType, blocks.key(2000)),
+		"v1_" + docType, // reindexed before partitioning, always searched
+	}
+	routed := blocks.route(alias, docType, indices, QueryParams{
+		IndexName: alias,
+		Bool:      Filter(Match("account", "0xaa"), Range("block_number", 999, 1000)),
+	})
+	require.Equal(t, []string{indices[0], indices[1], indices[3]}, routed)
+	routed = blocks.route(alias, docType, indices, QueryParams{
+		IndexName:    alias,
+		IntegerRange: &IntegerRangeQuery{Field: "block_number", Min: 2500, Max: 1 << 62},
+	})
+	require.Equal(t, []string{indices[2], indices[3]}, routed)
+	// unbounded queries search the alias
+	require.Nil(t, blocks.route(alias, docType, indices, QueryParams{IndexName: alias}))
+
+	month := Partitioning{Mode: PartitionMonth}
+	jan := uint64(time.Date(2024, 1, 31, 23, 59, 59, 0, time.UTC).UnixMilli())
+	require.Equal(t, "m202401", month.key(jan))
+	start, end, ok := month.bounds("m202401")
+	require.True(t, ok)
+	require.Less(t, start, jan)
+	require.Equal(t, jan+1000, end)
+	indices = []string{partitionIndex(alias, docType, "m202401"), partitionIndex(alias, docType, "m202402")}
+	routed = month.route(alias, docType, indices, QueryParams{
+		IndexName: alias,
+		Bool:      Filter(Range("block_timestamp", end, end+1)),
+	})
+	require.Equal(t, indices[1:], routed)
+
+	rollover := Partitioning{Mode: PartitionRollover}
+	require.Error(t, rollover.validate())
+	require.Error(t, Partitioning{Mode: PartitionBlocks}.validate())
+	require.Error(t, Partitioning{Mode: "weekly"}.validate())
+}
+
+func TestPartitioningTemplate(t *testing.T) {
+	docType := schema.TableBalanceChangeHistory
+	mappings, err := esMappings(docType)
+	require.NoError(t, err)
+
+	template := Partitioning{Mode: PartitionBlocks, Blocks: 1000, Shards: 3}.template(docType, docType, docType, mappings)
+	require.Equal(t, []string{"b*_balance_change_history"}, template["index_patterns"])
+	body := template["template"].(map[string]interface{})
+	require.Equal(t, map[string]interface{}{"number_of_shards": 3}, body["settings"])
+	require.Contains(t, body["aliases"], docType)
+
+	rollover := Partitioning{Mode: PartitionRollover, RolloverMaxDocs: 1e8}
+	require.NoError(t, rollover.validate())
+	template = rollover.template(docType, docType, docType, mappings)
+	require.Equal(t, []string{"balance_change_history-*"}, template["index_patterns"])
+	body = template["template"].(map[string]interface{})
+	require.Equal(t, docType, body["settings"].(map[string]interface{})["index.lifecycle.rollover_alias"])
+	require.NotContains(t, body, "aliases")
+}
+
+func TestPartitioningMeta(t *testing.T) {
+	docType := schema.TableBalanceChangeHistory
+	mappings, err := esMappings(docType)
+	require.NoError(t, err)
+
+	// the partitions of a reindex keep the names of the versioned alias after the swap
+	partitioning := Partitioning{Mode: PartitionBlocks, Blocks: 1000, Shards: 3}
+	template := partitioning.template(docType, "v2_"+docType, docType, mappings)
+	require.Equal(t, []string{"v2_b*_balance_change_history"}, template["index_patterns"])
+
+	source, err := json.Marshal(template["_meta"])
+	require.NoError(t, err)
+	var meta map[string]interface{}
+	require.NoError(t, json.Unmarshal(source, &meta))
+	decoded, err := decodePartitionMeta(meta)
+	require.NoError(t, err)
+	require.Equal(t, &partitionMeta{Partitioning: partitioning, Base: "v2_" + docType}, decoded)
+
+	decoded, err = decodePartitionMeta(nil)
+	require.NoError(t, err)
+	require.Nil(t, decoded)
+	_, err = decodePartitionMeta(map[string]interface{}{"partitioning": map[string]interface{}{"mode": "weekly"}})
+	require.Error(t, err)
+}
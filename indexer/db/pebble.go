@@ -0,0 +1,512 @@
+package db
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/rabbitprincess/eth-indexer/indexer/schema"
+	"github.com/rs/zerolog"
+)
+
+// Key layout of PebbleDBController:
+//
+//	d/<index>/<id>                                        document source
+//	a/<index>/<account>/<block_number><txindex><id>       per-account history, ordered by block and transaction
+//	b/<index>/<block_number><id>                          block ordered, used by range deletes on rollback
+//	m/alias/<alias>                                       index behind an alias
+//	m/index/<index>                                       document type of an index
+//
+// Numbers in keys are 8 byte big endian so that keys sort numerically.
+const (
+	pebbleDocPrefix     = "d/"
+	pebbleAccountPrefix = "a/"
+	pebbleBlockPrefix   = "b/"
+	pebbleAliasPrefix   = "m/alias/"
+	pebbleIndexPrefix   = "m/index/"
+)
+
+// PebbleDBController implements DbController on an embedded pebble LSM store, tuned for backfill throughput.
+// Queries are evaluated in process, by account or block range when the query allows it.
+type PebbleDBController struct {
+	logger *zerolog.Logger
+	db     *pebble.DB
+
+	mtx     sync.RWMutex
+	aliases map[string]string
+	indices map[string]string
+}
+
+// NewPebbleDbController opens or creates the pebble store in dir
+func NewPebbleDbController(ctx context.Context, logger *zerolog.Logger, dir string) (*PebbleDBController, error) {
+	db, err := pebble.Open(dir, &pebble.Options{})
+	if err != nil {
+		return nil, err
+	}
+	controller := &PebbleDBController{
+		logger:  logger,
+		db:      db,
+		aliases: make(map[string]string),
+		indices: make(map[string]string),
+	}
+
+	// load aliases and indices
+	iter, err := db.NewIter(prefixIterOptions([]byte("m/")))
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	defer iter.Close()
+	for iter.First(); iter.Valid(); iter.Next() {
+		key := string(iter.Key())
+		switch {
+		case strings.HasPrefix(key, pebbleAliasPrefix):
+			controller.aliases[strings.TrimPrefix(key, pebbleAliasPrefix)] = string(iter.Value())
+		case strings.HasPrefix(key, pebbleIndexPrefix):
+			controller.indices[strings.TrimPrefix(key, pebbleIndexPrefix)] = string(iter.Value())
+		}
+	}
+	logger.Info().Str("dir", dir).Int("indices", len(controller.indices)).Msg("Opened pebble database")
+	return controller, nil
+}
+
+// Close flushes and closes the store
+func (p *PebbleDBController) Close() error {
+	return p.db.Close()
+}
+
+// Indices returns every index which holds documents, with its document type
+func (p *PebbleDBController) Indices() map[string]string {
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+	indices := make(map[string]string, len(p.indices))
+	for index, documentType := range p.indices {
+		indices[index] = documentType
+	}
+	return indices
+}
+
+// resolve returns the index behind indexName if it is an alias
+func (p *PebbleDBController) resolve(indexName string) string {
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+	if index, ok := p.aliases[indexName]; ok {
+		return index
+	}
+	return indexName
+}
+
+// register records an index on its first write so that it can be listed and exported
+func (p *PebbleDBController) register(batch *pebble.Batch, index string) {
+	p.mtx.RLock()
+	_, ok := p.indices[index]
+	p.mtx.RUnlock()
+	if ok {
+		return
+	}
+	var documentType string
+	for docType := range schema.DocTypes {
+		if strings.HasSuffix(index, docType) && len(docType) > len(documentType) {
+			documentType = docType
+		}
+	}
+	batch.Set([]byte(pebbleIndexPrefix+index), []byte(documentType), nil)
+	p.mtx.Lock()
+	p.indices[index] = documentType
+	p.mtx.Unlock()
+}
+
+func docKey(index, id string) []byte {
+	return []byte(pebbleDocPrefix + index + "/" + id)
+}
+
+func accountPrefix(index, account string) []byte {
+	return []byte(pebbleAccountPrefix + index + "/" + account + "/")
+}
+
+func blockPrefix(index string) []byte {
+	return []byte(pebbleBlockPrefix + index + "/")
+}
+
+func appendUint64(key []byte, n uint64) []byte {
+	return binary.BigEndian.AppendUint64(key, n)
+}
+
+// secondaryKeys returns the account and block ordered keys of a document
+func secondaryKeys(index, id string, fields docFields) [][]byte {
+	var keys [][]byte
+	blockNumber, hasBlock := fields.Uint("block_number")
+	if account := fields.String("account"); account != "" {
+		txIndex, _ := fields.Uint("txindex")
+		key := appendUint64(appendUint64(accountPrefix(index, account), blockNumber), txIndex)
+		keys = append(keys, append(key, id...))
+	}
+	if hasBlock {
+		keys = append(keys, append(appendUint64(blockPrefix(index), blockNumber), id...))
+	}
+	return keys
+}
+
+// prefixEnd returns the smallest key greater than every key starting with prefix
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte{}, prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		end[i]++
+		if end[i] != 0 {
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+func prefixIterOptions(prefix []byte) *pebble.IterOptions {
+	return &pebble.IterOptions{LowerBound: prefix, UpperBound: prefixEnd(prefix)}
+}
+
+// rangeIterOptions bounds an iterator to keys whose number after prefix is within [min, max]
+func rangeIterOptions(prefix []byte, min, max uint64) *pebble.IterOptions {
+	opts := &pebble.IterOptions{LowerBound: appendUint64(append([]byte{}, prefix...), min)}
+	if max == math.MaxUint64 {
+		opts.UpperBound = prefixEnd(prefix)
+	} else {
+		opts.UpperBound = appendUint64(append([]byte{}, prefix...), max+1)
+	}
+	return opts
+}
+
+// get reads the document source of id from reader
+func (p *PebbleDBController) get(reader pebble.Reader, index, id string) ([]byte, error) {
+	value, closer, err := reader.Get(docKey(index, id))
+	if errors.Is(err, pebble.ErrNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer closer.Close()
+	return append([]byte{}, value...), nil
+}
+
+// scan finds the documents matching params, using the account or block key space when the query allows it
+func (p *PebbleDBController) scan(params QueryParams) ([]*matchedDoc, error) {
+	index := p.resolve(params.IndexName)
+
+	account := params.filterMatch("account")
+	blockRange := params.filterRange("block_number")
+	var opts *pebble.IterOptions
+	var idOffset int
+	switch {
+	case account != nil:
+		prefix := accountPrefix(index, account.Value)
+		opts = prefixIterOptions(prefix)
+		if blockRange != nil {
+			opts = rangeIterOptions(prefix, blockRange.Min, blockRange.Max)
+		}
+		idOffset = len(prefix) + 16
+	case blockRange != nil:
+		prefix := blockPrefix(index)
+		opts = rangeIterOptions(prefix, blockRange.Min, blockRange.Max)
+		idOffset = len(prefix) + 8
+	default:
+		prefix := []byte(pebbleDocPrefix + index + "/")
+		opts = prefixIterOptions(prefix)
+		idOffset = len(prefix)
+	}
+
+	iter, err := p.db.NewIter(opts)
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+	primary := strings.HasPrefix(string(opts.LowerBound), pebbleDocPrefix)
+
+	var docs []*matchedDoc
+	for iter.First(); iter.Valid(); iter.Next() {
+		id := string(iter.Key()[idOffset:])
+		source := append([]byte{}, iter.Value()...)
+		if !primary {
+			if source, err = p.get(p.db, index, id); err != nil {
+				return nil, err
+			} else if source == nil {
+				continue
+			}
+		}
+		fields, err := decodeFields(source)
+		if err != nil {
+			return nil, err
+		}
+		if matchParams(params, id, fields) {
+			docs = append(docs, &matchedDoc{id: id, source: source, fields: fields})
+		}
+	}
+	return docs, iter.Error()
+}
+
+func (p *PebbleDBController) Exists(indexName string, id string) bool {
+	source, err := p.get(p.db, p.resolve(indexName), id)
+	return err == nil && source != nil
+}
+
+// Insert inserts a single document, overwriting the document with the same id.
+// Unlike bulks it is synced, which also persists the bulks written before, so commit markers are durable.
+func (p *PebbleDBController) Insert(document schema.DocType, indexName string) error {
+	bulk := p.UpsertBulk(indexName).(*PebbleBulkInstance)
+	bulk.sync = true
+	bulk.Add(document)
+	return bulk.Commit()
+}
+
+// Update creates or overwrites the document with id
+func (p *PebbleDBController) Update(document schema.DocType, indexName string, id string) error {
+	document.SetID(id)
+	return p.Insert(document, indexName)
+}
+
+// Delete removes documents specified by the query params
+func (p *PebbleDBController) Delete(params QueryParams) (uint64, error) {
+	docs, err := p.scan(params)
+	if err != nil || len(docs) == 0 {
+		return 0, err
+	}
+	index := p.resolve(params.IndexName)
+	batch := p.db.NewBatch()
+	defer batch.Close()
+	for _, doc := range docs {
+		batch.Delete(docKey(index, doc.id), nil)
+		for _, key := range secondaryKeys(index, doc.id, doc.fields) {
+			batch.Delete(key, nil)
+		}
+	}
+	if err = batch.Commit(pebble.Sync); err != nil {
+		return 0, err
+	}
+	return uint64(len(docs)), nil
+}
+
+// Count returns the number of documents matching the query params
+func (p *PebbleDBController) Count(params QueryParams) (int64, error) {
+	docs, err := p.scan(params)
+	return int64(len(docs)), err
+}
+
+// SelectOne selects a single document
+func (p *PebbleDBController) SelectOne(params QueryParams, createDocument CreateDocFunction) (schema.DocType, error) {
+	docs, err := p.scan(params)
+	if err != nil {
+		return nil, err
+	}
+	if params.SortField != "" {
+		sortMatched(params, docs)
+	}
+	if params.From >= uint64(len(docs)) {
+		return nil, nil
+	}
+	return unmarshalMatched(docs[params.From], createDocument)
+}
+
+// MultiGet fetches documents by id, ids which are not found are skipped
+func (p *PebbleDBController) MultiGet(indexName string, ids []string, createDocument CreateDocFunction) ([]schema.DocType, error) {
+	index := p.resolve(indexName)
+	documents := make([]schema.DocType, 0, len(ids))
+	for _, id := range ids {
+		source, err := p.get(p.db, index, id)
+		if err != nil {
+			return nil, err
+		} else if source == nil {
+			continue
+		}
+		document, err := unmarshalMatched(&matchedDoc{id: id, source: source}, createDocument)
+		if err != nil {
+			return nil, err
+		}
+		documents = append(documents, document)
+	}
+	return documents, nil
+}
+
+// UpdateAlias points the alias to indexName and deletes the index it pointed to before
+func (p *PebbleDBController) UpdateAlias(aliasName string, indexName string) error {
+	p.mtx.RLock()
+	oldIndex, ok := p.aliases[aliasName]
+	if _, bare := p.indices[aliasName]; !ok && bare {
+		oldIndex = aliasName // an index written under the alias name before aliases were used
+	}
+	p.mtx.RUnlock()
+
+	batch := p.db.NewBatch()
+	defer batch.Close()
+	batch.Set([]byte(pebbleAliasPrefix+aliasName), []byte(indexName), nil)
+	if oldIndex != "" && oldIndex != indexName {
+		for _, prefix := range []string{pebbleDocPrefix, pebbleAccountPrefix, pebbleBlockPrefix} {
+			start := []byte(prefix + oldIndex + "/")
+			batch.DeleteRange(start, prefixEnd(start), nil)
+		}
+		batch.Delete([]byte(pebbleIndexPrefix+oldIndex), nil)
+	}
+	if err := batch.Commit(pebble.Sync); err != nil {
+		return err
+	}
+
+	p.mtx.Lock()
+	p.aliases[aliasName] = indexName
+	if oldIndex != indexName {
+		delete(p.indices, oldIndex)
+	}
+	p.mtx.Unlock()
+	return nil
+}
+
+// GetExistingIndexPrefix checks for the index behind an alias and returns its prefix, if any
+func (p *PebbleDBController) GetExistingIndexPrefix(aliasName string, documentType string) (bool, string, error) {
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+	if index, ok := p.aliases[aliasName]; ok {
+		return true, strings.TrimSuffix(index, documentType), nil
+	}
+	return false, "", nil
+}
+
+// CreateIndex records an index of documentType
+func (p *PebbleDBController) CreateIndex(indexName string, documentType string) error {
+	if !strings.HasSuffix(indexName, documentType) {
+		return fmt.Errorf("index %s is not named after document type %s", indexName, documentType)
+	}
+	batch := p.db.NewBatch()
+	defer batch.Close()
+	p.register(batch, indexName)
+	return batch.Commit(pebble.Sync)
+}
+
+// Scroll creates a new scroll instance over the sorted matching documents
+func (p *PebbleDBController) Scroll(params QueryParams, createDocument CreateDocFunction) ScrollInstance {
+	docs, err := p.scan(params)
+	if err == nil {
+		docs = scrollMatched(params, docs)
+	}
+	return &matchedScrollInstance{
+		docs:           docs,
+		err:            err,
+		createDocument: createDocument,
+	}
+}
+
+// Aggregate computes aggregations over the documents matching params
+func (p *PebbleDBController) Aggregate(params QueryParams, aggregations ...Aggregation) (map[string]*AggregationResult, error) {
+	docs, err := p.scan(params)
+	if err != nil {
+		return nil, err
+	}
+	return aggregateMatched(docs, aggregations)
+}
+
+// SearchPage returns the page of matching documents following cursor
+func (p *PebbleDBController) SearchPage(params QueryParams, cursor string, createDocument CreateDocFunction) (*Page, error) {
+	docs, err := p.scan(params)
+	if err != nil {
+		return nil, err
+	}
+	return pageMatched(params, scrollMatched(params, docs), cursor, createDocument)
+}
+
+// InsertBulk creates a bulk instance which creates documents, skipping the ones that already exist
+func (p *PebbleDBController) InsertBulk(indexName string) BulkInstance {
+	return &PebbleBulkInstance{
+		p:         p,
+		indexName: indexName,
+	}
+}
+
+// UpsertBulk creates a bulk instance which creates documents or overwrites the existing ones
+func (p *PebbleDBController) UpsertBulk(indexName string) BulkInstance {
+	return &PebbleBulkInstance{
+		p:         p,
+		indexName: indexName,
+		upsert:    true,
+	}
+}
+
+// UpsertLatestBulk creates a bulk instance which creates documents or overwrites the existing ones of the same or
+// an earlier block, so that a late write never replaces a newer document
+func (p *PebbleDBController) UpsertLatestBulk(indexName string) BulkInstance {
+	return &PebbleBulkInstance{
+		p:         p,
+		indexName: indexName,
+		upsert:    true,
+		latest:    true,
+	}
+}
+
+type PebbleBulkInstance struct {
+	p         *PebbleDBController
+	indexName string
+	upsert    bool
+	latest    bool
+	sync      bool
+	documents []schema.DocType
+}
+
+func (bulk *PebbleBulkInstance) Add(document schema.DocType) {
+	bulk.documents = append(bulk.documents, document)
+}
+
+// Commit writes the documents and their secondary keys in one atomic batch
+func (bulk *PebbleBulkInstance) Commit() error {
+	documents := bulk.documents
+	bulk.documents = nil
+	if len(documents) == 0 {
+		return nil
+	}
+	index := bulk.p.resolve(bulk.indexName)
+
+	// an indexed batch reads its own writes, so duplicated ids within the bulk replace their secondary keys
+	batch := bulk.p.db.NewIndexedBatch()
+	defer batch.Close()
+	bulk.p.register(batch, index)
+	for _, document := range documents {
+		id := document.GetID()
+		source, err := json.Marshal(document)
+		if err != nil {
+			return err
+		}
+		fields, err := decodeFields(source)
+		if err != nil {
+			return err
+		}
+
+		old, err := bulk.p.get(batch, index, id)
+		if err != nil {
+			return err
+		}
+		if old != nil {
+			if !bulk.upsert {
+				continue // already written by a previous run
+			}
+			oldFields, err := decodeFields(old)
+			if err != nil {
+				return err
+			}
+			if bulk.latest && supersedes(oldFields, fields) {
+				continue
+			}
+			for _, key := range secondaryKeys(index, id, oldFields) {
+				batch.Delete(key, nil)
+			}
+		}
+
+		batch.Set(docKey(index, id), source, nil)
+		for _, key := range secondaryKeys(index, id, fields) {
+			batch.Set(key, nil, nil)
+		}
+	}
+
+	opts := pebble.NoSync
+	if bulk.sync {
+		opts = pebble.Sync
+	}
+	return batch.Commit(opts)
+}
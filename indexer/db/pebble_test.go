@@ -0,0 +1,55 @@
+package db
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/rabbitprincess/eth-indexer/indexer/schema"
+	"github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPebble(t *testing.T) {
+	controller, err := NewPebbleDbController(context.Background(), &log.Logger, filepath.Join(t.TempDir(), "pebble"))
+	require.NoError(t, err)
+	defer controller.Close()
+
+	testDbController(t, controller)
+}
+
+func TestPebbleExport(t *testing.T) {
+	ctx := context.Background()
+	src, err := NewPebbleDbController(ctx, &log.Logger, filepath.Join(t.TempDir(), "pebble"))
+	require.NoError(t, err)
+	defer src.Close()
+	dst, err := NewSqliteDbController(ctx, &log.Logger, filepath.Join(t.TempDir(), "export.db"))
+	require.NoError(t, err)
+	defer dst.Close()
+
+	bulk := src.InsertBulk(schema.TableBalanceChangeHistory)
+	for blockNumber := uint64(0); blockNumber < 100; blockNumber++ {
+		bulk.Add(newTestBalanceChange(blockNumber, "0xaa"))
+	}
+	require.NoError(t, bulk.Commit())
+	require.Contains(t, src.Indices(), schema.TableBalanceChangeHistory)
+
+	// history of an account is read from the account key space in block order
+	doc, err := src.SelectOne(QueryParams{
+		IndexName:    schema.TableBalanceChangeHistory,
+		StringMatch:  &StringMatchQuery{Field: "account", Value: "0xaa"},
+		IntegerRange: &IntegerRangeQuery{Field: "block_number", Min: 10, Max: 20},
+		SortField:    "block_number",
+	}, schema.DocTypes[schema.TableBalanceChangeHistory])
+	require.NoError(t, err)
+	require.EqualValues(t, 20, doc.(*schema.BalanceCHangeHistory).BlockNumber)
+
+	for i := 0; i < 2; i++ {
+		exported, err := Export(src, dst, schema.TableBalanceChangeHistory, schema.DocTypes[schema.TableBalanceChangeHistory])
+		require.NoError(t, err)
+		require.EqualValues(t, 100, exported)
+	}
+	count, err := dst.Count(QueryParams{IndexName: schema.TableBalanceChangeHistory})
+	require.NoError(t, err)
+	require.EqualValues(t, 100, count)
+}
@@ -0,0 +1,543 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/rabbitprincess/eth-indexer/indexer/schema"
+	"github.com/rs/zerolog"
+)
+
+const pgAliasTable = "index_alias"
+
+// PgDBController implements DbController on PostgreSQL.
+// Every index is a table whose columns are derived from the db tags of its document type, aliases are views.
+type PgDBController struct {
+	logger *zerolog.Logger
+	pool   *pgxpool.Pool
+
+	mtx    sync.Mutex
+	tables map[string]*sqlTable
+}
+
+// NewPostgresDbController creates a new instance of PgDBController
+func NewPostgresDbController(ctx context.Context, logger *zerolog.Logger, pgURL string) (*PgDBController, error) {
+	pool, err := pgxpool.New(ctx, pgURL)
+	if err != nil {
+		return nil, err
+	}
+	controller := &PgDBController{
+		logger: logger,
+		pool:   pool,
+		tables: make(map[string]*sqlTable),
+	}
+
+	retry := 0
+	for {
+		if err = pool.Ping(ctx); err == nil {
+			break
+		}
+		if retry > 10 {
+			logger.Error().Int("retry", retry).Err(err).Msg("Could not connect to postgres database")
+			pool.Close()
+			return nil, err
+		}
+		retry++
+		logger.Info().Int("retry", retry).Err(err).Msg("Could not connect to postgres database, retrying")
+		time.Sleep(time.Second)
+	}
+
+	_, err = pool.Exec(ctx, fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (alias_name TEXT PRIMARY KEY, index_name TEXT NOT NULL)", quoteIdent(pgAliasTable)))
+	if err != nil {
+		pool.Close()
+		return nil, err
+	}
+	return controller, nil
+}
+
+// Close releases the connections of the pool
+func (pg *PgDBController) Close() {
+	pg.pool.Close()
+}
+
+// table returns the layout of indexName, creating the table on first use like elasticsearch creates indices
+func (pg *PgDBController) table(ctx context.Context, indexName string) (*sqlTable, error) {
+	pg.mtx.Lock()
+	defer pg.mtx.Unlock()
+	if table, ok := pg.tables[indexName]; ok {
+		return table, nil
+	}
+
+	name, err := pg.resolve(ctx, indexName)
+	if err != nil {
+		return nil, err
+	}
+	table, err := newSqlTable(name)
+	if err != nil {
+		return nil, err
+	}
+	for _, stmt := range table.createTableStatements() {
+		if _, err = pg.pool.Exec(ctx, stmt); err != nil {
+			return nil, err
+		}
+	}
+	pg.tables[indexName] = table
+	return table, nil
+}
+
+// resolve returns the table of indexName, an alias is a view for readers outside the indexer,
+// the indexer reads and writes the table behind it
+func (pg *PgDBController) resolve(ctx context.Context, indexName string) (string, error) {
+	name := indexName
+	err := pg.pool.QueryRow(ctx, fmt.Sprintf("SELECT index_name FROM %s WHERE alias_name = $1", quoteIdent(pgAliasTable)), indexName).Scan(&name)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return "", err
+	}
+	return name, nil
+}
+
+// hasTable reports whether the table of indexName exists, without creating it like table does
+func (pg *PgDBController) hasTable(ctx context.Context, indexName string) (bool, error) {
+	pg.mtx.Lock()
+	_, ok := pg.tables[indexName]
+	pg.mtx.Unlock()
+	if ok {
+		return true, nil
+	}
+	name, err := pg.resolve(ctx, indexName)
+	if err != nil {
+		return false, err
+	}
+	var exists bool
+	err = pg.pool.QueryRow(ctx, "SELECT to_regclass($1) IS NOT NULL", quoteIdent(name)).Scan(&exists)
+	return exists, err
+}
+
+func pgBind(args *[]any) func(arg any) string {
+	return func(arg any) string {
+		*args = append(*args, arg)
+		return fmt.Sprintf("$%d", len(*args))
+	}
+}
+
+func (pg *PgDBController) Exists(indexName string, id string) bool {
+	ctx := context.Background()
+	table, err := pg.table(ctx, indexName)
+	if err != nil {
+		return false
+	}
+	var exists bool
+	err = pg.pool.QueryRow(ctx, fmt.Sprintf("SELECT EXISTS (SELECT 1 FROM %s WHERE id = $1)", quoteIdent(table.Name)), id).Scan(&exists)
+	return err == nil && exists
+}
+
+// Insert inserts a single document, overwriting the document with the same id
+func (pg *PgDBController) Insert(document schema.DocType, indexName string) error {
+	bulk := pg.UpsertBulk(indexName)
+	bulk.Add(document)
+	return bulk.Commit()
+}
+
+// Update creates or overwrites the document with id
+func (pg *PgDBController) Update(document schema.DocType, indexName string, id string) error {
+	document.SetID(id)
+	return pg.Insert(document, indexName)
+}
+
+// Delete removes documents specified by the query params
+func (pg *PgDBController) Delete(params QueryParams) (uint64, error) {
+	ctx := context.Background()
+	table, err := pg.table(ctx, params.IndexName)
+	if err != nil {
+		return 0, err
+	}
+	var args []any
+	where, err := table.where(params, pgBind(&args))
+	if err != nil {
+		return 0, err
+	}
+	res, err := pg.pool.Exec(ctx, fmt.Sprintf("DELETE FROM %s%s", quoteIdent(table.Name), where), args...)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(res.RowsAffected()), nil
+}
+
+// Count returns the number of documents matching the query params, 0 for a table which does not exist yet
+func (pg *PgDBController) Count(params QueryParams) (int64, error) {
+	ctx := context.Background()
+	if exists, err := pg.hasTable(ctx, params.IndexName); err != nil || !exists {
+		return 0, err
+	}
+	table, err := pg.table(ctx, params.IndexName)
+	if err != nil {
+		return 0, err
+	}
+	var args []any
+	where, err := table.where(params, pgBind(&args))
+	if err != nil {
+		return 0, err
+	}
+	var count int64
+	err = pg.pool.QueryRow(ctx, fmt.Sprintf("SELECT COUNT(*) FROM %s%s", quoteIdent(table.Name), where), args...).Scan(&count)
+	return count, err
+}
+
+// SelectOne selects a single document
+func (pg *PgDBController) SelectOne(params QueryParams, createDocument CreateDocFunction) (schema.DocType, error) {
+	ctx := context.Background()
+	table, err := pg.table(ctx, params.IndexName)
+	if err != nil {
+		return nil, err
+	}
+	var args []any
+	query, err := table.selectQuery(params, pgBind(&args))
+	if err != nil {
+		return nil, err
+	}
+	if params.SortField != "" {
+		order, err := table.orderBy(params)
+		if err != nil {
+			return nil, err
+		}
+		query += order
+	}
+	query += fmt.Sprintf(" LIMIT 1 OFFSET %d", params.From)
+
+	document, err := table.scan(pg.pool.QueryRow(ctx, query, args...))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	return document, err
+}
+
+// MultiGet fetches documents by id in a single round trip, ids which are not found are skipped
+func (pg *PgDBController) MultiGet(indexName string, ids []string, createDocument CreateDocFunction) ([]schema.DocType, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	ctx := context.Background()
+	table, err := pg.table(ctx, indexName)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := pg.pool.Query(ctx, fmt.Sprintf("SELECT %s FROM %s WHERE id = ANY($1)", strings.Join(table.columnNames(), ", "), quoteIdent(table.Name)), ids)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	documents := make([]schema.DocType, 0, len(ids))
+	for rows.Next() {
+		document, err := table.scan(rows)
+		if err != nil {
+			return nil, err
+		}
+		documents = append(documents, document)
+	}
+	return documents, rows.Err()
+}
+
+// UpdateAlias points the alias view to indexName and drops the tables it pointed to before
+func (pg *PgDBController) UpdateAlias(aliasName string, indexName string) error {
+	ctx := context.Background()
+	if _, err := pg.table(ctx, indexName); err != nil {
+		return err
+	}
+	tx, err := pg.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var oldIndex string
+	err = tx.QueryRow(ctx, fmt.Sprintf("SELECT index_name FROM %s WHERE alias_name = $1", quoteIdent(pgAliasTable)), aliasName).Scan(&oldIndex)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return err
+	}
+	// without an alias the name may belong to a table written before aliases were used, it is retired like an old index
+	stmts := []string{fmt.Sprintf("DROP VIEW IF EXISTS %s", quoteIdent(aliasName))}
+	if oldIndex == "" {
+		stmts = []string{fmt.Sprintf("DROP TABLE IF EXISTS %s", quoteIdent(aliasName))}
+	}
+	stmts = append(stmts, fmt.Sprintf("CREATE VIEW %s AS SELECT * FROM %s", quoteIdent(aliasName), quoteIdent(indexName)))
+	if oldIndex != "" && oldIndex != indexName {
+		stmts = append(stmts, fmt.Sprintf("DROP TABLE IF EXISTS %s", quoteIdent(oldIndex)))
+	}
+	for _, stmt := range stmts {
+		if _, err = tx.Exec(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec(ctx, fmt.Sprintf("INSERT INTO %s (alias_name, index_name) VALUES ($1, $2) ON CONFLICT (alias_name) DO UPDATE SET index_name = EXCLUDED.index_name", quoteIdent(pgAliasTable)), aliasName, indexName)
+	if err != nil {
+		return err
+	}
+	if err = tx.Commit(ctx); err != nil {
+		return err
+	}
+
+	pg.mtx.Lock()
+	delete(pg.tables, oldIndex)
+	delete(pg.tables, aliasName)
+	pg.mtx.Unlock()
+	return nil
+}
+
+// GetExistingIndexPrefix checks for the table behind an alias and returns its prefix, if any
+func (pg *PgDBController) GetExistingIndexPrefix(aliasName string, documentType string) (bool, string, error) {
+	var indexName string
+	err := pg.pool.QueryRow(context.Background(), fmt.Sprintf("SELECT index_name FROM %s WHERE alias_name = $1", quoteIdent(pgAliasTable)), aliasName).Scan(&indexName)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, "", nil
+	} else if err != nil {
+		return false, "", err
+	}
+	return true, strings.TrimSuffix(indexName, documentType), nil
+}
+
+// CreateIndex creates the table of documentType
+func (pg *PgDBController) CreateIndex(indexName string, documentType string) error {
+	if !strings.HasSuffix(indexName, documentType) {
+		return fmt.Errorf("index %s is not named after document type %s", indexName, documentType)
+	}
+	_, err := pg.table(context.Background(), indexName)
+	return err
+}
+
+// Scroll creates a new scroll instance which pages through the query with keyset pagination
+func (pg *PgDBController) Scroll(params QueryParams, createDocument CreateDocFunction) ScrollInstance {
+	params.Size = pageSize(params)
+	return &PgScrollInstance{
+		pg:     pg,
+		ctx:    context.Background(),
+		params: params,
+	}
+}
+
+// PgScrollInstance is an instance of a scroll for postgres
+type PgScrollInstance struct {
+	pg     *PgDBController
+	ctx    context.Context
+	params QueryParams
+
+	page     []schema.DocType
+	current  int
+	lastSort any
+	lastID   string
+	done     bool
+}
+
+// Next returns the next document of a scroll or io.EOF
+func (scroll *PgScrollInstance) Next() (schema.DocType, error) {
+	if scroll.current >= len(scroll.page) {
+		if scroll.done {
+			return nil, io.EOF
+		}
+		if err := scroll.fetch(); err != nil {
+			return nil, err
+		}
+		if len(scroll.page) == 0 {
+			return nil, io.EOF
+		}
+	}
+	document := scroll.page[scroll.current]
+	scroll.current++
+	return document, nil
+}
+
+// fetch loads the page following the last returned document
+func (scroll *PgScrollInstance) fetch() error {
+	table, err := scroll.pg.table(scroll.ctx, scroll.params.IndexName)
+	if err != nil {
+		return err
+	}
+	scroll.page, err = scroll.pg.page(scroll.ctx, table, scroll.params, scroll.lastSort, scroll.lastID)
+	if err != nil {
+		return err
+	}
+	scroll.current = 0
+
+	scroll.done = len(scroll.page) < scroll.params.Size
+	if len(scroll.page) > 0 {
+		last := scroll.page[len(scroll.page)-1]
+		scroll.lastID = last.GetID()
+		scroll.lastSort = table.sortValue(scroll.params, last)
+	}
+	return nil
+}
+
+// page reads the page of params following the document (lastSort, lastID) with keyset pagination
+func (pg *PgDBController) page(ctx context.Context, table *sqlTable, params QueryParams, lastSort any, lastID string) ([]schema.DocType, error) {
+	var args []any
+	query, err := table.pageQuery(params, pgBind(&args), lastSort, lastID)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := pg.pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var documents []schema.DocType
+	for rows.Next() {
+		document, err := table.scan(rows)
+		if err != nil {
+			return nil, err
+		}
+		documents = append(documents, document)
+	}
+	return documents, rows.Err()
+}
+
+// Aggregate computes aggregations over the documents matching params with a grouped select per aggregation
+func (pg *PgDBController) Aggregate(params QueryParams, aggregations ...Aggregation) (map[string]*AggregationResult, error) {
+	ctx := context.Background()
+	table, err := pg.table(ctx, params.IndexName)
+	if err != nil {
+		return nil, err
+	}
+	results := make(map[string]*AggregationResult, len(aggregations))
+	for _, agg := range aggregations {
+		if err := agg.validate(); err != nil {
+			return nil, err
+		}
+		var args []any
+		query, err := table.aggregationQuery(params, agg, pgBind(&args))
+		if err != nil {
+			return nil, err
+		}
+		rows, err := pg.pool.Query(ctx, query, args...)
+		if err != nil {
+			return nil, err
+		}
+		results[agg.Name], err = scanAggregation(rows, agg)
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+// SearchPage returns the page of matching documents following cursor
+func (pg *PgDBController) SearchPage(params QueryParams, cursor string, createDocument CreateDocFunction) (*Page, error) {
+	ctx := context.Background()
+	params.Size = pageSize(params)
+	table, err := pg.table(ctx, params.IndexName)
+	if err != nil {
+		return nil, err
+	}
+	lastSort, lastID, err := table.cursorPosition(cursor)
+	if err != nil {
+		return nil, err
+	}
+	documents, err := pg.page(ctx, table, params, lastSort, lastID)
+	if err != nil {
+		return nil, err
+	}
+	return table.newPage(params, documents)
+}
+
+// InsertBulk creates a bulk instance which creates documents, skipping the ones that already exist
+func (pg *PgDBController) InsertBulk(indexName string) BulkInstance {
+	return &PgBulkInstance{
+		pg:        pg,
+		ctx:       context.Background(),
+		indexName: indexName,
+	}
+}
+
+// UpsertBulk creates a bulk instance which creates documents or overwrites the existing ones
+func (pg *PgDBController) UpsertBulk(indexName string) BulkInstance {
+	return &PgBulkInstance{
+		pg:        pg,
+		ctx:       context.Background(),
+		indexName: indexName,
+		upsert:    true,
+	}
+}
+
+// UpsertLatestBulk creates a bulk instance which creates documents or overwrites the existing ones of the same or
+// an earlier block, so that a late write never replaces a newer document
+func (pg *PgDBController) UpsertLatestBulk(indexName string) BulkInstance {
+	return &PgBulkInstance{
+		pg:        pg,
+		ctx:       context.Background(),
+		indexName: indexName,
+		upsert:    true,
+		latest:    true,
+	}
+}
+
+type PgBulkInstance struct {
+	pg        *PgDBController
+	ctx       context.Context
+	indexName string
+	upsert    bool
+	latest    bool
+	documents []schema.DocType
+}
+
+func (bulk *PgBulkInstance) Add(document schema.DocType) {
+	bulk.documents = append(bulk.documents, document)
+}
+
+// Commit copies the documents into a temporary table and merges them into the index in one transaction
+func (bulk *PgBulkInstance) Commit() error {
+	documents := dedupDocuments(bulk.documents)
+	bulk.documents = nil
+	if len(documents) == 0 {
+		return nil
+	}
+	table, err := bulk.pg.table(bulk.ctx, bulk.indexName)
+	if err != nil {
+		return err
+	}
+
+	tx, err := bulk.pg.pool.Begin(bulk.ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(bulk.ctx)
+
+	staging := "staging_" + table.DocumentType
+	_, err = tx.Exec(bulk.ctx, fmt.Sprintf("CREATE TEMP TABLE %s (LIKE %s) ON COMMIT DROP", quoteIdent(staging), quoteIdent(table.Name)))
+	if err != nil {
+		return err
+	}
+	columns := []string{"id"}
+	for _, col := range table.Columns {
+		columns = append(columns, col.Name)
+	}
+	rows := make([][]any, len(documents))
+	for i, document := range documents {
+		if rows[i], err = table.values(document); err != nil {
+			return err
+		}
+	}
+	_, err = tx.CopyFrom(bulk.ctx, pgx.Identifier{staging}, columns, pgx.CopyFromRows(rows))
+	if err != nil {
+		return err
+	}
+
+	names := strings.Join(table.columnNames(), ", ")
+	conflict, err := table.conflictClause(bulk.upsert, bulk.latest)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(bulk.ctx, fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM %s ON CONFLICT (id) %s", quoteIdent(table.Name), names, names, quoteIdent(staging), conflict))
+	if err != nil {
+		bulk.pg.logger.Error().Str("index", table.Name).Int("documents", len(documents)).Err(err).Msg("bulk commit failed")
+		return err
+	}
+	return tx.Commit(bulk.ctx)
+}
@@ -0,0 +1,129 @@
+package db
+
+import "time"
+
+// Query is a single condition of a BoolQuery, exactly one of its fields is set
+type Query struct {
+	Range  *IntegerRangeQuery
+	Match  *StringMatchQuery
+	Terms  *TermsQuery
+	Exists *ExistsQuery
+	Bool   *BoolQuery
+}
+
+// TermsQuery matches documents whose field equals any of the values
+type TermsQuery struct {
+	Field  string
+	Values []string
+}
+
+// ExistsQuery matches documents which have a value for the field
+type ExistsQuery struct {
+	Field string
+}
+
+// BoolQuery combines queries like the elasticsearch bool query.
+// Every Must and Filter query must match and no MustNot query may match.
+// Should queries only restrict the result if there is no Must or Filter query, then at least one of them must match.
+type BoolQuery struct {
+	Must    []Query
+	Filter  []Query
+	Should  []Query
+	MustNot []Query
+}
+
+// Range returns a query matching documents whose numeric field is within [min, max]
+func Range(field string, min, max uint64) Query {
+	return Query{Range: &IntegerRangeQuery{Field: field, Min: min, Max: max}}
+}
+
+// TimeRange returns a query matching documents whose timestamp field in milliseconds is within [from, to)
+func TimeRange(field string, from, to time.Time) Query {
+	return Range(field, uint64(from.UnixMilli()), uint64(to.UnixMilli())-1)
+}
+
+// Match returns a query matching documents whose field equals value
+func Match(field string, value string) Query {
+	return Query{Match: &StringMatchQuery{Field: field, Value: value}}
+}
+
+// Terms returns a query matching documents whose field equals any of values
+func Terms(field string, values ...string) Query {
+	return Query{Terms: &TermsQuery{Field: field, Values: values}}
+}
+
+// Exists returns a query matching documents which have a value for field
+func Exists(field string) Query {
+	return Query{Exists: &ExistsQuery{Field: field}}
+}
+
+// Filter returns a bool query requiring every query to match
+func Filter(queries ...Query) *BoolQuery {
+	return &BoolQuery{Filter: queries}
+}
+
+// Any returns a bool query requiring at least one of queries to match, nest it with Query to combine it with filters
+func Any(queries ...Query) *BoolQuery {
+	return &BoolQuery{Should: queries}
+}
+
+// Query returns q as a condition nested in another bool query
+func (q *BoolQuery) Query() Query {
+	return Query{Bool: q}
+}
+
+// query returns the conditions of params as a single bool query,
+// the IntegerRange and StringMatch shorthands are filters combined with Bool.
+// It returns nil if params match every document.
+func (params QueryParams) query() *BoolQuery {
+	var filters []Query
+	if params.IntegerRange != nil {
+		filters = append(filters, Query{Range: params.IntegerRange})
+	}
+	if params.StringMatch != nil {
+		filters = append(filters, Query{Match: params.StringMatch})
+	}
+	if len(filters) == 0 {
+		return params.Bool
+	}
+	if params.Bool != nil {
+		filters = append(filters, params.Bool.Query())
+	}
+	return Filter(filters...)
+}
+
+// filterMatch returns a match on field which every matching document satisfies, backends use it to pick a key space
+func (params QueryParams) filterMatch(field string) *StringMatchQuery {
+	for _, q := range params.query().required() {
+		if q.Match != nil && q.Match.Field == field {
+			return q.Match
+		}
+	}
+	return nil
+}
+
+// filterRange returns a range on field which every matching document satisfies
+func (params QueryParams) filterRange(field string) *IntegerRangeQuery {
+	for _, q := range params.query().required() {
+		if q.Range != nil && q.Range.Field == field {
+			return q.Range
+		}
+	}
+	return nil
+}
+
+// required returns the Must and Filter queries of q and its nested required bool queries
+func (q *BoolQuery) required() []Query {
+	if q == nil {
+		return nil
+	}
+	var queries []Query
+	for _, query := range append(append([]Query{}, q.Must...), q.Filter...) {
+		if query.Bool != nil {
+			queries = append(queries, query.Bool.required()...)
+		} else {
+			queries = append(queries, query)
+		}
+	}
+	return queries
+}
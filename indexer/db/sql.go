@@ -0,0 +1,496 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/rabbitprincess/eth-indexer/indexer/schema"
+)
+
+// sqlIndexedColumns are the columns which get a secondary index when a table is created
+var sqlIndexedColumns = []string{"account", "block_number", "block_timestamp", "counterparty", "hash", "from_address", "to_address", "token", "holder", "contract", "owner"}
+
+// sqlColumn maps a document field to a sql column named by its db tag
+type sqlColumn struct {
+	Name  string // db tag
+	Field string // json name, used as field name by QueryParams
+	Index []int
+	Kind  reflect.Kind
+}
+
+// sqlTable describes the layout of a table derived from the db tags of its document type
+type sqlTable struct {
+	Name           string
+	DocumentType   string
+	Columns        []*sqlColumn
+	createDocument CreateDocFunction
+}
+
+// newSqlTable resolves the document type of indexName, which is named <prefix><documentType>, and derives its columns
+func newSqlTable(indexName string) (*sqlTable, error) {
+	var documentType string
+	for docType := range schema.DocTypes {
+		if strings.HasSuffix(indexName, docType) && len(docType) > len(documentType) {
+			documentType = docType
+		}
+	}
+	if documentType == "" {
+		return nil, fmt.Errorf("unknown document type of index %s", indexName)
+	}
+
+	table := &sqlTable{
+		Name:           indexName,
+		DocumentType:   documentType,
+		createDocument: schema.DocTypes[documentType],
+	}
+	docType := reflect.TypeOf(table.createDocument()).Elem()
+	for i := 0; i < docType.NumField(); i++ {
+		field := docType.Field(i)
+		name := field.Tag.Get("db")
+		if field.Anonymous || name == "" || name == "-" {
+			continue // the id of BaseEsType is handled through GetID and SetID
+		}
+		jsonName := strings.Split(field.Tag.Get("json"), ",")[0]
+		if jsonName == "" {
+			jsonName = name
+		}
+		table.Columns = append(table.Columns, &sqlColumn{
+			Name:  name,
+			Field: jsonName,
+			Index: field.Index,
+			Kind:  field.Type.Kind(),
+		})
+	}
+	return table, nil
+}
+
+// column returns the column of a field, matching either its json or db name
+func (t *sqlTable) column(field string) (string, error) {
+	if field == "id" || field == "_id" {
+		return "id", nil
+	}
+	for _, col := range t.Columns {
+		if col.Field == field || col.Name == field {
+			return col.Name, nil
+		}
+	}
+	return "", fmt.Errorf("unknown field %s of %s", field, t.DocumentType)
+}
+
+// columnNames returns the quoted column names including the id
+func (t *sqlTable) columnNames() []string {
+	names := make([]string, 0, len(t.Columns)+1)
+	names = append(names, quoteIdent("id"))
+	for _, col := range t.Columns {
+		names = append(names, quoteIdent(col.Name))
+	}
+	return names
+}
+
+// values returns the column values of document in the order of columnNames.
+// Unsigned values are stored in BIGINT columns, the ones above math.MaxInt64 are rejected rather than overflowing.
+func (t *sqlTable) values(document schema.DocType) ([]any, error) {
+	v := reflect.ValueOf(document).Elem()
+	values := make([]any, 0, len(t.Columns)+1)
+	values = append(values, document.GetID())
+	for _, col := range t.Columns {
+		field := v.FieldByIndex(col.Index)
+		if field.CanUint() && field.Uint() > math.MaxInt64 {
+			return nil, fmt.Errorf("%s %d of %s %s exceeds the range of BIGINT", col.Name, field.Uint(), t.DocumentType, document.GetID())
+		}
+		values = append(values, field.Interface())
+	}
+	return values, nil
+}
+
+// scan creates a document and reads a row into it
+func (t *sqlTable) scan(scanner interface{ Scan(dest ...any) error }) (schema.DocType, error) {
+	document := t.createDocument()
+	v := reflect.ValueOf(document).Elem()
+
+	var id string
+	dest := make([]any, 0, len(t.Columns)+1)
+	dest = append(dest, &id)
+	for _, col := range t.Columns {
+		dest = append(dest, v.FieldByIndex(col.Index).Addr().Interface())
+	}
+	if err := scanner.Scan(dest...); err != nil {
+		return nil, err
+	}
+	document.SetID(id)
+	return document, nil
+}
+
+// where builds the condition of params, bind appends an argument and returns its placeholder
+func (t *sqlTable) where(params QueryParams, bind func(arg any) string) (string, error) {
+	q := params.query()
+	if q == nil {
+		return "", nil
+	}
+	cond, err := t.boolCondition(q, bind)
+	if err != nil {
+		return "", err
+	}
+	return " WHERE " + cond, nil
+}
+
+// boolCondition translates a bool query into a sql condition
+func (t *sqlTable) boolCondition(q *BoolQuery, bind func(arg any) string) (string, error) {
+	var conds []string
+	for _, query := range append(append([]Query{}, q.Must...), q.Filter...) {
+		cond, err := t.condition(query, bind)
+		if err != nil {
+			return "", err
+		}
+		conds = append(conds, cond)
+	}
+	for _, query := range q.MustNot {
+		cond, err := t.condition(query, bind)
+		if err != nil {
+			return "", err
+		}
+		conds = append(conds, "NOT "+cond)
+	}
+	if len(q.Should) > 0 && len(q.Must) == 0 && len(q.Filter) == 0 {
+		should := make([]string, 0, len(q.Should))
+		for _, query := range q.Should {
+			cond, err := t.condition(query, bind)
+			if err != nil {
+				return "", err
+			}
+			should = append(should, cond)
+		}
+		conds = append(conds, "("+strings.Join(should, " OR ")+")")
+	}
+	if len(conds) == 0 {
+		return "1 = 1", nil
+	}
+	return "(" + strings.Join(conds, " AND ") + ")", nil
+}
+
+// condition translates a single query into a sql condition
+func (t *sqlTable) condition(query Query, bind func(arg any) string) (string, error) {
+	switch {
+	case query.Range != nil:
+		col, err := t.column(query.Range.Field)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s BETWEEN %s AND %s", quoteIdent(col), bind(query.Range.Min), bind(query.Range.Max)), nil
+	case query.Match != nil:
+		col, err := t.column(query.Match.Field)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s = %s", quoteIdent(col), bind(query.Match.Value)), nil
+	case query.Terms != nil:
+		col, err := t.column(query.Terms.Field)
+		if err != nil {
+			return "", err
+		}
+		if len(query.Terms.Values) == 0 {
+			return "1 = 0", nil
+		}
+		placeholders := make([]string, len(query.Terms.Values))
+		for i, value := range query.Terms.Values {
+			placeholders[i] = bind(value)
+		}
+		return fmt.Sprintf("%s IN (%s)", quoteIdent(col), strings.Join(placeholders, ", ")), nil
+	case query.Exists != nil:
+		col, err := t.column(query.Exists.Field)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s IS NOT NULL", quoteIdent(col)), nil
+	case query.Bool != nil:
+		return t.boolCondition(query.Bool, bind)
+	}
+	return "1 = 1", nil
+}
+
+// selectQuery builds a select of the documents matching params, the caller appends order and limits
+func (t *sqlTable) selectQuery(params QueryParams, bind func(arg any) string) (string, error) {
+	where, err := t.where(params, bind)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("SELECT %s FROM %s%s", strings.Join(t.columnNames(), ", "), quoteIdent(t.Name), where), nil
+}
+
+// pageQuery builds the select of the page following the document (lastSort, lastID) for keyset pagination.
+// Like the elasticsearch scroll, From and To bound the sort field.
+func (t *sqlTable) pageQuery(params QueryParams, bind func(arg any) string, lastSort any, lastID string) (string, error) {
+	query, err := t.selectQuery(params, bind)
+	if err != nil {
+		return "", err
+	}
+	var conds []string
+	var sortCol string
+	if params.SortField != "" {
+		if sortCol, err = t.column(params.SortField); err != nil {
+			return "", err
+		}
+		if params.From != 0 {
+			conds = append(conds, fmt.Sprintf("%s >= %s", quoteIdent(sortCol), bind(params.From)))
+		}
+		if params.To != 0 {
+			conds = append(conds, fmt.Sprintf("%s <= %s", quoteIdent(sortCol), bind(params.To)))
+		}
+	}
+	if lastID != "" {
+		cmp := "<"
+		if params.SortAsc {
+			cmp = ">"
+		}
+		if sortCol != "" {
+			conds = append(conds, fmt.Sprintf("(%s, id) %s (%s, %s)", quoteIdent(sortCol), cmp, bind(lastSort), bind(lastID)))
+		} else {
+			conds = append(conds, fmt.Sprintf("id %s %s", cmp, bind(lastID)))
+		}
+	}
+	if len(conds) > 0 {
+		if strings.Contains(query, " WHERE ") {
+			query += " AND " + strings.Join(conds, " AND ")
+		} else {
+			query += " WHERE " + strings.Join(conds, " AND ")
+		}
+	}
+	order, err := t.orderBy(params)
+	if err != nil {
+		return "", err
+	}
+	return query + order + fmt.Sprintf(" LIMIT %d", params.Size), nil
+}
+
+// sortValue returns the value of the sort field of document, used as keyset of the next page
+func (t *sqlTable) sortValue(params QueryParams, document schema.DocType) any {
+	col, err := t.column(params.SortField)
+	if params.SortField == "" || err != nil {
+		return nil
+	}
+	values, err := t.values(document)
+	if err != nil {
+		return nil
+	}
+	for i, name := range t.columnNames() {
+		if name == quoteIdent(col) {
+			return values[i]
+		}
+	}
+	return nil
+}
+
+// cursorPosition returns the sort value and id of the last document of a page from its cursor
+func (t *sqlTable) cursorPosition(cursor string) (any, string, error) {
+	c, err := decodeCursor(cursor)
+	if err != nil || c == nil {
+		return nil, "", err
+	}
+	if len(c.After) != 2 {
+		return nil, "", ErrInvalidCursor
+	}
+	lastID, ok := c.After[1].(string)
+	if !ok {
+		return nil, "", ErrInvalidCursor
+	}
+	lastSort := c.After[0]
+	if n, ok := lastSort.(json.Number); ok {
+		if lastSort, err = strconv.ParseUint(n.String(), 10, 64); err != nil {
+			return nil, "", ErrInvalidCursor
+		}
+	}
+	return lastSort, lastID, nil
+}
+
+// newPage returns documents as a page, a full page gets the cursor of its last document
+func (t *sqlTable) newPage(params QueryParams, documents []schema.DocType) (*Page, error) {
+	page := &Page{Documents: documents}
+	if len(documents) < params.Size {
+		return page, nil
+	}
+	last := documents[len(documents)-1]
+	next := &pageCursor{After: []any{t.sortValue(params, last), last.GetID()}}
+	var err error
+	page.Cursor, err = next.encode()
+	return page, err
+}
+
+// orderBy builds the order of params, the id breaks ties so that pages are stable
+func (t *sqlTable) orderBy(params QueryParams) (string, error) {
+	dir := "DESC"
+	if params.SortAsc {
+		dir = "ASC"
+	}
+	if params.SortField == "" {
+		return " ORDER BY " + quoteIdent("id") + " " + dir, nil
+	}
+	col, err := t.column(params.SortField)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf(" ORDER BY %s %s, %s %s", quoteIdent(col), dir, quoteIdent("id"), dir), nil
+}
+
+// sqlType returns the column type of a field kind, unsigned fields share BIGINT and are limited to math.MaxInt64
+func sqlType(kind reflect.Kind) string {
+	switch kind {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "BIGINT"
+	case reflect.Float32, reflect.Float64:
+		return "DOUBLE PRECISION"
+	case reflect.Bool:
+		return "BOOLEAN"
+	default:
+		return "TEXT"
+	}
+}
+
+// sqlRows is the part of the result rows of database/sql and pgx read by the shared sql code
+type sqlRows interface {
+	Next() bool
+	Scan(dest ...any) error
+	Err() error
+}
+
+// metricExpr returns the expression computing a metric aggregation, a sum of no rows is 0 like in elasticsearch
+func (t *sqlTable) metricExpr(agg Aggregation) (string, error) {
+	col, err := t.column(agg.Field)
+	if err != nil {
+		return "", err
+	}
+	switch agg.Type {
+	case AggregationSum:
+		return fmt.Sprintf("CAST(COALESCE(SUM(%s), 0) AS DOUBLE PRECISION)", quoteIdent(col)), nil
+	case AggregationMin:
+		return fmt.Sprintf("CAST(MIN(%s) AS DOUBLE PRECISION)", quoteIdent(col)), nil
+	case AggregationMax:
+		return fmt.Sprintf("CAST(MAX(%s) AS DOUBLE PRECISION)", quoteIdent(col)), nil
+	}
+	return "", fmt.Errorf("aggregation %s is not a metric", agg.Name)
+}
+
+// aggregationQuery builds the select of a validated aggregation,
+// metrics select a single value and bucket aggregations a row of key, document count and sub metrics per bucket
+func (t *sqlTable) aggregationQuery(params QueryParams, agg Aggregation, bind func(arg any) string) (string, error) {
+	where, err := t.where(params, bind)
+	if err != nil {
+		return "", err
+	}
+	if agg.isMetric() {
+		expr, err := t.metricExpr(agg)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("SELECT %s FROM %s%s", expr, quoteIdent(t.Name), where), nil
+	}
+
+	col, err := t.column(agg.Field)
+	if err != nil {
+		return "", err
+	}
+	key := quoteIdent(col)
+	if agg.Type == AggregationDateHistogram {
+		interval := agg.Interval.Milliseconds()
+		key = fmt.Sprintf("(%s / %d) * %d", quoteIdent(col), interval, interval)
+	}
+	selects := []string{fmt.Sprintf("CAST(%s AS TEXT)", key), "COUNT(*)"}
+	for _, sub := range agg.SubAggregations {
+		expr, err := t.metricExpr(sub)
+		if err != nil {
+			return "", err
+		}
+		selects = append(selects, expr)
+	}
+	query := fmt.Sprintf("SELECT %s FROM %s%s GROUP BY %s", strings.Join(selects, ", "), quoteIdent(t.Name), where, key)
+	if agg.Type == AggregationTerms {
+		return query + fmt.Sprintf(" ORDER BY COUNT(*) DESC, %s ASC LIMIT %d", key, agg.termsSize()), nil
+	}
+	return query + fmt.Sprintf(" ORDER BY %s ASC", key), nil
+}
+
+// scanAggregation reads the rows of aggregationQuery
+func scanAggregation(rows sqlRows, agg Aggregation) (*AggregationResult, error) {
+	result := new(AggregationResult)
+	for rows.Next() {
+		if agg.isMetric() {
+			if err := rows.Scan(&result.Value); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		bucket := Bucket{SubAggregations: make(map[string]*AggregationResult, len(agg.SubAggregations))}
+		dest := []any{&bucket.Key, &bucket.DocCount}
+		for _, sub := range agg.SubAggregations {
+			metric := new(AggregationResult)
+			bucket.SubAggregations[sub.Name] = metric
+			dest = append(dest, &metric.Value)
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		result.Buckets = append(result.Buckets, bucket)
+	}
+	return result, rows.Err()
+}
+
+// createTableStatements returns the statements creating the table and its secondary indices
+func (t *sqlTable) createTableStatements() []string {
+	defs := make([]string, 0, len(t.Columns)+1)
+	defs = append(defs, quoteIdent("id")+" TEXT PRIMARY KEY")
+	for _, col := range t.Columns {
+		defs = append(defs, fmt.Sprintf("%s %s NOT NULL", quoteIdent(col.Name), sqlType(col.Kind)))
+	}
+	stmts := []string{fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s)", quoteIdent(t.Name), strings.Join(defs, ", "))}
+	for _, indexed := range sqlIndexedColumns {
+		if _, err := t.column(indexed); err != nil {
+			continue
+		}
+		stmts = append(stmts, fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s (%s)", quoteIdent(t.Name+"_"+indexed+"_idx"), quoteIdent(t.Name), quoteIdent(indexed)))
+	}
+	return stmts
+}
+
+func quoteIdent(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// conflictClause returns the ON CONFLICT action of a bulk, skipping existing rows unless upsert is set,
+// with latest only overwriting rows of the same or an earlier block
+func (t *sqlTable) conflictClause(upsert, latest bool) (string, error) {
+	if !upsert {
+		return "DO NOTHING", nil
+	}
+	sets := make([]string, 0, len(t.Columns))
+	for _, col := range t.Columns {
+		sets = append(sets, fmt.Sprintf("%s = excluded.%s", quoteIdent(col.Name), quoteIdent(col.Name)))
+	}
+	conflict := "DO UPDATE SET " + strings.Join(sets, ", ")
+	if latest {
+		col, err := t.column(latestField)
+		if err != nil {
+			return "", err
+		}
+		conflict += fmt.Sprintf(" WHERE %s.%s <= excluded.%s", quoteIdent(t.Name), quoteIdent(col), quoteIdent(col))
+	}
+	return conflict, nil
+}
+
+// dedupDocuments keeps the last document of every id, a single statement cannot write the same row twice
+func dedupDocuments(documents []schema.DocType) []schema.DocType {
+	seen := make(map[string]int, len(documents))
+	deduped := make([]schema.DocType, 0, len(documents))
+	for _, document := range documents {
+		if idx, ok := seen[document.GetID()]; ok {
+			deduped[idx] = document
+			continue
+		}
+		seen[document.GetID()] = len(deduped)
+		deduped = append(deduped, document)
+	}
+	return deduped
+}
@@ -0,0 +1,533 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/rabbitprincess/eth-indexer/indexer/schema"
+	"github.com/rs/zerolog"
+	_ "modernc.org/sqlite"
+)
+
+const sqliteAliasTable = "index_alias"
+
+// SqliteDBController implements DbController on an embedded SQLite file.
+// The layout is the same as PgDBController: a table per index derived from the db tags, aliases are views.
+type SqliteDBController struct {
+	logger *zerolog.Logger
+	db     *sql.DB
+
+	mtx    sync.Mutex
+	tables map[string]*sqlTable
+}
+
+// NewSqliteDbController opens or creates the SQLite database at path
+func NewSqliteDbController(ctx context.Context, logger *zerolog.Logger, path string) (*SqliteDBController, error) {
+	if dir := filepath.Dir(path); dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, err
+		}
+	}
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=journal_mode(WAL)&_pragma=busy_timeout(10000)&_pragma=synchronous(NORMAL)")
+	if err != nil {
+		return nil, err
+	}
+	// sqlite has a single writer, serializing connections avoids busy errors
+	db.SetMaxOpenConns(1)
+
+	_, err = db.ExecContext(ctx, fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (alias_name TEXT PRIMARY KEY, index_name TEXT NOT NULL)", quoteIdent(sqliteAliasTable)))
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	logger.Info().Str("path", path).Msg("Opened sqlite database")
+	return &SqliteDBController{
+		logger: logger,
+		db:     db,
+		tables: make(map[string]*sqlTable),
+	}, nil
+}
+
+// Close closes the database file
+func (lite *SqliteDBController) Close() error {
+	return lite.db.Close()
+}
+
+// table returns the layout of indexName, creating the table on first use like elasticsearch creates indices
+func (lite *SqliteDBController) table(ctx context.Context, indexName string) (*sqlTable, error) {
+	lite.mtx.Lock()
+	defer lite.mtx.Unlock()
+	if table, ok := lite.tables[indexName]; ok {
+		return table, nil
+	}
+
+	name, err := lite.resolve(ctx, indexName)
+	if err != nil {
+		return nil, err
+	}
+	table, err := newSqlTable(name)
+	if err != nil {
+		return nil, err
+	}
+	for _, stmt := range table.createTableStatements() {
+		if _, err = lite.db.ExecContext(ctx, stmt); err != nil {
+			return nil, err
+		}
+	}
+	lite.tables[indexName] = table
+	return table, nil
+}
+
+// resolve returns the table of indexName, an alias is a view for readers outside the indexer,
+// the indexer reads and writes the table behind it
+func (lite *SqliteDBController) resolve(ctx context.Context, indexName string) (string, error) {
+	name := indexName
+	err := lite.db.QueryRowContext(ctx, fmt.Sprintf("SELECT index_name FROM %s WHERE alias_name = ?", quoteIdent(sqliteAliasTable)), indexName).Scan(&name)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return "", err
+	}
+	return name, nil
+}
+
+// hasTable reports whether the table of indexName exists, without creating it like table does
+func (lite *SqliteDBController) hasTable(ctx context.Context, indexName string) (bool, error) {
+	lite.mtx.Lock()
+	_, ok := lite.tables[indexName]
+	lite.mtx.Unlock()
+	if ok {
+		return true, nil
+	}
+	name, err := lite.resolve(ctx, indexName)
+	if err != nil {
+		return false, err
+	}
+	var exists bool
+	err = lite.db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = ?)", name).Scan(&exists)
+	return exists, err
+}
+
+func sqliteBind(args *[]any) func(arg any) string {
+	return func(arg any) string {
+		*args = append(*args, arg)
+		return "?"
+	}
+}
+
+func (lite *SqliteDBController) Exists(indexName string, id string) bool {
+	ctx := context.Background()
+	table, err := lite.table(ctx, indexName)
+	if err != nil {
+		return false
+	}
+	var exists bool
+	err = lite.db.QueryRowContext(ctx, fmt.Sprintf("SELECT EXISTS (SELECT 1 FROM %s WHERE id = ?)", quoteIdent(table.Name)), id).Scan(&exists)
+	return err == nil && exists
+}
+
+// Insert inserts a single document, overwriting the document with the same id
+func (lite *SqliteDBController) Insert(document schema.DocType, indexName string) error {
+	bulk := lite.UpsertBulk(indexName)
+	bulk.Add(document)
+	return bulk.Commit()
+}
+
+// Update creates or overwrites the document with id
+func (lite *SqliteDBController) Update(document schema.DocType, indexName string, id string) error {
+	document.SetID(id)
+	return lite.Insert(document, indexName)
+}
+
+// Delete removes documents specified by the query params
+func (lite *SqliteDBController) Delete(params QueryParams) (uint64, error) {
+	ctx := context.Background()
+	table, err := lite.table(ctx, params.IndexName)
+	if err != nil {
+		return 0, err
+	}
+	var args []any
+	where, err := table.where(params, sqliteBind(&args))
+	if err != nil {
+		return 0, err
+	}
+	res, err := lite.db.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s%s", quoteIdent(table.Name), where), args...)
+	if err != nil {
+		return 0, err
+	}
+	deleted, err := res.RowsAffected()
+	return uint64(deleted), err
+}
+
+// Count returns the number of documents matching the query params, 0 for a table which does not exist yet
+func (lite *SqliteDBController) Count(params QueryParams) (int64, error) {
+	ctx := context.Background()
+	if exists, err := lite.hasTable(ctx, params.IndexName); err != nil || !exists {
+		return 0, err
+	}
+	table, err := lite.table(ctx, params.IndexName)
+	if err != nil {
+		return 0, err
+	}
+	var args []any
+	where, err := table.where(params, sqliteBind(&args))
+	if err != nil {
+		return 0, err
+	}
+	var count int64
+	err = lite.db.QueryRowContext(ctx, fmt.Sprintf("SELECT COUNT(*) FROM %s%s", quoteIdent(table.Name), where), args...).Scan(&count)
+	return count, err
+}
+
+// SelectOne selects a single document
+func (lite *SqliteDBController) SelectOne(params QueryParams, createDocument CreateDocFunction) (schema.DocType, error) {
+	ctx := context.Background()
+	table, err := lite.table(ctx, params.IndexName)
+	if err != nil {
+		return nil, err
+	}
+	var args []any
+	query, err := table.selectQuery(params, sqliteBind(&args))
+	if err != nil {
+		return nil, err
+	}
+	if params.SortField != "" {
+		order, err := table.orderBy(params)
+		if err != nil {
+			return nil, err
+		}
+		query += order
+	}
+	query += fmt.Sprintf(" LIMIT 1 OFFSET %d", params.From)
+
+	document, err := table.scan(lite.db.QueryRowContext(ctx, query, args...))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return document, err
+}
+
+// MultiGet fetches documents by id in a single query, ids which are not found are skipped
+func (lite *SqliteDBController) MultiGet(indexName string, ids []string, createDocument CreateDocFunction) ([]schema.DocType, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	ctx := context.Background()
+	table, err := lite.table(ctx, indexName)
+	if err != nil {
+		return nil, err
+	}
+	args := make([]any, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(ids)), ", ")
+	rows, err := lite.db.QueryContext(ctx, fmt.Sprintf("SELECT %s FROM %s WHERE id IN (%s)", strings.Join(table.columnNames(), ", "), quoteIdent(table.Name), placeholders), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	documents := make([]schema.DocType, 0, len(ids))
+	for rows.Next() {
+		document, err := table.scan(rows)
+		if err != nil {
+			return nil, err
+		}
+		documents = append(documents, document)
+	}
+	return documents, rows.Err()
+}
+
+// UpdateAlias points the alias view to indexName and drops the tables it pointed to before
+func (lite *SqliteDBController) UpdateAlias(aliasName string, indexName string) error {
+	ctx := context.Background()
+	if _, err := lite.table(ctx, indexName); err != nil {
+		return err
+	}
+	tx, err := lite.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var oldIndex string
+	err = tx.QueryRowContext(ctx, fmt.Sprintf("SELECT index_name FROM %s WHERE alias_name = ?", quoteIdent(sqliteAliasTable)), aliasName).Scan(&oldIndex)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	// without an alias the name may belong to a table written before aliases were used, it is retired like an old index
+	stmts := []string{fmt.Sprintf("DROP VIEW IF EXISTS %s", quoteIdent(aliasName))}
+	if oldIndex == "" {
+		stmts = []string{fmt.Sprintf("DROP TABLE IF EXISTS %s", quoteIdent(aliasName))}
+	}
+	stmts = append(stmts, fmt.Sprintf("CREATE VIEW %s AS SELECT * FROM %s", quoteIdent(aliasName), quoteIdent(indexName)))
+	if oldIndex != "" && oldIndex != indexName {
+		stmts = append(stmts, fmt.Sprintf("DROP TABLE IF EXISTS %s", quoteIdent(oldIndex)))
+	}
+	for _, stmt := range stmts {
+		if _, err = tx.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	_, err = tx.ExecContext(ctx, fmt.Sprintf("INSERT INTO %s (alias_name, index_name) VALUES (?, ?) ON CONFLICT (alias_name) DO UPDATE SET index_name = excluded.index_name", quoteIdent(sqliteAliasTable)), aliasName, indexName)
+	if err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	lite.mtx.Lock()
+	delete(lite.tables, oldIndex)
+	delete(lite.tables, aliasName)
+	lite.mtx.Unlock()
+	return nil
+}
+
+// GetExistingIndexPrefix checks for the table behind an alias and returns its prefix, if any
+func (lite *SqliteDBController) GetExistingIndexPrefix(aliasName string, documentType string) (bool, string, error) {
+	var indexName string
+	err := lite.db.QueryRowContext(context.Background(), fmt.Sprintf("SELECT index_name FROM %s WHERE alias_name = ?", quoteIdent(sqliteAliasTable)), aliasName).Scan(&indexName)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, "", nil
+	} else if err != nil {
+		return false, "", err
+	}
+	return true, strings.TrimSuffix(indexName, documentType), nil
+}
+
+// CreateIndex creates the table of documentType
+func (lite *SqliteDBController) CreateIndex(indexName string, documentType string) error {
+	if !strings.HasSuffix(indexName, documentType) {
+		return fmt.Errorf("index %s is not named after document type %s", indexName, documentType)
+	}
+	_, err := lite.table(context.Background(), indexName)
+	return err
+}
+
+// Scroll creates a new scroll instance which pages through the query with keyset pagination
+func (lite *SqliteDBController) Scroll(params QueryParams, createDocument CreateDocFunction) ScrollInstance {
+	params.Size = pageSize(params)
+	return &SqliteScrollInstance{
+		lite:   lite,
+		ctx:    context.Background(),
+		params: params,
+	}
+}
+
+// SqliteScrollInstance is an instance of a scroll for sqlite
+type SqliteScrollInstance struct {
+	lite   *SqliteDBController
+	ctx    context.Context
+	params QueryParams
+
+	page     []schema.DocType
+	current  int
+	lastSort any
+	lastID   string
+	done     bool
+}
+
+// Next returns the next document of a scroll or io.EOF
+func (scroll *SqliteScrollInstance) Next() (schema.DocType, error) {
+	if scroll.current >= len(scroll.page) {
+		if scroll.done {
+			return nil, io.EOF
+		}
+		if err := scroll.fetch(); err != nil {
+			return nil, err
+		}
+		if len(scroll.page) == 0 {
+			return nil, io.EOF
+		}
+	}
+	document := scroll.page[scroll.current]
+	scroll.current++
+	return document, nil
+}
+
+// fetch loads the page following the last returned document
+func (scroll *SqliteScrollInstance) fetch() error {
+	table, err := scroll.lite.table(scroll.ctx, scroll.params.IndexName)
+	if err != nil {
+		return err
+	}
+	scroll.page, err = scroll.lite.page(scroll.ctx, table, scroll.params, scroll.lastSort, scroll.lastID)
+	if err != nil {
+		return err
+	}
+	scroll.current = 0
+
+	scroll.done = len(scroll.page) < scroll.params.Size
+	if len(scroll.page) > 0 {
+		last := scroll.page[len(scroll.page)-1]
+		scroll.lastID = last.GetID()
+		scroll.lastSort = table.sortValue(scroll.params, last)
+	}
+	return nil
+}
+
+// page reads the page of params following the document (lastSort, lastID) with keyset pagination
+func (lite *SqliteDBController) page(ctx context.Context, table *sqlTable, params QueryParams, lastSort any, lastID string) ([]schema.DocType, error) {
+	var args []any
+	query, err := table.pageQuery(params, sqliteBind(&args), lastSort, lastID)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := lite.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var documents []schema.DocType
+	for rows.Next() {
+		document, err := table.scan(rows)
+		if err != nil {
+			return nil, err
+		}
+		documents = append(documents, document)
+	}
+	return documents, rows.Err()
+}
+
+// Aggregate computes aggregations over the documents matching params with a grouped select per aggregation
+func (lite *SqliteDBController) Aggregate(params QueryParams, aggregations ...Aggregation) (map[string]*AggregationResult, error) {
+	ctx := context.Background()
+	table, err := lite.table(ctx, params.IndexName)
+	if err != nil {
+		return nil, err
+	}
+	results := make(map[string]*AggregationResult, len(aggregations))
+	for _, agg := range aggregations {
+		if err := agg.validate(); err != nil {
+			return nil, err
+		}
+		var args []any
+		query, err := table.aggregationQuery(params, agg, sqliteBind(&args))
+		if err != nil {
+			return nil, err
+		}
+		rows, err := lite.db.QueryContext(ctx, query, args...)
+		if err != nil {
+			return nil, err
+		}
+		results[agg.Name], err = scanAggregation(rows, agg)
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+// SearchPage returns the page of matching documents following cursor
+func (lite *SqliteDBController) SearchPage(params QueryParams, cursor string, createDocument CreateDocFunction) (*Page, error) {
+	ctx := context.Background()
+	params.Size = pageSize(params)
+	table, err := lite.table(ctx, params.IndexName)
+	if err != nil {
+		return nil, err
+	}
+	lastSort, lastID, err := table.cursorPosition(cursor)
+	if err != nil {
+		return nil, err
+	}
+	documents, err := lite.page(ctx, table, params, lastSort, lastID)
+	if err != nil {
+		return nil, err
+	}
+	return table.newPage(params, documents)
+}
+
+// InsertBulk creates a bulk instance which creates documents, skipping the ones that already exist
+func (lite *SqliteDBController) InsertBulk(indexName string) BulkInstance {
+	return &SqliteBulkInstance{
+		lite:      lite,
+		ctx:       context.Background(),
+		indexName: indexName,
+	}
+}
+
+// UpsertBulk creates a bulk instance which creates documents or overwrites the existing ones
+func (lite *SqliteDBController) UpsertBulk(indexName string) BulkInstance {
+	return &SqliteBulkInstance{
+		lite:      lite,
+		ctx:       context.Background(),
+		indexName: indexName,
+		upsert:    true,
+	}
+}
+
+// UpsertLatestBulk creates a bulk instance which creates documents or overwrites the existing ones of the same or
+// an earlier block, so that a late write never replaces a newer document
+func (lite *SqliteDBController) UpsertLatestBulk(indexName string) BulkInstance {
+	return &SqliteBulkInstance{
+		lite:      lite,
+		ctx:       context.Background(),
+		indexName: indexName,
+		upsert:    true,
+		latest:    true,
+	}
+}
+
+type SqliteBulkInstance struct {
+	lite      *SqliteDBController
+	ctx       context.Context
+	indexName string
+	upsert    bool
+	latest    bool
+	documents []schema.DocType
+}
+
+func (bulk *SqliteBulkInstance) Add(document schema.DocType) {
+	bulk.documents = append(bulk.documents, document)
+}
+
+// Commit writes the documents with a prepared statement in one transaction
+func (bulk *SqliteBulkInstance) Commit() error {
+	documents := dedupDocuments(bulk.documents)
+	bulk.documents = nil
+	if len(documents) == 0 {
+		return nil
+	}
+	table, err := bulk.lite.table(bulk.ctx, bulk.indexName)
+	if err != nil {
+		return err
+	}
+
+	conflict, err := table.conflictClause(bulk.upsert, bulk.latest)
+	if err != nil {
+		return err
+	}
+	names := table.columnNames()
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(names)), ", ")
+
+	tx, err := bulk.lite.db.BeginTx(bulk.ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.PrepareContext(bulk.ctx, fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s) ON CONFLICT (id) %s", quoteIdent(table.Name), strings.Join(names, ", "), placeholders, conflict))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, document := range documents {
+		values, err := table.values(document)
+		if err != nil {
+			return err
+		}
+		if _, err = stmt.ExecContext(bulk.ctx, values...); err != nil {
+			bulk.lite.logger.Error().Str("index", table.Name).Str("id", document.GetID()).Err(err).Msg("bulk commit failed")
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,57 @@
+package db
+
+import (
+	"context"
+	"math"
+	"path/filepath"
+	"testing"
+
+	"github.com/rabbitprincess/eth-indexer/indexer/schema"
+	"github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSqlite(t *testing.T) {
+	controller, err := NewSqliteDbController(context.Background(), &log.Logger, filepath.Join(t.TempDir(), "indexer.db"))
+	require.NoError(t, err)
+	defer controller.Close()
+
+	testDbController(t, controller)
+}
+
+func TestSqliteUint64Range(t *testing.T) {
+	controller, err := NewSqliteDbController(context.Background(), &log.Logger, filepath.Join(t.TempDir(), "indexer.db"))
+	require.NoError(t, err)
+	defer controller.Close()
+	require.NoError(t, controller.CreateIndex(schema.TableAccountBalance, schema.TableAccountBalance))
+
+	// unsigned values are stored as BIGINT, the ones it cannot hold are rejected
+	bulk := controller.UpsertBulk(schema.TableAccountBalance)
+	balance := newTestBalance("0xaa", 1, "1")
+	balance.BlockNumber = math.MaxInt64
+	bulk.Add(balance)
+	require.NoError(t, bulk.Commit())
+	balance = newTestBalance("0xbb", 1, "1")
+	balance.BlockNumber = math.MaxInt64 + 1
+	bulk.Add(balance)
+	require.ErrorContains(t, bulk.Commit(), "exceeds the range of BIGINT")
+}
+
+func TestSqliteCountMissingTable(t *testing.T) {
+	controller, err := NewSqliteDbController(context.Background(), &log.Logger, filepath.Join(t.TempDir(), "indexer.db"))
+	require.NoError(t, err)
+	defer controller.Close()
+
+	// counting probes for tables without creating them
+	count, err := controller.Count(QueryParams{IndexName: schema.TableAccountBalance})
+	require.NoError(t, err)
+	require.Zero(t, count)
+	exists, err := controller.hasTable(context.Background(), schema.TableAccountBalance)
+	require.NoError(t, err)
+	require.False(t, exists)
+
+	require.NoError(t, controller.CreateIndex(schema.TableAccountBalance, schema.TableAccountBalance))
+	exists, err = controller.hasTable(context.Background(), schema.TableAccountBalance)
+	require.NoError(t, err)
+	require.True(t, exists)
+}
@@ -2,7 +2,11 @@ package indexer
 
 import (
 	"context"
+	"fmt"
+	"math/big"
+	"time"
 
+	"github.com/ethereum/go-ethereum/common/lru"
 	"github.com/rabbitprincess/eth-indexer/indexer/client"
 	"github.com/rabbitprincess/eth-indexer/indexer/db"
 	"github.com/rabbitprincess/eth-indexer/indexer/schema"
@@ -10,15 +14,71 @@ import (
 )
 
 type DTO struct {
+	// prefix of the indices of the network, see schema.IndexPrefix
+	prefix      string
 	blockNumber uint64
+	// blockTimestamp of the current block in milliseconds, parentTimestamp of the block before it if known
+	blockTimestamp  uint64
+	parentTimestamp uint64
+	lastCommit      *schema.BlockCommit
 
+	// balanceCache survives across blocks, accountBalance only holds the balances touched by the current block
+	balanceCache   *BalanceCache
 	accountBalance map[string]*schema.AccountBalance
 	balanceChange  []*schema.BalanceCHangeHistory
+
+	// block of the current block if known, issuance and transferVolume total the credits of its balance changes
+	block        *schema.Block
+	transactions []*schema.Transaction
+	// tokenBalance holds the token balances touched by the current block by schema.TokenBalanceID
+	tokenBalance map[string]*schema.TokenBalance
+	tokenChange  []*schema.TokenBalanceChangeHistory
+
+	// nftOwner and nftHolding hold the owners and holdings of token ids touched by the current block by their ids
+	nftOwner    map[string]*schema.NftOwner
+	nftHolding  map[string]*schema.NftHolding
+	nftTransfer []*schema.NftTransfer
+
+	// tokens holds the metadata of contracts first seen by the current block, knownTokens the contracts committed before
+	tokens      map[string]*schema.Token
+	knownTokens *lru.BasicLRU[string, struct{}]
+
+	// internalTransactions are the value transfers of sub calls
+	internalTransactions []*schema.InternalTransaction
+	issuance             *big.Int
+	transferVolume       *big.Int
+
+	// accounts known to have no committed balance in db
+	missingBalance map[string]struct{}
+}
+
+// NewDTO creates a DTO writing to the indices of prefix
+func NewDTO(prefix string) *DTO {
+	d := &DTO{prefix: prefix}
+	d.Init(0, 0)
+	return d
 }
 
-func (d *DTO) Init(blockNumber uint64) {
-	d.blockNumber = blockNumber
+// Init starts collecting the documents of a block, blockTimestamp is in milliseconds
+func (d *DTO) Init(blockNumber uint64, blockTimestamp uint64) {
+	d.parentTimestamp = 0
+	if blockNumber > 0 && blockNumber == d.blockNumber+1 {
+		d.parentTimestamp = d.blockTimestamp
+	}
+	d.blockNumber, d.blockTimestamp = blockNumber, blockTimestamp
+	if d.balanceCache == nil {
+		d.balanceCache = NewBalanceCache(0)
+	}
+	if d.knownTokens == nil {
+		d.knownTokens = newTokenCache()
+	}
 	d.accountBalance = make(map[string]*schema.AccountBalance)
+	d.missingBalance = make(map[string]struct{})
+	d.block, d.issuance, d.transferVolume = nil, new(big.Int), new(big.Int)
+	d.transactions, d.internalTransactions = d.transactions[:0], d.internalTransactions[:0]
+	d.tokenBalance, d.tokenChange = make(map[string]*schema.TokenBalance), d.tokenChange[:0]
+	d.nftOwner, d.nftHolding, d.nftTransfer = make(map[string]*schema.NftOwner), make(map[string]*schema.NftHolding), d.nftTransfer[:0]
+	d.tokens = make(map[string]*schema.Token)
 	if d.balanceChange == nil {
 		d.balanceChange = make([]*schema.BalanceCHangeHistory, 0, 1024)
 	} else {
@@ -27,7 +87,8 @@ func (d *DTO) Init(blockNumber uint64) {
 }
 
 func (d *DTO) Commit(db db.DbController) error {
-	bulk := db.InsertBulk(schema.TableAccountBalance)
+	// balances and owners of a block never replace the ones of a later block, e.g. written by another run of the same blocks
+	bulk := db.UpsertLatestBulk(d.prefix + schema.TableAccountBalance)
 	for _, balance := range d.accountBalance {
 		bulk.Add(balance)
 	}
@@ -36,7 +97,7 @@ func (d *DTO) Commit(db db.DbController) error {
 		return err
 	}
 
-	bulk = db.InsertBulk(schema.TableBalanceChangeHistory)
+	bulk = db.InsertBulk(d.prefix + schema.TableBalanceChangeHistory)
 	for _, change := range d.balanceChange {
 		bulk.Add(change)
 	}
@@ -44,9 +105,135 @@ func (d *DTO) Commit(db db.DbController) error {
 	if err != nil {
 		return err
 	}
+
+	bulk = db.UpsertLatestBulk(d.prefix + schema.TableTokenBalance)
+	for _, balance := range d.tokenBalance {
+		bulk.Add(balance)
+	}
+	err = bulk.Commit()
+	if err != nil {
+		return err
+	}
+
+	bulk = db.InsertBulk(d.prefix + schema.TableTokenBalanceHistory)
+	for _, change := range d.tokenChange {
+		bulk.Add(change)
+	}
+	err = bulk.Commit()
+	if err != nil {
+		return err
+	}
+
+	bulk = db.UpsertLatestBulk(d.prefix + schema.TableNftOwner)
+	for _, owner := range d.nftOwner {
+		bulk.Add(owner)
+	}
+	err = bulk.Commit()
+	if err != nil {
+		return err
+	}
+
+	bulk = db.UpsertLatestBulk(d.prefix + schema.TableNftHolding)
+	for _, holding := range d.nftHolding {
+		bulk.Add(holding)
+	}
+	err = bulk.Commit()
+	if err != nil {
+		return err
+	}
+
+	bulk = db.InsertBulk(d.prefix + schema.TableNftTransfer)
+	for _, transfer := range d.nftTransfer {
+		bulk.Add(transfer)
+	}
+	err = bulk.Commit()
+	if err != nil {
+		return err
+	}
+
+	bulk = db.UpsertBulk(d.prefix + schema.TableTokens)
+	for _, token := range d.tokens {
+		bulk.Add(token)
+	}
+	err = bulk.Commit()
+	if err != nil {
+		return err
+	}
+
+	bulk = db.InsertBulk(d.prefix + schema.TableTransactions)
+	for _, transaction := range d.transactions {
+		bulk.Add(transaction)
+	}
+	err = bulk.Commit()
+	if err != nil {
+		return err
+	}
+
+	bulk = db.InsertBulk(d.prefix + schema.TableInternalTransactions)
+	for _, internal := range d.internalTransactions {
+		bulk.Add(internal)
+	}
+	err = bulk.Commit()
+	if err != nil {
+		return err
+	}
+
+	if d.block != nil {
+		err = db.Insert(d.block, d.prefix+schema.TableBlocks)
+		if err != nil {
+			return err
+		}
+	}
+
+	// the commit marker is written last, blocks without it are rolled back on startup
+	commit := &schema.BlockCommit{
+		BaseEsType:    &schema.BaseEsType{Id: schema.BlockCommitID(d.blockNumber)},
+		BlockNumber:   d.blockNumber,
+		AccountCount:  uint64(len(d.accountBalance)),
+		ChangeCount:   uint64(len(d.balanceChange)),
+		CommittedTime: uint64(time.Now().UnixMilli()),
+	}
+	err = db.Insert(commit, d.prefix+schema.TableBlockCommit)
+	if err != nil {
+		return err
+	}
+	d.lastCommit = commit
+
+	for _, balance := range d.accountBalance {
+		d.balanceCache.Add(balance)
+	}
+	for contract := range d.tokens {
+		d.knownTokens.Add(contract, struct{}{})
+	}
 	return nil
 }
 
+// LoadLastCommit reads the commit marker of the highest committed block, it returns nil if no block is committed yet
+func (d *DTO) LoadLastCommit(dbController db.DbController) (*schema.BlockCommit, error) {
+	doc, err := dbController.SelectOne(db.QueryParams{
+		IndexName: d.prefix + schema.TableBlockCommit,
+		SortField: "block_number",
+		SortAsc:   false,
+	}, func() schema.DocType {
+		commit := new(schema.BlockCommit)
+		commit.BaseEsType = new(schema.BaseEsType)
+		return commit
+	})
+	if err != nil {
+		return nil, err
+	}
+	d.lastCommit = nil
+	if doc != nil {
+		d.lastCommit = doc.(*schema.BlockCommit)
+	}
+	return d.lastCommit, nil
+}
+
+// IsCommitted reports whether the documents of blockNumber are complete
+func (d *DTO) IsCommitted(blockNumber uint64) bool {
+	return d.lastCommit != nil && blockNumber <= d.lastCommit.BlockNumber
+}
+
 func (d *DTO) VerifyBalance(ctx context.Context, blockNumber uint64, client *client.Client) error {
 	for _, a := range d.accountBalance {
 		verifyBalance, err := client.GetAccountBalance(ctx, a.Account, blockNumber)
@@ -55,69 +242,136 @@ func (d *DTO) VerifyBalance(ctx context.Context, blockNumber uint64, client *cli
 		}
 		if verifyBalance.String() != a.Balance {
 			log.Error().Uint64("blockNumber", blockNumber).Str("address", a.Account).Str("balance", a.Balance).Str("verifyBalance", verifyBalance.String()).Msg("balance mismatch")
-			return err
+			return fmt.Errorf("balance of %s mismatch at block %d", a.Account, blockNumber)
 		}
 	}
 	return nil
 }
 
 func (d *DTO) AddAccountBalance(blockNumber uint64, blockTimeStamp uint64, account string, balance string) {
-	d.accountBalance[account] = &schema.AccountBalance{
+	accBalance := &schema.AccountBalance{
+		BaseEsType:     &schema.BaseEsType{Id: schema.AccountBalanceID(account)},
 		Account:        account,
 		BlockNumber:    blockNumber,
 		BlockTimestamp: blockTimeStamp,
-		Balance:        balance,
 	}
+	accBalance.SetBalance(balance)
+	d.accountBalance[account] = accBalance
 }
 
 func (d *DTO) GetAccountBalance(account string, dbController db.DbController, client *client.Client) (*schema.AccountBalance, error) {
-	// get from cache
+	// get from current block
 	if accBalance, exist := d.accountBalance[account]; exist {
 		return accBalance, nil
 	}
+	// get from cache
+	if accBalance, exist := d.balanceCache.Get(account); exist {
+		return accBalance, nil
+	}
 	// get from db
-	doc, err := dbController.SelectOne(db.QueryParams{
-		IndexName: schema.TableAccountBalance,
-		StringMatch: &db.StringMatchQuery{
-			Field: "account",
-			Value: account,
-		},
-	}, func() schema.DocType {
-		balance := new(schema.AccountBalance)
-		balance.BaseEsType = new(schema.BaseEsType)
-		return balance
-	})
+	if _, missing := d.missingBalance[account]; !missing {
+		err := d.PrefetchAccountBalance([]string{account}, dbController)
+		if err != nil {
+			return nil, err
+		}
+		if accBalance, exist := d.balanceCache.Peek(account); exist {
+			return accBalance, nil
+		}
+	}
+
+	// get from server, the balance before the current block is applied
+	ctx := context.Background()
+	blockNumber, blockTimestamp := d.blockNumber, d.blockTimestamp
+	if blockNumber > 0 {
+		blockNumber--
+		if d.parentTimestamp == 0 {
+			header, err := client.GetBlockHeader(ctx, blockNumber)
+			if err != nil {
+				return nil, err
+			}
+			d.parentTimestamp = schema.TimestampMillis(header.Time)
+		}
+		blockTimestamp = d.parentTimestamp
+	}
+	balance, err := client.GetAccountBalance(ctx, account, blockNumber)
 	if err != nil {
 		return nil, err
 	}
-	if doc != nil {
-		d.accountBalance[account] = doc.(*schema.AccountBalance)
-		return doc.(*schema.AccountBalance), nil
+	accBalance := &schema.AccountBalance{
+		BaseEsType:     &schema.BaseEsType{Id: schema.AccountBalanceID(account)},
+		Account:        account,
+		BlockNumber:    blockNumber,
+		BlockTimestamp: blockTimestamp,
 	}
+	accBalance.SetBalance(balance.String())
+	return accBalance, nil
+}
 
-	// get from server
-	balance, err := client.GetAccountBalance(context.Background(), account, d.blockNumber)
+// PrefetchAccountBalance loads the committed balances of accounts which are neither touched nor cached in one round trip
+func (d *DTO) PrefetchAccountBalance(accounts []string, dbController db.DbController) error {
+	ids := make([]string, 0, len(accounts))
+	for _, account := range accounts {
+		if _, exist := d.accountBalance[account]; exist {
+			continue
+		}
+		if _, missing := d.missingBalance[account]; missing {
+			continue
+		}
+		if d.balanceCache.Contains(account) {
+			continue
+		}
+		ids = append(ids, schema.AccountBalanceID(account))
+		d.missingBalance[account] = struct{}{}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	docs, err := dbController.MultiGet(d.prefix+schema.TableAccountBalance, ids, newAccountBalance)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	return &schema.AccountBalance{
-		Account:        account,
-		BlockNumber:    d.blockNumber,
-		BlockTimestamp: 0,
-		Balance:        balance.String(),
-	}, nil
+	for _, doc := range docs {
+		balance := doc.(*schema.AccountBalance)
+		if !d.IsCommitted(balance.BlockNumber) {
+			continue // written by an incomplete block
+		}
+		delete(d.missingBalance, balance.Account)
+		d.balanceCache.Add(balance)
+	}
+	return nil
 }
 
-func (d *DTO) AddBalanceChange(blockNumber uint64, blockTimeStamp uint64, account string, changeType schema.BalanceChange, balanceBefore, balanceAfter, balanceChange string, txid string, txIndex uint64) {
-	d.balanceChange = append(d.balanceChange, &schema.BalanceCHangeHistory{
+func newAccountBalance() schema.DocType {
+	balance := new(schema.AccountBalance)
+	balance.BaseEsType = new(schema.BaseEsType)
+	return balance
+}
+
+// AddBalanceChange records a change of the balance of account, delta is signed and counterparty is the other side of the transfer
+func (d *DTO) AddBalanceChange(blockNumber uint64, blockTimeStamp uint64, account string, counterparty string, changeType schema.BalanceChange, balanceBefore, balanceAfter, delta string, txid string, txIndex uint64, tracePath string) {
+	change := &schema.BalanceCHangeHistory{
+		BaseEsType:     &schema.BaseEsType{Id: schema.BalanceChangeID(blockNumber, txIndex, tracePath, changeType, account)},
 		Account:        account,
 		BlockNumber:    blockNumber,
 		BlockTimestamp: blockTimeStamp,
 		ChangeType:     uint64(changeType),
-		BalanceBefore:  balanceBefore,
-		BalanceAfter:   balanceAfter,
-		BalanceChange:  balanceChange,
+		Counterparty:   counterparty,
 		Txid:           txid,
 		TxIndex:        txIndex,
-	})
+		TracePath:      tracePath,
+	}
+	change.SetBalances(balanceBefore, balanceAfter, delta)
+	d.balanceChange = append(d.balanceChange, change)
+
+	// credits without a counterparty issue new value, the others are the receiving side of a transfer
+	value, ok := new(big.Int).SetString(delta, 10)
+	if !ok || value.Sign() <= 0 {
+		return
+	}
+	if counterparty == "" {
+		d.issuance.Add(d.issuance, value)
+	} else {
+		d.transferVolume.Add(d.transferVolume, value)
+	}
 }
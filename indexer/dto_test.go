@@ -0,0 +1,397 @@
+package indexer
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+
+	"github.com/rabbitprincess/eth-indexer/indexer/client"
+	"github.com/rabbitprincess/eth-indexer/indexer/db"
+	"github.com/rabbitprincess/eth-indexer/indexer/schema"
+	"github.com/stretchr/testify/require"
+)
+
+func count(t *testing.T, controller db.DbController, indexName string) int64 {
+	count, err := controller.Count(db.QueryParams{IndexName: indexName})
+	require.NoError(t, err)
+	return count
+}
+
+func TestDTOCommit(t *testing.T) {
+	controller := db.NewMemoryDbController()
+	dto := &DTO{}
+
+	// committing the same block twice is a no-op
+	for i := 0; i < 2; i++ {
+		dto.Init(0, 0)
+		dto.AddAccountBalance(0, 0, "0xaa", "100")
+		dto.AddBalanceChange(0, 0, "0xaa", "", schema.PreAlloc, "0", "100", "100", "", 0, "")
+		require.NoError(t, dto.Commit(controller))
+	}
+	require.EqualValues(t, 1, count(t, controller, schema.TableAccountBalance))
+	require.EqualValues(t, 1, count(t, controller, schema.TableBalanceChangeHistory))
+	require.EqualValues(t, 1, count(t, controller, schema.TableBlockCommit))
+
+	lastCommit, err := (&DTO{}).LoadLastCommit(controller)
+	require.NoError(t, err)
+	require.EqualValues(t, 0, lastCommit.BlockNumber)
+	require.EqualValues(t, 1, lastCommit.AccountCount)
+}
+
+func TestDTONetworks(t *testing.T) {
+	controller := db.NewMemoryDbController()
+	holesky, sepolia := NewDTO(schema.IndexPrefix("Holesky")), NewDTO(schema.IndexPrefix("sepolia"))
+	holesky.AddAccountBalance(0, 0, "0xaa", "100")
+	require.NoError(t, holesky.Commit(controller))
+	for block := uint64(0); block < 2; block++ {
+		sepolia.Init(block, 0)
+		sepolia.AddAccountBalance(block, 0, "0xaa", "200")
+		require.NoError(t, sepolia.Commit(controller))
+	}
+
+	// the networks share the database without seeing each other's documents
+	require.EqualValues(t, 1, count(t, controller, "holesky_"+schema.TableBlockCommit))
+	require.EqualValues(t, 2, count(t, controller, "sepolia_"+schema.TableBlockCommit))
+	require.EqualValues(t, 0, count(t, controller, schema.TableBlockCommit))
+	for dto, balance := range map[*DTO]string{holesky: "100", sepolia: "200"} {
+		dto.balanceCache.Purge()
+		_, err := dto.LoadLastCommit(controller)
+		require.NoError(t, err)
+		dto.Init(2, 0)
+		accBalance, err := dto.GetAccountBalance("0xaa", controller, nil)
+		require.NoError(t, err)
+		require.Equal(t, balance, accBalance.Balance)
+	}
+}
+
+func TestDTOGetAccountBalance(t *testing.T) {
+	controller := db.NewMemoryDbController()
+	dto := &DTO{}
+	dto.Init(0, 0)
+	dto.AddAccountBalance(0, 0, "0xaa", "100")
+	require.NoError(t, dto.Commit(controller))
+
+	// a balance written without commit marker is ignored
+	require.NoError(t, controller.Insert(&schema.AccountBalance{
+		BaseEsType:  &schema.BaseEsType{Id: schema.AccountBalanceID("0xbb")},
+		Account:     "0xbb",
+		BlockNumber: 1,
+		Balance:     "200",
+	}, schema.TableAccountBalance))
+
+	// a fresh dto reads committed balances from db
+	dto = &DTO{}
+	_, err := dto.LoadLastCommit(controller)
+	require.NoError(t, err)
+	dto.Init(1, 0)
+	balance, err := dto.GetAccountBalance("0xaa", controller, nil)
+	require.NoError(t, err)
+	require.Equal(t, "100", balance.Balance)
+	require.Equal(t, 1e-16, balance.BalanceEth)
+
+	require.NoError(t, dto.PrefetchAccountBalance([]string{"0xbb"}, controller))
+	require.Contains(t, dto.missingBalance, "0xbb")
+	require.False(t, dto.balanceCache.Contains("0xbb"))
+}
+
+func TestDTOApplyTraces(t *testing.T) {
+	controller := db.NewMemoryDbController()
+	dto := &DTO{}
+	dto.Init(0, 0)
+	dto.AddAccountBalance(0, 0, "0xaa", "1000")
+	dto.AddAccountBalance(0, 0, "0xbb", "0")
+	dto.AddAccountBalance(0, 0, "0xcc", "0")
+	require.NoError(t, dto.Commit(controller))
+
+	dto.Init(1, 12000)
+	traces := []client.TraceBlock{
+		{ // transfer of 0x64 from 0xaa to 0xbb
+			Type:            client.TraceTypeCall,
+			Action:          client.Action{CallType: "call", From: "0xAA", To: "0xbb", Value: "0x64"},
+			Result:          &client.Result{},
+			TraceAddress:    []int{},
+			TransactionHash: "0x01",
+		},
+		{ // reverted sub call
+			Type:            client.TraceTypeCall,
+			Action:          client.Action{CallType: "call", From: "0xbb", To: "0xcc", Value: "0x10"},
+			Error:           "Reverted",
+			TraceAddress:    []int{0},
+			TransactionHash: "0x01",
+		},
+		{ // child of the reverted call
+			Type:            client.TraceTypeCall,
+			Action:          client.Action{CallType: "call", From: "0xcc", To: "0xaa", Value: "0x1"},
+			Result:          &client.Result{},
+			TraceAddress:    []int{0, 0},
+			TransactionHash: "0x01",
+		},
+		{
+			Type:   client.TraceTypeReward,
+			Action: client.Action{Author: "0xcc", RewardType: "block", Value: "0x2"},
+		},
+	}
+	require.NoError(t, dto.ApplyTraces(traces, controller, nil))
+	require.NoError(t, dto.Commit(controller))
+
+	balances := map[string]string{}
+	docs, err := controller.MultiGet(schema.TableAccountBalance, []string{"0xaa", "0xbb", "0xcc"}, newAccountBalance)
+	require.NoError(t, err)
+	for _, doc := range docs {
+		balances[doc.GetID()] = doc.(*schema.AccountBalance).Balance
+	}
+	require.Equal(t, map[string]string{"0xaa": "900", "0xbb": "100", "0xcc": "2"}, balances)
+	for _, doc := range docs {
+		require.EqualValues(t, 12000, doc.(*schema.AccountBalance).BlockTimestamp)
+	}
+	require.EqualValues(t, 3, count(t, controller, schema.TableBalanceChangeHistory))
+
+	// outgoing transfers of 0xaa to 0xbb are signed debits
+	doc, err := controller.SelectOne(db.QueryParams{
+		IndexName: schema.TableBalanceChangeHistory,
+		Bool:      db.Filter(db.Match("account", "0xaa"), db.Match("direction", schema.DirectionDebit), db.Match("counterparty", "0xbb")),
+	}, schema.DocTypes[schema.TableBalanceChangeHistory])
+	require.NoError(t, err)
+	change := doc.(*schema.BalanceCHangeHistory)
+	require.Equal(t, "-100", change.BalanceChange)
+	require.Equal(t, -1e-16, change.BalanceChangeEth)
+	require.Equal(t, "0x01", change.Txid)
+	require.EqualValues(t, 12000, change.BlockTimestamp)
+
+	reward, err := controller.SelectOne(db.QueryParams{
+		IndexName: schema.TableBalanceChangeHistory,
+		Bool:      db.Filter(db.Match("account", "0xcc")),
+	}, schema.DocTypes[schema.TableBalanceChangeHistory])
+	require.NoError(t, err)
+	require.Equal(t, schema.DirectionCredit, reward.(*schema.BalanceCHangeHistory).Direction)
+	require.Equal(t, "block.3", reward.(*schema.BalanceCHangeHistory).TracePath)
+	require.Empty(t, reward.(*schema.BalanceCHangeHistory).Counterparty)
+}
+
+func TestDTOBlock(t *testing.T) {
+	controller := db.NewMemoryDbController()
+	dto := &DTO{}
+	dto.Init(0, 0)
+	dto.AddAccountBalance(0, 0, "0xaa", "1000")
+	dto.AddAccountBalance(0, 0, "0x00000000000000000000000000000000000000bb", "0")
+	require.NoError(t, dto.Commit(controller))
+
+	dto.Init(1, 12000)
+	traces := []client.TraceBlock{
+		{
+			Type:            client.TraceTypeCall,
+			Action:          client.Action{CallType: "call", From: "0xaa", To: "0x00000000000000000000000000000000000000bb", Value: "0x64"},
+			Result:          &client.Result{},
+			TraceAddress:    []int{},
+			TransactionHash: "0x01",
+		},
+		{
+			Type:   client.TraceTypeReward,
+			Action: client.Action{Author: "0xaa", RewardType: "block", Value: "0x2"},
+		},
+	}
+	require.NoError(t, dto.ApplyTraces(traces, controller, nil))
+	withdrawals := []*types.Withdrawal{{Index: 7, Address: common.HexToAddress("0xbb"), Amount: 1}}
+	require.NoError(t, dto.ApplyWithdrawals(withdrawals, controller, nil))
+	blobGas, excess := hexutil.Uint64(131072), hexutil.Uint64(0)
+	header := &client.Block{
+		Hash:          "0xAB",
+		BaseFeePerGas: (*hexutil.Big)(big.NewInt(7)),
+		GasUsed:       21000,
+		BlobGasUsed:   &blobGas,
+		ExcessBlobGas: &excess,
+		Transactions:  []*client.Transaction{{Hash: "0x01", Type: 3}},
+		Withdrawals:   withdrawals,
+	}
+	receipts := []*client.Receipt{{TransactionHash: "0x01", GasUsed: 21000, EffectiveGasPrice: (*hexutil.Big)(big.NewInt(7)), BlobGasUsed: &blobGas, BlobGasPrice: (*hexutil.Big)(big.NewInt(3))}}
+	require.NoError(t, dto.AddTransactions(header, receipts, nil))
+	dto.AddBlock(header)
+	require.NoError(t, dto.Commit(controller))
+
+	docs, err := controller.MultiGet(schema.TableBlocks, []string{schema.BlockID(1)}, schema.DocTypes[schema.TableBlocks])
+	require.NoError(t, err)
+	require.Len(t, docs, 1)
+	block := docs[0].(*schema.Block)
+	require.Equal(t, "0xab", block.Hash)
+	require.EqualValues(t, 12000, block.BlockTimestamp)
+	require.EqualValues(t, 1, block.TxCount)
+	require.EqualValues(t, 1, block.WithdrawalCount)
+	require.Equal(t, "7", block.BaseFeePerGas)
+	// rewards and withdrawals are issued, the base fee and the blob fee at the blob gas price of the receipt are burnt
+	require.Equal(t, "1000000002", block.Issuance)
+	require.Equal(t, "540216", block.Burn)
+	require.Equal(t, "100", block.TransferVolume)
+
+	balance, err := dto.GetAccountBalance("0x00000000000000000000000000000000000000bb", controller, nil)
+	require.NoError(t, err)
+	require.Equal(t, "1000000100", balance.Balance)
+}
+
+func TestDTOTransactions(t *testing.T) {
+	controller := db.NewMemoryDbController()
+	dto := &DTO{}
+	dto.Init(1, 12000)
+	success, blobGas, excess := hexutil.Uint64(schema.TxStatusSuccess), hexutil.Uint64(131072), hexutil.Uint64(0)
+	block := &client.Block{
+		BaseFeePerGas: (*hexutil.Big)(big.NewInt(7)),
+		ExcessBlobGas: &excess,
+		Transactions: []*client.Transaction{
+			{Hash: "0x01", From: "0xAA", To: "0xbb", Value: hexutil.Big(*big.NewInt(100)), Gas: 30000},
+			{Hash: "0x02", TransactionIndex: 1, Type: 3, From: "0xaa", Gas: 60000},
+		},
+	}
+	receipts := []*client.Receipt{
+		{TransactionHash: "0x01", GasUsed: 21000, EffectiveGasPrice: (*hexutil.Big)(big.NewInt(10))},
+		{TransactionHash: "0x02", TransactionIndex: 1, Status: &success, GasUsed: 50000, EffectiveGasPrice: (*hexutil.Big)(big.NewInt(8)), ContractAddress: "0xCC", BlobGasUsed: &blobGas, BlobGasPrice: (*hexutil.Big)(big.NewInt(1))},
+	}
+	traces := []client.TraceBlock{{TraceAddress: []int{}, TransactionHash: "0x01", Error: "Reverted"}}
+	require.NoError(t, dto.AddTransactions(block, receipts, traces))
+	require.NoError(t, dto.Commit(controller))
+	require.EqualValues(t, 2, count(t, controller, schema.TableTransactions))
+
+	docs, err := controller.MultiGet(schema.TableTransactions, []string{"0x01", "0x02"}, schema.DocTypes[schema.TableTransactions])
+	require.NoError(t, err)
+	require.Len(t, docs, 2)
+	transactions := map[string]*schema.Transaction{}
+	for _, doc := range docs {
+		transactions[doc.GetID()] = doc.(*schema.Transaction)
+	}
+
+	// the status of a receipt without one is taken from the top level trace
+	transfer := transactions["0x01"]
+	require.EqualValues(t, schema.TxStatusFailed, transfer.Status)
+	require.Equal(t, "0xaa", transfer.From)
+	require.Equal(t, "100", transfer.Value)
+	require.Equal(t, "147000", transfer.BaseFee)
+	require.Equal(t, "63000", transfer.PriorityFee)
+	require.Equal(t, "210000", transfer.Fee)
+
+	blob := transactions["0x02"]
+	require.EqualValues(t, schema.TxStatusSuccess, blob.Status)
+	require.Equal(t, "0xcc", blob.ContractAddress)
+	require.Equal(t, "1", blob.BlobGasPrice)
+	require.Equal(t, "131072", blob.BlobFee)
+	require.Equal(t, "50000", blob.PriorityFee)
+	require.Equal(t, "531072", blob.Fee)
+
+	// receipts have to match the transactions of the block and carry the price of the blob gas they used
+	require.Error(t, dto.AddTransactions(block, receipts[:1], nil))
+	receipts[1].BlobGasPrice = nil
+	require.Error(t, dto.AddTransactions(block, receipts, nil))
+}
+
+func TestDTOApplyFees(t *testing.T) {
+	controller := db.NewMemoryDbController()
+	dto := &DTO{}
+	dto.Init(0, 0)
+	dto.AddAccountBalance(0, 0, "0xaa", "1000000")
+	dto.AddAccountBalance(0, 0, "0xfe", "0")
+	require.NoError(t, dto.Commit(controller))
+
+	dto.Init(1, 12000)
+	block := &client.Block{
+		Miner:         "0xFE",
+		BaseFeePerGas: (*hexutil.Big)(big.NewInt(7)),
+		Transactions:  []*client.Transaction{{Hash: "0x01", From: "0xaa", To: "0xbb", Gas: 30000}},
+	}
+	receipts := []*client.Receipt{{TransactionHash: "0x01", GasUsed: 21000, EffectiveGasPrice: (*hexutil.Big)(big.NewInt(10))}}
+	require.NoError(t, dto.AddTransactions(block, receipts, nil))
+	require.NoError(t, dto.ApplyFees(block, controller, nil))
+
+	// the sender pays the whole fee, the fee recipient earns the priority fee and the base fee is burnt
+	sender, err := dto.GetAccountBalance("0xaa", controller, nil)
+	require.NoError(t, err)
+	require.Equal(t, "790000", sender.Balance)
+	recipient, err := dto.GetAccountBalance("0xfe", controller, nil)
+	require.NoError(t, err)
+	require.Equal(t, "63000", recipient.Balance)
+
+	require.NoError(t, dto.Commit(controller))
+	require.EqualValues(t, 2, count(t, controller, schema.TableBalanceChangeHistory))
+	fee, err := controller.SelectOne(db.QueryParams{
+		IndexName:   schema.TableBalanceChangeHistory,
+		StringMatch: &db.StringMatchQuery{Field: "account", Value: "0xaa"},
+		SortField:   "block_number",
+	}, schema.DocTypes[schema.TableBalanceChangeHistory])
+	require.NoError(t, err)
+	require.EqualValues(t, schema.FeeDeduction, fee.(*schema.BalanceCHangeHistory).ChangeType)
+	require.Equal(t, schema.DirectionDebit, fee.(*schema.BalanceCHangeHistory).Direction)
+	require.Equal(t, "-210000", fee.(*schema.BalanceCHangeHistory).BalanceChange)
+	require.Equal(t, "0xfe", fee.(*schema.BalanceCHangeHistory).Counterparty)
+}
+
+func TestDTOInternalTransactions(t *testing.T) {
+	controller := db.NewMemoryDbController()
+	dto := &DTO{}
+	dto.Init(1, 12000)
+	traces := []client.TraceBlock{
+		{ // top level transfer is a transaction
+			Type:            client.TraceTypeCall,
+			Action:          client.Action{CallType: "call", From: "0xaa", To: "0xbb", Value: "0x64"},
+			TraceAddress:    []int{},
+			TransactionHash: "0x01",
+		},
+		{
+			Type:            client.TraceTypeCall,
+			Action:          client.Action{CallType: "call", From: "0xbb", To: "0xCC", Value: "0x10"},
+			TraceAddress:    []int{0},
+			TransactionHash: "0x01",
+		},
+		{ // delegate calls move no value
+			Type:            client.TraceTypeCall,
+			Action:          client.Action{CallType: "delegatecall", From: "0xbb", To: "0xdd", Value: "0x10"},
+			TraceAddress:    []int{1},
+			TransactionHash: "0x01",
+		},
+		{
+			Type:            client.TraceTypeCall,
+			Action:          client.Action{CallType: "call", From: "0xbb", To: "0xdd", Value: "0x1"},
+			Error:           "out of gas",
+			TraceAddress:    []int{2},
+			TransactionHash: "0x01",
+		},
+		{
+			Type:                client.TraceTypeCreate,
+			Action:              client.Action{From: "0xdd", Value: "0x2"},
+			Result:              &client.Result{Address: "0xee"},
+			TraceAddress:        []int{2, 0},
+			TransactionHash:     "0x01",
+			TransactionPosition: 0,
+		},
+	}
+	dto.AddInternalTransactions(traces)
+	require.NoError(t, dto.Commit(controller))
+	require.EqualValues(t, 3, count(t, controller, schema.TableInternalTransactions))
+
+	// either party finds the transfer
+	for _, account := range []string{"0xbb", "0xcc"} {
+		doc, err := controller.SelectOne(db.QueryParams{
+			IndexName: schema.TableInternalTransactions,
+			Bool:      db.Filter(db.Any(db.Match("from", account), db.Match("to", account)).Query(), db.Match("reverted", "false")),
+		}, schema.DocTypes[schema.TableInternalTransactions])
+		require.NoError(t, err)
+		internal := doc.(*schema.InternalTransaction)
+		require.Equal(t, schema.InternalTransactionID(1, 0, "0"), internal.GetID())
+		require.Equal(t, "16", internal.Value)
+		require.EqualValues(t, 1, internal.Depth)
+	}
+
+	// the child of a failed call is reverted without an error of its own
+	docs, err := controller.MultiGet(schema.TableInternalTransactions, []string{schema.InternalTransactionID(1, 0, "2"), schema.InternalTransactionID(1, 0, "2.0")}, schema.DocTypes[schema.TableInternalTransactions])
+	require.NoError(t, err)
+	require.Len(t, docs, 2)
+	for _, doc := range docs {
+		internal := doc.(*schema.InternalTransaction)
+		require.True(t, internal.Reverted)
+		if internal.Type == client.TraceTypeCreate {
+			require.Empty(t, internal.Error)
+			require.Equal(t, "0xee", internal.To)
+			require.EqualValues(t, 2, internal.Depth)
+		} else {
+			require.Equal(t, "out of gas", internal.Error)
+		}
+	}
+}
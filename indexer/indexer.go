@@ -14,8 +14,16 @@ type RunConfig struct {
 	NetworkID     *big.Int
 	NetworkName   string
 	VerifyBalance bool
-	From          uint64
-	To            uint64
+	// VerifyTokenBalance compares the token balances of every block with the balanceOf of their tokens
+	VerifyTokenBalance bool
+	From               uint64
+	To                 uint64
+
+	// BalanceCacheSize is the number of account balances kept in memory across blocks
+	BalanceCacheSize int
+
+	// ReindexVersion rebuilds the indices into <ReindexVersion>_<table> while indexing, then swaps the aliases to them
+	ReindexVersion string
 }
 
 type Indexer struct {
@@ -24,11 +32,17 @@ type Indexer struct {
 
 	client *client.Client
 	db     db.DbController
+	// prefix of the indices of the network, see schema.IndexPrefix
+	prefix string
 
-	dto *DTO
+	dto     *DTO
+	reindex *reindexer
 }
 
-func NewIndexer(ctx context.Context, logger *zerolog.Logger, executionURL, beaconURL, esURL string) (*Indexer, error) {
+// NewIndexer creates an indexer writing to the indices of prefix in dbController, see db.NewDbController.
+// Indexers of several networks can share dbController with distinct prefixes.
+// The indices of a fresh database are created, partitioned indices must be configured on the controller before.
+func NewIndexer(ctx context.Context, logger *zerolog.Logger, executionURL, beaconURL string, dbController db.DbController, prefix string) (*Indexer, error) {
 	if logger == nil {
 		logger = &log.Logger
 	}
@@ -40,32 +54,48 @@ func NewIndexer(ctx context.Context, logger *zerolog.Logger, executionURL, beaco
 	}
 
 	// init db
-	d, err := db.NewElasticsearchDbController(ctx, logger, esURL)
-	if err != nil {
+	if err = EnsureSchema(logger, dbController, prefix); err != nil {
 		return nil, err
 	}
 
-	dto := &DTO{}
-	dto.Init(0)
-
 	return &Indexer{
 		logger: logger,
 		client: c,
-		db:     d,
-		dto:    dto,
+		db:     dbController,
+		prefix: prefix,
+		dto:    NewDTO(prefix),
 	}, nil
 }
 
 func (i *Indexer) Run(ctx context.Context, cfg *RunConfig) error {
 	var err error
 	i.cfg = cfg
+	i.dto.balanceCache = NewBalanceCache(cfg.BalanceCacheSize)
 
-	// start indexing
-	err = i.RunPreAlloc(ctx)
+	// roll back blocks left incomplete by a previous run
+	err = i.RunRollback(ctx)
 	if err != nil {
 		return err
 	}
 
+	// start indexing
+	if lastCommit := i.dto.lastCommit; lastCommit == nil {
+		err = i.RunPreAlloc(ctx)
+		if err != nil {
+			return err
+		}
+	} else if cfg.From <= lastCommit.BlockNumber {
+		i.logger.Info().Uint64("from", cfg.From).Uint64("lastCommit", lastCommit.BlockNumber).Msg("resume from last committed block")
+		cfg.From = lastCommit.BlockNumber + 1
+	}
+
+	if cfg.ReindexVersion != "" {
+		i.reindex, err = startReindex(ctx, i.logger, i.db, i.prefix, cfg.ReindexVersion, i.dto.lastCommit)
+		if err != nil {
+			return err
+		}
+	}
+
 	err = i.RunTraceBlock(ctx)
 	if err != nil {
 		return err
@@ -74,6 +104,11 @@ func (i *Indexer) Run(ctx context.Context, cfg *RunConfig) error {
 	return nil
 }
 
+// DB returns the database the indexer writes to
+func (i *Indexer) DB() db.DbController {
+	return i.db
+}
+
 func (i *Indexer) Stop() {
 	// stop indexing
 }
@@ -0,0 +1,86 @@
+package indexer
+
+import (
+	"context"
+
+	"github.com/ethereum/go-ethereum/common/lru"
+	"github.com/rabbitprincess/eth-indexer/indexer/client"
+	"github.com/rabbitprincess/eth-indexer/indexer/db"
+	"github.com/rabbitprincess/eth-indexer/indexer/schema"
+)
+
+const defaultTokenCacheSize = 100000
+
+// DetectTokens reads the metadata of the token contracts which the transfers of the current block show for the first
+// time. Contracts whose metadata is committed are looked up in db in one round trip and remembered across blocks.
+func (d *DTO) DetectTokens(ctx context.Context, dbController db.DbController, client *client.Client) error {
+	standards := make(map[string]string)
+	var contracts []string
+	see := func(contract string, standard string) {
+		if _, seen := standards[contract]; seen {
+			return
+		}
+		if _, exist := d.tokens[contract]; exist || d.knownTokens.Contains(contract) {
+			return
+		}
+		standards[contract] = standard
+		contracts = append(contracts, contract)
+	}
+	for _, change := range d.tokenChange {
+		see(change.Token, schema.StandardERC20)
+	}
+	for _, transfer := range d.nftTransfer {
+		see(transfer.Contract, transfer.Standard)
+	}
+	if len(contracts) == 0 {
+		return nil
+	}
+
+	ids := make([]string, len(contracts))
+	for i, contract := range contracts {
+		ids[i] = schema.TokenID(contract)
+	}
+	docs, err := dbController.MultiGet(d.prefix+schema.TableTokens, ids, schema.DocTypes[schema.TableTokens])
+	if err != nil {
+		return err
+	}
+	for _, doc := range docs {
+		token := doc.(*schema.Token)
+		if !d.IsCommitted(token.BlockNumber) {
+			continue // written by an incomplete block
+		}
+		d.knownTokens.Add(token.Contract, struct{}{})
+	}
+
+	for _, contract := range contracts {
+		if d.knownTokens.Contains(contract) {
+			continue
+		}
+		metadata, err := client.GetTokenMetadata(ctx, contract, d.blockNumber)
+		if err != nil {
+			return err
+		}
+		token := &schema.Token{
+			BaseEsType:     &schema.BaseEsType{Id: schema.TokenID(contract)},
+			Contract:       contract,
+			Standard:       standards[contract],
+			Name:           metadata.Name,
+			Symbol:         metadata.Symbol,
+			BlockNumber:    d.blockNumber,
+			BlockTimestamp: d.blockTimestamp,
+		}
+		if metadata.Decimals != nil {
+			token.Decimals, token.HasDecimals = uint64(*metadata.Decimals), true
+		}
+		if metadata.TotalSupply != nil {
+			token.TotalSupply = metadata.TotalSupply.String()
+		}
+		d.tokens[contract] = token
+	}
+	return nil
+}
+
+func newTokenCache() *lru.BasicLRU[string, struct{}] {
+	cache := lru.NewBasicLRU[string, struct{}](defaultTokenCacheSize)
+	return &cache
+}
@@ -0,0 +1,41 @@
+package indexer
+
+import (
+	"context"
+	"testing"
+
+	"github.com/rabbitprincess/eth-indexer/indexer/client"
+	"github.com/rabbitprincess/eth-indexer/indexer/db"
+	"github.com/rabbitprincess/eth-indexer/indexer/schema"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDTODetectTokens(t *testing.T) {
+	controller := db.NewMemoryDbController()
+	token, alice := "0x00000000000000000000000000000000000000aa", "0x00000000000000000000000000000000000000a1"
+	dto := NewDTO("")
+	dto.Init(0, 0)
+	dto.tokens[token] = &schema.Token{
+		BaseEsType: &schema.BaseEsType{Id: schema.TokenID(token)},
+		Contract:   token,
+		Standard:   schema.StandardERC20,
+		Symbol:     "TKN",
+	}
+	require.NoError(t, dto.ApplyTokenTransfers([]*client.Receipt{{Logs: []*client.Log{
+		transferLog(token, zeroAddress, alice, 1000, 0),
+	}}}, controller, nil))
+	require.NoError(t, dto.Commit(controller))
+	require.EqualValues(t, 1, count(t, controller, schema.TableTokens))
+
+	// a fresh dto finds the committed metadata in db instead of calling the token again
+	dto = NewDTO("")
+	_, err := dto.LoadLastCommit(controller)
+	require.NoError(t, err)
+	dto.Init(1, 12000)
+	require.NoError(t, dto.ApplyTokenTransfers([]*client.Receipt{{Logs: []*client.Log{
+		transferLog(token, alice, zeroAddress, 1, 0),
+	}}}, controller, nil))
+	require.NoError(t, dto.DetectTokens(context.Background(), controller, nil))
+	require.Empty(t, dto.tokens)
+	require.True(t, dto.knownTokens.Contains(token))
+}
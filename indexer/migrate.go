@@ -0,0 +1,157 @@
+package indexer
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/rabbitprincess/eth-indexer/indexer/db"
+	"github.com/rabbitprincess/eth-indexer/indexer/schema"
+	"github.com/rs/zerolog"
+)
+
+// loadSchemaVersion reads the schema version of the indices of prefix. Indices without version document hold
+// version 0 if blocks were committed before versions were recorded, and are fresh otherwise.
+func loadSchemaVersion(dbController db.DbController, prefix string) (version uint64, fresh bool, err error) {
+	docs, err := dbController.MultiGet(prefix+schema.TableSchemaVersion, []string{schema.SchemaInfoID}, schema.DocTypes[schema.TableSchemaVersion])
+	if err != nil {
+		return 0, false, err
+	}
+	if len(docs) > 0 {
+		return docs[0].(*schema.SchemaInfo).Version, false, nil
+	}
+	commits, err := dbController.Count(db.QueryParams{IndexName: prefix + schema.TableBlockCommit})
+	if err != nil {
+		return 0, false, err
+	}
+	return 0, commits == 0, nil
+}
+
+// storeSchemaVersion records the schema version the indices of prefix hold
+func storeSchemaVersion(dbController db.DbController, prefix string, version uint64) error {
+	bulk := dbController.UpsertBulk(prefix + schema.TableSchemaVersion)
+	bulk.Add(&schema.SchemaInfo{
+		BaseEsType:  &schema.BaseEsType{Id: schema.SchemaInfoID},
+		Version:     version,
+		UpdatedTime: uint64(time.Now().UnixMilli()),
+	})
+	return bulk.Commit()
+}
+
+// EnsureSchema creates the fresh indices of prefix and records the schema version of this build.
+// It fails on indices of another schema version, older ones are upgraded by Migrate.
+func EnsureSchema(logger *zerolog.Logger, dbController db.DbController, prefix string) error {
+	if err := dbController.CreateIndex(prefix+schema.TableSchemaVersion, schema.TableSchemaVersion); err != nil {
+		return err
+	}
+	version, fresh, err := loadSchemaVersion(dbController, prefix)
+	if err != nil {
+		return err
+	}
+	switch {
+	case fresh:
+		for _, table := range schema.Tables {
+			if err = dbController.CreateIndex(prefix+table, table); err != nil {
+				return err
+			}
+		}
+		logger.Info().Str("prefix", prefix).Uint64("version", schema.SchemaVersion).Msg("created indices")
+		return storeSchemaVersion(dbController, prefix, schema.SchemaVersion)
+	case version < schema.SchemaVersion:
+		return fmt.Errorf("database holds schema version %d, run the migration to version %d", version, schema.SchemaVersion)
+	case version > schema.SchemaVersion:
+		return fmt.Errorf("database holds schema version %d, newer than version %d of this build", version, schema.SchemaVersion)
+	}
+	return nil
+}
+
+// Migrate upgrades the indices of prefix to the schema version of this build, recording the version after every migration
+// so that an interrupted run resumes where it stopped. Migrations are applied in place, scripts updating documents
+// only run on elasticsearch, or by reindexing into indices of the new mappings.
+func Migrate(ctx context.Context, logger *zerolog.Logger, dbController db.DbController, prefix string) error {
+	if err := dbController.CreateIndex(prefix+schema.TableSchemaVersion, schema.TableSchemaVersion); err != nil {
+		return err
+	}
+	version, fresh, err := loadSchemaVersion(dbController, prefix)
+	if err != nil {
+		return err
+	}
+	if fresh {
+		return EnsureSchema(logger, dbController, prefix)
+	}
+	if version > schema.SchemaVersion {
+		return fmt.Errorf("database holds schema version %d, newer than version %d of this build", version, schema.SchemaVersion)
+	}
+
+	for _, migration := range schema.Migrations {
+		if migration.Version <= version {
+			continue
+		}
+		logger.Info().Uint64("version", migration.Version).Str("description", migration.Description).Msg("migrating")
+		if migration.Reindex {
+			err = migrateReindex(ctx, logger, dbController, prefix, migration)
+		} else {
+			err = migrateInPlace(logger, dbController, prefix, migration)
+		}
+		if err != nil {
+			return fmt.Errorf("migration to version %d: %w", migration.Version, err)
+		}
+		if err = storeSchemaVersion(dbController, prefix, migration.Version); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateInPlace creates the new indices, adds the new fields to the mappings of the existing indices and runs
+// the scripts on the documents which lack them. It can be rerun until it updates nothing.
+func migrateInPlace(logger *zerolog.Logger, dbController db.DbController, prefix string, migration schema.Migration) error {
+	for _, table := range schema.Tables {
+		if err := dbController.CreateIndex(prefix+table, table); err != nil {
+			return err
+		}
+	}
+	esdb, ok := dbController.(*db.EsDBController)
+	if !ok {
+		if len(migration.Scripts) > 0 {
+			return fmt.Errorf("%s is only migrated in place on elasticsearch, index this database again", migration.Description)
+		}
+		return nil
+	}
+	for _, table := range schema.Tables {
+		if err := esdb.PutMapping(prefix+table, table); err != nil {
+			return err
+		}
+		script, ok := migration.Scripts[table]
+		if !ok {
+			continue
+		}
+		updated, err := esdb.UpdateByQuery(db.QueryParams{
+			IndexName: prefix + table,
+			Bool:      &db.BoolQuery{MustNot: []db.Query{db.Exists(script.Field)}},
+		}, script.Script)
+		if err != nil {
+			return err
+		}
+		logger.Info().Str("index", prefix+table).Uint64("updated", updated).Msg("migrated documents")
+	}
+	return nil
+}
+
+// migrateReindex copies the documents into indices named after the migration version and swaps the aliases to them
+func migrateReindex(ctx context.Context, logger *zerolog.Logger, dbController db.DbController, prefix string, migration schema.Migration) error {
+	lastCommit, err := NewDTO(prefix).LoadLastCommit(dbController)
+	if err != nil {
+		return err
+	}
+	r, err := startReindex(ctx, logger, dbController, prefix, fmt.Sprintf("v%d", migration.Version), lastCommit)
+	if err != nil {
+		return err
+	}
+	var lastCommitted uint64
+	if lastCommit != nil {
+		lastCommitted = lastCommit.BlockNumber
+	}
+	_, err = r.poll(ctx, lastCommitted, true)
+	return err
+}
@@ -0,0 +1,71 @@
+package indexer
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/rabbitprincess/eth-indexer/indexer/db"
+	"github.com/rabbitprincess/eth-indexer/indexer/schema"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnsureSchema(t *testing.T) {
+	logger := zerolog.Nop()
+	controller := db.NewMemoryDbController()
+
+	// a fresh database gets the version of this build
+	require.NoError(t, EnsureSchema(&logger, controller, ""))
+	version, fresh, err := loadSchemaVersion(controller, "")
+	require.NoError(t, err)
+	require.False(t, fresh)
+	require.EqualValues(t, schema.SchemaVersion, version)
+	require.NoError(t, EnsureSchema(&logger, controller, ""))
+
+	// older and newer versions are refused
+	require.NoError(t, storeSchemaVersion(controller, "", schema.SchemaVersion-1))
+	require.ErrorContains(t, EnsureSchema(&logger, controller, ""), "run the migration")
+	require.NoError(t, storeSchemaVersion(controller, "", schema.SchemaVersion+1))
+	require.ErrorContains(t, EnsureSchema(&logger, controller, ""), "newer than version")
+
+	// blocks committed before versions were recorded are version 0
+	legacy := db.NewMemoryDbController()
+	dto := &DTO{}
+	dto.Init(0, 0)
+	dto.AddAccountBalance(0, 0, "0xaa", "100")
+	require.NoError(t, dto.Commit(legacy))
+	require.ErrorContains(t, EnsureSchema(&logger, legacy, ""), "schema version 0")
+	// scripted migrations only run on elasticsearch
+	require.ErrorContains(t, Migrate(context.Background(), &logger, legacy, ""), "only migrated in place on elasticsearch")
+}
+
+func TestMigrateReindex(t *testing.T) {
+	ctx := context.Background()
+	logger := zerolog.Nop()
+	controller := db.NewMemoryDbController()
+	require.NoError(t, EnsureSchema(&logger, controller, ""))
+	dto := &DTO{}
+	dto.Init(0, 0)
+	dto.AddAccountBalance(0, 0, "0xaa", "100")
+	require.NoError(t, dto.Commit(controller))
+
+	// a migration without scripts copies the documents into indices of the new version
+	migrations := schema.Migrations
+	defer func() { schema.Migrations = migrations }()
+	schema.Migrations = append(migrations[:len(migrations):len(migrations)], schema.Migration{
+		Version:     schema.SchemaVersion + 1,
+		Description: "incompatible mapping",
+		Reindex:     true,
+	})
+	require.NoError(t, Migrate(ctx, &logger, controller, ""))
+
+	version, _, err := loadSchemaVersion(controller, "")
+	require.NoError(t, err)
+	require.EqualValues(t, schema.SchemaVersion+1, version)
+	exists, prefix, err := controller.GetExistingIndexPrefix(schema.TableAccountBalance, schema.TableAccountBalance)
+	require.NoError(t, err)
+	require.True(t, exists)
+	require.Equal(t, fmt.Sprintf("v%d_", schema.SchemaVersion+1), prefix)
+	require.EqualValues(t, 1, count(t, controller, schema.TableAccountBalance))
+}
@@ -0,0 +1,325 @@
+package indexer
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math"
+	"math/big"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/rabbitprincess/eth-indexer/indexer/client"
+	"github.com/rabbitprincess/eth-indexer/indexer/db"
+	"github.com/rabbitprincess/eth-indexer/indexer/schema"
+)
+
+var (
+	transferSingleTopic = crypto.Keccak256Hash([]byte("TransferSingle(address,address,address,uint256,uint256)")).Hex()
+	transferBatchTopic  = crypto.Keccak256Hash([]byte("TransferBatch(address,address,address,uint256[],uint256[])")).Hex()
+
+	// the ids and values of a TransferBatch are not indexed
+	uint256Array, _   = abi.NewType("uint256[]", "", nil)
+	transferBatchData = abi.Arguments{{Type: uint256Array}, {Type: uint256Array}}
+)
+
+// nftTransfer describes a token id moved by a single log, a TransferBatch yields one per token id
+type nftTransfer struct {
+	contract   string
+	tokenID    *big.Int
+	standard   string
+	from       string // the zero address for mints
+	to         string // the zero address for burns
+	operator   string
+	amount     *big.Int
+	txid       string
+	txIndex    uint64
+	logIndex   uint64
+	batchIndex uint64
+}
+
+// ApplyNftTransfers applies the ERC-721 and ERC-1155 transfer events of the current block's receipts to the owners
+// and holdings of token ids. Amounts of ERC-1155 holdings are loaded from db in one round trip before they change.
+func (d *DTO) ApplyNftTransfers(receipts []*client.Receipt, dbController db.DbController, client *client.Client) error {
+	var transfers []*nftTransfer
+	var ids []string
+	for _, receipt := range receipts {
+		for _, event := range receipt.Logs {
+			for _, transfer := range parseNftTransfers(event) {
+				transfers = append(transfers, transfer)
+				if transfer.standard != schema.StandardERC1155 {
+					continue
+				}
+				for _, holder := range []string{transfer.from, transfer.to} {
+					if holder != zeroAddress {
+						ids = append(ids, schema.NftHoldingID(transfer.contract, transfer.tokenID.String(), holder))
+					}
+				}
+			}
+		}
+	}
+	if len(transfers) == 0 {
+		return nil
+	}
+	committed, err := d.loadNftHoldings(ids, dbController)
+	if err != nil {
+		return err
+	}
+
+	for _, transfer := range transfers {
+		tokenID := transfer.tokenID.String()
+		d.nftTransfer = append(d.nftTransfer, &schema.NftTransfer{
+			BaseEsType:     &schema.BaseEsType{Id: schema.NftTransferID(d.blockNumber, transfer.logIndex, transfer.batchIndex)},
+			Contract:       transfer.contract,
+			TokenID:        tokenID,
+			Standard:       transfer.standard,
+			From:           transfer.from,
+			To:             transfer.to,
+			Operator:       transfer.operator,
+			Amount:         transfer.amount.String(),
+			BlockNumber:    d.blockNumber,
+			BlockTimestamp: d.blockTimestamp,
+			Txid:           transfer.txid,
+			TxIndex:        transfer.txIndex,
+			LogIndex:       transfer.logIndex,
+			BatchIndex:     transfer.batchIndex,
+		})
+
+		if transfer.standard == schema.StandardERC721 {
+			d.nftOwner[schema.NftOwnerID(transfer.contract, tokenID)] = &schema.NftOwner{
+				BaseEsType:     &schema.BaseEsType{Id: schema.NftOwnerID(transfer.contract, tokenID)},
+				Contract:       transfer.contract,
+				TokenID:        tokenID,
+				Owner:          transfer.to,
+				BlockNumber:    d.blockNumber,
+				BlockTimestamp: d.blockTimestamp,
+			}
+			d.setNftHolding(transfer, transfer.from, new(big.Int))
+			d.setNftHolding(transfer, transfer.to, big.NewInt(1))
+			continue
+		}
+
+		if transfer.amount.Sign() == 0 || transfer.from == transfer.to {
+			continue
+		}
+		for _, side := range []struct {
+			holder string
+			delta  *big.Int
+		}{{transfer.from, new(big.Int).Neg(transfer.amount)}, {transfer.to, transfer.amount}} {
+			if side.holder == zeroAddress {
+				continue
+			}
+			amount, err := d.nftAmount(transfer, side.holder, committed, client)
+			if err != nil {
+				return err
+			}
+			d.setNftHolding(transfer, side.holder, amount.Add(amount, side.delta))
+		}
+	}
+	return nil
+}
+
+// loadNftHoldings returns the committed holdings of ids which the current block did not touch yet
+func (d *DTO) loadNftHoldings(ids []string, dbController db.DbController) (map[string]*schema.NftHolding, error) {
+	missing := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if _, exist := d.nftHolding[id]; !exist {
+			missing = append(missing, id)
+		}
+	}
+	committed := make(map[string]*schema.NftHolding, len(missing))
+	if len(missing) == 0 {
+		return committed, nil
+	}
+	docs, err := dbController.MultiGet(d.prefix+schema.TableNftHolding, missing, schema.DocTypes[schema.TableNftHolding])
+	if err != nil {
+		return nil, err
+	}
+	for _, doc := range docs {
+		holding := doc.(*schema.NftHolding)
+		if !d.IsCommitted(holding.BlockNumber) {
+			continue // written by an incomplete block
+		}
+		committed[holding.GetID()] = holding
+	}
+	return committed, nil
+}
+
+// nftAmount returns the amount of an ERC-1155 token id held by holder before the transfer.
+// A holding neither touched nor committed is read from the contract at the block before the current one, see contractBalance.
+func (d *DTO) nftAmount(transfer *nftTransfer, holder string, committed map[string]*schema.NftHolding, client *client.Client) (*big.Int, error) {
+	id := schema.NftHoldingID(transfer.contract, transfer.tokenID.String(), holder)
+	holding, exist := d.nftHolding[id]
+	if !exist {
+		holding, exist = committed[id]
+	}
+	if exist {
+		amount, _ := new(big.Int).SetString(holding.Amount, 10)
+		if amount == nil {
+			amount = new(big.Int)
+		}
+		return amount, nil
+	}
+	if d.blockNumber == 0 {
+		return new(big.Int), nil
+	}
+	return contractBalance(context.Background(), client, transfer.contract, d.blockNumber-1, func(ctx context.Context) (*big.Int, error) {
+		return client.GetNftBalance(ctx, transfer.contract, holder, transfer.tokenID, d.blockNumber-1)
+	})
+}
+
+// setNftHolding sets the amount of the token id of transfer held by holder, the zero address holds nothing
+func (d *DTO) setNftHolding(transfer *nftTransfer, holder string, amount *big.Int) {
+	if holder == zeroAddress {
+		return
+	}
+	tokenID := transfer.tokenID.String()
+	id := schema.NftHoldingID(transfer.contract, tokenID, holder)
+	d.nftHolding[id] = &schema.NftHolding{
+		BaseEsType:     &schema.BaseEsType{Id: id},
+		Contract:       transfer.contract,
+		TokenID:        tokenID,
+		Standard:       transfer.standard,
+		Holder:         holder,
+		Amount:         amount.String(),
+		BlockNumber:    d.blockNumber,
+		BlockTimestamp: d.blockTimestamp,
+	}
+}
+
+// parseNftTransfers returns the token ids moved by an ERC-721 Transfer, ERC-1155 TransferSingle or TransferBatch log
+func parseNftTransfers(event *client.Log) []*nftTransfer {
+	if event.Removed || len(event.Topics) != 4 {
+		return nil
+	}
+	transfer := nftTransfer{
+		contract: strings.ToLower(event.Address),
+		txid:     event.TransactionHash,
+		txIndex:  uint64(event.TransactionIndex),
+		logIndex: uint64(event.LogIndex),
+	}
+	topic := strings.ToLower(event.Topics[0])
+	switch {
+	case topic == transferTopic && len(event.Data) == 0:
+		// erc-20 transfers carry the value in data instead of a third indexed topic
+		transfer.standard = schema.StandardERC721
+		transfer.from, transfer.to = topicAddress(event.Topics[1]), topicAddress(event.Topics[2])
+		transfer.tokenID, transfer.amount = parseHexBig(event.Topics[3]), big.NewInt(1)
+		return []*nftTransfer{&transfer}
+	case topic == transferSingleTopic && len(event.Data) == 64:
+		transfer.standard = schema.StandardERC1155
+		transfer.operator, transfer.from, transfer.to = topicAddress(event.Topics[1]), topicAddress(event.Topics[2]), topicAddress(event.Topics[3])
+		transfer.tokenID, transfer.amount = new(big.Int).SetBytes(event.Data[:32]), new(big.Int).SetBytes(event.Data[32:])
+		return []*nftTransfer{&transfer}
+	case topic == transferBatchTopic:
+		values, err := transferBatchData.Unpack(event.Data)
+		if err != nil {
+			return nil
+		}
+		ids, amounts := values[0].([]*big.Int), values[1].([]*big.Int)
+		if len(ids) != len(amounts) {
+			return nil
+		}
+		transfer.standard = schema.StandardERC1155
+		transfer.operator, transfer.from, transfer.to = topicAddress(event.Topics[1]), topicAddress(event.Topics[2]), topicAddress(event.Topics[3])
+		transfers := make([]*nftTransfer, len(ids))
+		for i := range ids {
+			batch := transfer
+			batch.tokenID, batch.amount, batch.batchIndex = ids[i], amounts[i], uint64(i)
+			transfers[i] = &batch
+		}
+		return transfers
+	}
+	return nil
+}
+
+// collectNftRestore reads the owners and holdings written by incomplete blocks from their contracts at the last
+// committed block. Owners of token ids which did not exist yet, or of contracts which were not deployed yet, are not restored.
+func (i *Indexer) collectNftRestore(ctx context.Context, from uint64, lastCommit *schema.BlockCommit, committedTime func() (uint64, error)) ([]*schema.NftOwner, []*schema.NftHolding, error) {
+	var owners []*schema.NftOwner
+	var holdings []*schema.NftHolding
+	if lastCommit == nil {
+		return nil, nil, nil
+	}
+	ownerOf := func(contract string, tokenID string) (string, error) {
+		id, _ := new(big.Int).SetString(tokenID, 10)
+		hasCode, err := i.client.HasCode(ctx, contract, lastCommit.BlockNumber)
+		if err != nil || !hasCode {
+			return "", err
+		}
+		owner, err := i.client.GetNftOwner(ctx, contract, id, lastCommit.BlockNumber)
+		if client.IsExecutionError(err) || errors.Is(err, client.ErrNoOutput) {
+			return "", nil
+		}
+		return owner, err
+	}
+
+	scroll := i.db.Scroll(db.QueryParams{
+		IndexName: i.prefix + schema.TableNftOwner,
+		Size:      1000,
+		SortField: "block_number",
+		SortAsc:   true,
+		Bool:      db.Filter(db.Range("block_number", from, math.MaxInt64)),
+	}, schema.DocTypes[schema.TableNftOwner])
+	for {
+		doc, err := scroll.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, err
+		}
+		owner := doc.(*schema.NftOwner)
+		if owner.Owner, err = ownerOf(owner.Contract, owner.TokenID); err != nil {
+			return nil, nil, err
+		} else if owner.Owner == "" {
+			continue // minted by an incomplete block
+		}
+		owner.BlockNumber = lastCommit.BlockNumber
+		if owner.BlockTimestamp, err = committedTime(); err != nil {
+			return nil, nil, err
+		}
+		owners = append(owners, owner)
+	}
+
+	scroll = i.db.Scroll(db.QueryParams{
+		IndexName: i.prefix + schema.TableNftHolding,
+		Size:      1000,
+		SortField: "block_number",
+		SortAsc:   true,
+		Bool:      db.Filter(db.Range("block_number", from, math.MaxInt64)),
+	}, schema.DocTypes[schema.TableNftHolding])
+	for {
+		doc, err := scroll.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, err
+		}
+		holding := doc.(*schema.NftHolding)
+		amount := new(big.Int)
+		if holding.Standard == schema.StandardERC721 {
+			owner, err := ownerOf(holding.Contract, holding.TokenID)
+			if err != nil {
+				return nil, nil, err
+			}
+			if owner == holding.Holder {
+				amount.SetUint64(1)
+			}
+		} else {
+			id, _ := new(big.Int).SetString(holding.TokenID, 10)
+			amount, err = contractBalance(ctx, i.client, holding.Contract, lastCommit.BlockNumber, func(ctx context.Context) (*big.Int, error) {
+				return i.client.GetNftBalance(ctx, holding.Contract, holding.Holder, id, lastCommit.BlockNumber)
+			})
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		holding.Amount, holding.BlockNumber = amount.String(), lastCommit.BlockNumber
+		if holding.BlockTimestamp, err = committedTime(); err != nil {
+			return nil, nil, err
+		}
+		holdings = append(holdings, holding)
+	}
+	return owners, holdings, nil
+}
@@ -0,0 +1,75 @@
+package indexer
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/rabbitprincess/eth-indexer/indexer/client"
+	"github.com/rabbitprincess/eth-indexer/indexer/db"
+	"github.com/rabbitprincess/eth-indexer/indexer/schema"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDTOApplyNftTransfers(t *testing.T) {
+	controller := db.NewMemoryDbController()
+	erc721, erc1155 := "0x0000000000000000000000000000000000000721", "0x0000000000000000000000000000000000001155"
+	alice, bob, operator := "0x00000000000000000000000000000000000000a1", "0x00000000000000000000000000000000000000b0", "0x00000000000000000000000000000000000000c0"
+	topic := func(address string) string { return common.HexToHash(address).Hex() }
+	word := func(n int64) []byte { return common.BigToHash(big.NewInt(n)).Bytes() }
+
+	batch, err := transferBatchData.Pack([]*big.Int{big.NewInt(1), big.NewInt(2)}, []*big.Int{big.NewInt(10), big.NewInt(20)})
+	require.NoError(t, err)
+	dto := &DTO{}
+	dto.Init(0, 0)
+	require.NoError(t, dto.ApplyNftTransfers([]*client.Receipt{{Logs: []*client.Log{
+		{Address: erc721, Topics: []string{transferTopic, topic(zeroAddress), topic(alice), common.BigToHash(big.NewInt(7)).Hex()}, LogIndex: 0},
+		{Address: erc1155, Topics: []string{transferBatchTopic, topic(operator), topic(zeroAddress), topic(alice)}, Data: batch, LogIndex: 1},
+		{Address: erc1155, Topics: []string{transferSingleTopic, topic(operator), topic(zeroAddress), topic(bob)}, Data: append(word(2), word(1)...), LogIndex: 2},
+	}}}, controller, nil))
+	require.NoError(t, dto.Commit(controller))
+
+	dto.Init(1, 12000)
+	require.NoError(t, dto.ApplyNftTransfers([]*client.Receipt{{Logs: []*client.Log{
+		{Address: erc721, Topics: []string{transferTopic, topic(alice), topic(bob), common.BigToHash(big.NewInt(7)).Hex()}, LogIndex: 0, TransactionHash: "0x01"},
+		{Address: erc1155, Topics: []string{transferSingleTopic, topic(operator), topic(alice), topic(bob)}, Data: append(word(2), word(5)...), LogIndex: 1, TransactionHash: "0x01"},
+		// erc-20 transfers have three topics
+		{Address: erc721, Topics: []string{transferTopic, topic(alice), topic(bob)}, Data: word(1), LogIndex: 2},
+	}}}, controller, nil))
+	require.NoError(t, dto.Commit(controller))
+
+	owners, err := controller.MultiGet(schema.TableNftOwner, []string{schema.NftOwnerID(erc721, "7")}, schema.DocTypes[schema.TableNftOwner])
+	require.NoError(t, err)
+	require.Len(t, owners, 1)
+	require.Equal(t, bob, owners[0].(*schema.NftOwner).Owner)
+	require.EqualValues(t, 12000, owners[0].(*schema.NftOwner).BlockTimestamp)
+
+	holdings := map[string]string{}
+	ids := []string{
+		schema.NftHoldingID(erc721, "7", alice), schema.NftHoldingID(erc721, "7", bob),
+		schema.NftHoldingID(erc1155, "1", alice), schema.NftHoldingID(erc1155, "2", alice), schema.NftHoldingID(erc1155, "2", bob),
+	}
+	found, err := controller.MultiGet(schema.TableNftHolding, ids, schema.DocTypes[schema.TableNftHolding])
+	require.NoError(t, err)
+	for _, doc := range found {
+		holdings[doc.GetID()] = doc.(*schema.NftHolding).Amount
+	}
+	require.Equal(t, map[string]string{ids[0]: "0", ids[1]: "1", ids[2]: "10", ids[3]: "15", ids[4]: "6"}, holdings)
+
+	// history records are linked to the transaction and log, a batch to the position of the token id
+	require.EqualValues(t, 6, count(t, controller, schema.TableNftTransfer))
+	transfer, err := controller.SelectOne(db.QueryParams{
+		IndexName: schema.TableNftTransfer,
+		Bool:      db.Filter(db.Match("standard", schema.StandardERC1155), db.Match("to", bob)),
+	}, schema.DocTypes[schema.TableNftTransfer])
+	require.NoError(t, err)
+	require.Equal(t, schema.NftTransferID(1, 1, 0), transfer.GetID())
+	require.Equal(t, "0x01", transfer.(*schema.NftTransfer).Txid)
+	require.Equal(t, operator, transfer.(*schema.NftTransfer).Operator)
+	require.Equal(t, "5", transfer.(*schema.NftTransfer).Amount)
+	batched, err := controller.MultiGet(schema.TableNftTransfer, []string{schema.NftTransferID(0, 1, 1)}, schema.DocTypes[schema.TableNftTransfer])
+	require.NoError(t, err)
+	require.Len(t, batched, 1)
+	require.Equal(t, "2", batched[0].(*schema.NftTransfer).TokenID)
+	require.Equal(t, "20", batched[0].(*schema.NftTransfer).Amount)
+}
@@ -0,0 +1,147 @@
+package indexer
+
+import (
+	"context"
+	"io"
+
+	"github.com/rabbitprincess/eth-indexer/indexer/db"
+	"github.com/rabbitprincess/eth-indexer/indexer/schema"
+	"github.com/rs/zerolog"
+)
+
+const reindexBatchSize = 5000
+
+// reindexer rebuilds the indices blue/green. Documents are copied in the background into versioned indices
+// created from schema.EsSchema, while the indexer keeps writing to the aliases and the aliases keep serving reads.
+// Once the copy is done the blocks committed meanwhile are copied between two blocks, then the aliases are swapped
+// to the new indices and the old indices retired.
+type reindexer struct {
+	logger  *zerolog.Logger
+	db      db.DbController
+	prefix  string
+	indices map[string]string // table to the new versioned index behind its alias
+
+	// watermark is the last block copied by the background copy
+	watermark uint64
+	done      chan error
+}
+
+// startReindex creates the indices <version>_<prefix><table> and starts copying the blocks up to lastCommit
+// from the aliases <prefix><table> into them
+func startReindex(ctx context.Context, logger *zerolog.Logger, dbController db.DbController, prefix, version string, lastCommit *schema.BlockCommit) (*reindexer, error) {
+	r := &reindexer{
+		logger:  logger,
+		db:      dbController,
+		prefix:  prefix,
+		indices: make(map[string]string, len(schema.Tables)),
+		done:    make(chan error, 1),
+	}
+	esdb, _ := dbController.(*db.EsDBController)
+	for _, table := range schema.Tables {
+		index := version + "_" + prefix + table
+		var err error
+		if partitioning := partitioningOf(esdb, prefix+table); partitioning != nil {
+			// a partitioned alias is copied into partitions of the same partitioning, which it takes over on the swap
+			err = esdb.SetPartitioning(index, table, *partitioning)
+		} else {
+			err = dbController.CreateIndex(index, table)
+		}
+		if err != nil {
+			return nil, err
+		}
+		r.indices[table] = index
+	}
+	if lastCommit != nil {
+		r.watermark = lastCommit.BlockNumber
+	}
+
+	logger.Info().Str("version", version).Uint64("watermark", r.watermark).Msg("reindex started")
+	go func() {
+		r.done <- r.copy(ctx, 0, r.watermark)
+	}()
+	return r, nil
+}
+
+// partitioningOf returns the partitioning of the alias on elasticsearch, nil if it is not partitioned
+func partitioningOf(esdb *db.EsDBController, aliasName string) *db.Partitioning {
+	if esdb == nil {
+		return nil
+	}
+	return esdb.GetPartitioning(aliasName)
+}
+
+// copy upserts the documents of the blocks from..to of every alias into its new index
+func (r *reindexer) copy(ctx context.Context, from, to uint64) error {
+	for _, table := range schema.Tables {
+		scroll := r.db.Scroll(db.QueryParams{
+			IndexName: r.prefix + table,
+			Size:      reindexBatchSize,
+			SortField: "block_number",
+			SortAsc:   true,
+			Bool:      db.Filter(db.Range("block_number", from, to)),
+		}, schema.DocTypes[table])
+
+		var copied uint64
+		bulk := r.db.UpsertBulk(r.indices[table])
+		pending := 0
+		for {
+			doc, err := scroll.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return err
+			}
+			bulk.Add(doc)
+			pending++
+			if pending == reindexBatchSize {
+				if err = bulk.Commit(); err != nil {
+					return err
+				}
+				if err = ctx.Err(); err != nil {
+					return err
+				}
+				copied += uint64(pending)
+				pending = 0
+			}
+		}
+		if err := bulk.Commit(); err != nil {
+			return err
+		}
+		copied += uint64(pending)
+		r.logger.Info().Str("index", r.indices[table]).Uint64("from", from).Uint64("to", to).Uint64("copied", copied).Msg("reindex copied")
+	}
+	return nil
+}
+
+// poll finishes the reindex once the background copy is done, wait blocks until it is.
+// It must run between two blocks so that no write is missed, lastCommitted is the last block written to the aliases.
+// It reports whether the reindex has ended.
+func (r *reindexer) poll(ctx context.Context, lastCommitted uint64, wait bool) (bool, error) {
+	var err error
+	if wait {
+		err = <-r.done
+	} else {
+		select {
+		case err = <-r.done:
+		default:
+			return false, nil
+		}
+	}
+	if err != nil {
+		return true, err
+	}
+
+	// catch up with the blocks committed during the copy, then swap the commit markers last
+	if lastCommitted > r.watermark {
+		if err = r.copy(ctx, r.watermark+1, lastCommitted); err != nil {
+			return true, err
+		}
+	}
+	for _, table := range schema.Tables {
+		if err = r.db.UpdateAlias(r.prefix+table, r.indices[table]); err != nil {
+			return true, err
+		}
+	}
+	r.logger.Info().Uint64("lastCommitted", lastCommitted).Msg("reindex finished, aliases swapped")
+	return true, nil
+}
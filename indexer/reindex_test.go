@@ -0,0 +1,56 @@
+package indexer
+
+import (
+	"context"
+	"testing"
+
+	"github.com/rabbitprincess/eth-indexer/indexer/db"
+	"github.com/rabbitprincess/eth-indexer/indexer/schema"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReindex(t *testing.T) {
+	ctx := context.Background()
+	logger := zerolog.Nop()
+	controller := db.NewMemoryDbController()
+	dto := &DTO{}
+	commit := func(blockNumber uint64, balance string) {
+		dto.Init(blockNumber, 0)
+		dto.AddAccountBalance(blockNumber, 0, "0xaa", balance)
+		dto.AddBalanceChange(blockNumber, 0, "0xaa", "", schema.Transfer, "0", balance, balance, "", 0, "")
+		require.NoError(t, dto.Commit(controller))
+	}
+	commit(0, "100")
+	commit(1, "200")
+
+	// blocks committed while the copy runs are caught up before the swap
+	r, err := startReindex(ctx, &logger, controller, "", "v1", dto.lastCommit)
+	require.NoError(t, err)
+	commit(2, "300")
+	done, err := r.poll(ctx, dto.lastCommit.BlockNumber, true)
+	require.NoError(t, err)
+	require.True(t, done)
+
+	for _, table := range schema.Tables {
+		exists, prefix, err := controller.GetExistingIndexPrefix(table, table)
+		require.NoError(t, err)
+		require.True(t, exists)
+		require.Equal(t, "v1_", prefix)
+	}
+	require.EqualValues(t, 3, count(t, controller, schema.TableBalanceChangeHistory))
+	require.EqualValues(t, 3, count(t, controller, schema.TableBlockCommit))
+	docs, err := controller.MultiGet(schema.TableAccountBalance, []string{"0xaa"}, newAccountBalance)
+	require.NoError(t, err)
+	require.Len(t, docs, 1)
+	require.Equal(t, "300", docs[0].(*schema.AccountBalance).Balance)
+
+	// a second reindex retires the first versioned indices
+	commit(3, "400")
+	r, err = startReindex(ctx, &logger, controller, "", "v2", dto.lastCommit)
+	require.NoError(t, err)
+	_, err = r.poll(ctx, dto.lastCommit.BlockNumber, true)
+	require.NoError(t, err)
+	require.EqualValues(t, 4, count(t, controller, schema.TableBlockCommit))
+	require.EqualValues(t, 0, count(t, controller, "v1_"+schema.TableBlockCommit))
+}
@@ -4,13 +4,172 @@ import (
 	"context"
 	"embed"
 	"encoding/json"
+	"io"
 	"math"
+	"math/big"
+	"strings"
 	"time"
 
 	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/rabbitprincess/eth-indexer/indexer/db"
 	"github.com/rabbitprincess/eth-indexer/indexer/schema"
 )
 
+// RunRollback removes the documents of blocks written without a commit marker
+// and restores the balances of the accounts they touched to the last committed block
+func (i *Indexer) RunRollback(ctx context.Context) error {
+	lastCommit, err := i.dto.LoadLastCommit(i.db)
+	if err != nil {
+		return err
+	}
+	var from uint64
+	if lastCommit != nil {
+		from = lastCommit.BlockNumber + 1
+	}
+
+	// collect balances written by incomplete blocks
+	var restore []*schema.AccountBalance
+	var committedTimestamp uint64
+	committedTime := func() (uint64, error) {
+		if committedTimestamp == 0 {
+			header, err := i.client.GetBlockHeader(ctx, lastCommit.BlockNumber)
+			if err != nil {
+				return 0, err
+			}
+			committedTimestamp = schema.TimestampMillis(header.Time)
+		}
+		return committedTimestamp, nil
+	}
+	scroll := i.db.Scroll(db.QueryParams{
+		IndexName: i.prefix + schema.TableAccountBalance,
+		Size:      1000,
+		SortField: "block_number",
+		SortAsc:   true,
+		Bool:      db.Filter(db.Range("block_number", from, math.MaxInt64)),
+	}, newAccountBalance)
+	for {
+		doc, err := scroll.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		balance := doc.(*schema.AccountBalance)
+		if lastCommit == nil {
+			continue // no committed balance to restore
+		}
+		committed, err := i.client.GetAccountBalance(ctx, balance.Account, lastCommit.BlockNumber)
+		if err != nil {
+			return err
+		}
+		balance.BlockNumber = lastCommit.BlockNumber
+		balance.BlockTimestamp, err = committedTime()
+		if err != nil {
+			return err
+		}
+		balance.SetBalance(committed.String())
+		restore = append(restore, balance)
+	}
+
+	// token balances likewise, the balanceOf of their token at the last committed block
+	var restoreToken []*schema.TokenBalance
+	scroll = i.db.Scroll(db.QueryParams{
+		IndexName: i.prefix + schema.TableTokenBalance,
+		Size:      1000,
+		SortField: "block_number",
+		SortAsc:   true,
+		Bool:      db.Filter(db.Range("block_number", from, math.MaxInt64)),
+	}, schema.DocTypes[schema.TableTokenBalance])
+	for {
+		doc, err := scroll.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		balance := doc.(*schema.TokenBalance)
+		if lastCommit == nil {
+			continue
+		}
+		committed, err := contractBalance(ctx, i.client, balance.Token, lastCommit.BlockNumber, func(ctx context.Context) (*big.Int, error) {
+			return i.client.GetTokenBalance(ctx, balance.Token, balance.Holder, lastCommit.BlockNumber)
+		})
+		if err != nil {
+			return err
+		}
+		balance.BlockNumber = lastCommit.BlockNumber
+		balance.BlockTimestamp, err = committedTime()
+		if err != nil {
+			return err
+		}
+		balance.Balance = committed.String()
+		restoreToken = append(restoreToken, balance)
+	}
+
+	restoreOwner, restoreHolding, err := i.collectNftRestore(ctx, from, lastCommit, committedTime)
+	if err != nil {
+		return err
+	}
+
+	// write restored balances before deleting incomplete blocks, so that a rollback interrupted in between
+	// finds the remaining documents of incomplete blocks again and no balance is lost.
+	// Plain upserts, the restored documents are of an earlier block than the ones they replace.
+	bulk := i.db.UpsertBulk(i.prefix + schema.TableAccountBalance)
+	for _, balance := range restore {
+		bulk.Add(balance)
+	}
+	err = bulk.Commit()
+	if err != nil {
+		return err
+	}
+	bulk = i.db.UpsertBulk(i.prefix + schema.TableTokenBalance)
+	for _, balance := range restoreToken {
+		bulk.Add(balance)
+	}
+	err = bulk.Commit()
+	if err != nil {
+		return err
+	}
+	bulk = i.db.UpsertBulk(i.prefix + schema.TableNftOwner)
+	for _, owner := range restoreOwner {
+		bulk.Add(owner)
+	}
+	err = bulk.Commit()
+	if err != nil {
+		return err
+	}
+	bulk = i.db.UpsertBulk(i.prefix + schema.TableNftHolding)
+	for _, holding := range restoreHolding {
+		bulk.Add(holding)
+	}
+	err = bulk.Commit()
+	if err != nil {
+		return err
+	}
+
+	// delete incomplete blocks, the restored documents are of the last committed block and kept
+	var deleted uint64
+	for _, table := range schema.Tables {
+		count, err := i.db.Delete(db.QueryParams{
+			IndexName: i.prefix + table,
+			Bool:      db.Filter(db.Range("block_number", from, math.MaxInt64)),
+		})
+		if err != nil {
+			return err
+		}
+		deleted += count
+	}
+
+	// cached balances and tokens may belong to rolled back blocks
+	i.dto.balanceCache.Purge()
+	i.dto.knownTokens.Purge()
+
+	if deleted > 0 {
+		i.logger.Warn().Uint64("from", from).Uint64("deleted", deleted).Int("restored", len(restore)+len(restoreToken)+len(restoreOwner)+len(restoreHolding)).Msg("rolled back incomplete blocks")
+	}
+	return nil
+}
+
 func (i *Indexer) RunPreAlloc(ctx context.Context) error {
 	var filename string = "allocs/" + i.cfg.NetworkName + ".json"
 	ga, err := readPrealloc(filename)
@@ -19,14 +178,23 @@ func (i *Indexer) RunPreAlloc(ctx context.Context) error {
 		return nil
 	}
 
+	// the prealloc is dated by the genesis block of the network
+	genesis, err := i.client.GetBlock(ctx, 0)
+	if err != nil {
+		return err
+	}
+	timestamp := schema.TimestampMillis(uint64(genesis.Timestamp))
+	i.dto.Init(0, timestamp)
+
 	for address, account := range ga {
 		// save to db
-		addr := address.String()
+		addr := strings.ToLower(address.Hex())
 		bal := account.Balance.String()
 
-		i.dto.AddAccountBalance(0, 0, addr, bal)
-		i.dto.AddBalanceChange(0, 0, address.String(), schema.PreAlloc, "0", bal, bal, "", 0)
+		i.dto.AddAccountBalance(0, timestamp, addr, bal)
+		i.dto.AddBalanceChange(0, timestamp, addr, "", schema.PreAlloc, "0", bal, bal, "", 0, "")
 	}
+	i.dto.AddBlock(genesis)
 
 	if i.cfg.VerifyBalance {
 		err = i.dto.VerifyBalance(ctx, 0, i.client)
@@ -61,6 +229,8 @@ func readPrealloc(filename string) (types.GenesisAlloc, error) {
 	return ga, nil
 }
 
+const cacheStatsInterval = 1000
+
 func (i *Indexer) RunTraceBlock(ctx context.Context) error {
 	if i.cfg.To == 0 {
 		i.cfg.To = math.MaxInt
@@ -85,14 +255,53 @@ func (i *Indexer) RunTraceBlock(ctx context.Context) error {
 		}
 
 		// init dto
-		i.dto.Init(blockNumber)
+		block, err := i.client.GetBlock(ctx, blockNumber)
+		if err != nil {
+			return err
+		}
+		i.dto.Init(blockNumber, schema.TimestampMillis(uint64(block.Timestamp)))
 
 		// trace balance
-		trace, err := i.client.TraceBlock(ctx, blockNumber)
+		traces, err := i.client.TraceBlock(ctx, blockNumber)
+		if err != nil {
+			return err
+		}
+		err = i.dto.ApplyTraces(traces, i.db, i.client)
+		if err != nil {
+			return err
+		}
+		i.dto.AddInternalTransactions(traces)
+		err = i.dto.ApplyWithdrawals(block.Withdrawals, i.db, i.client)
 		if err != nil {
 			return err
 		}
-		_ = trace
+
+		// transactions and their receipts
+		receipts, err := i.client.GetBlockReceipts(ctx, blockNumber)
+		if err != nil {
+			return err
+		}
+		err = i.dto.AddTransactions(block, receipts, traces)
+		if err != nil {
+			return err
+		}
+		err = i.dto.ApplyFees(block, i.db, i.client)
+		if err != nil {
+			return err
+		}
+		err = i.dto.ApplyTokenTransfers(receipts, i.db, i.client)
+		if err != nil {
+			return err
+		}
+		err = i.dto.ApplyNftTransfers(receipts, i.db, i.client)
+		if err != nil {
+			return err
+		}
+		err = i.dto.DetectTokens(ctx, i.db, i.client)
+		if err != nil {
+			return err
+		}
+		i.dto.AddBlock(block)
 
 		// verify balance
 		if i.cfg.VerifyBalance {
@@ -101,14 +310,50 @@ func (i *Indexer) RunTraceBlock(ctx context.Context) error {
 				return err
 			}
 		}
+		if i.cfg.VerifyTokenBalance {
+			err := i.dto.VerifyTokenBalance(ctx, blockNumber, i.client)
+			if err != nil {
+				return err
+			}
+		}
 
 		err = i.dto.Commit(i.db)
 		if err != nil {
 			return err
 		}
 
+		err = i.pollReindex(ctx, false)
+		if err != nil {
+			return err
+		}
+
+		if blockNumber%cacheStatsInterval == 0 {
+			hits, misses, hitRate := i.dto.balanceCache.Stats()
+			i.logger.Info().Uint64("blockNumber", blockNumber).Int("size", i.dto.balanceCache.Len()).Uint64("hits", hits).Uint64("misses", misses).Float64("hitRate", hitRate).Msg("balance cache stats")
+		}
+
 		blockNumber++
 	}
 
+	// a reindex started on a bounded run finishes before returning
+	return i.pollReindex(ctx, true)
+}
+
+// pollReindex finishes a running reindex between two blocks once its copy is done, wait blocks until it is.
+// A failed reindex is abandoned, the aliases keep the current indices.
+func (i *Indexer) pollReindex(ctx context.Context, wait bool) error {
+	if i.reindex == nil || i.dto.lastCommit == nil {
+		return nil
+	}
+	done, err := i.reindex.poll(ctx, i.dto.lastCommit.BlockNumber, wait)
+	if done {
+		i.reindex = nil
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		i.logger.Error().Err(err).Msg("reindex failed, the aliases keep the current indices")
+	}
 	return nil
 }
@@ -1,5 +1,12 @@
 package schema
 
+import (
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
 // DocType is an interface for structs to be used as database documents
 type DocType interface {
 	GetID() string
@@ -22,33 +29,388 @@ func (m *BaseEsType) SetID(id string) {
 }
 
 type AccountBalance struct {
+	*BaseEsType
+	Account        string  `json:"account" db:"account"`
+	BlockNumber    uint64  `json:"block_number" db:"block_number"`
+	BlockTimestamp uint64  `json:"block_timestamp" db:"block_timestamp"`
+	Balance        string  `json:"balance" db:"balance"`
+	BalanceEth     float64 `json:"balance_eth" db:"balance_eth"`
+}
+
+// SetBalance sets the exact balance in wei and its numeric value in ether
+func (b *AccountBalance) SetBalance(wei string) {
+	b.Balance = wei
+	b.BalanceEth = WeiToEther(wei)
+}
+
+type BalanceCHangeHistory struct {
 	*BaseEsType
 	Account        string `json:"account" db:"account"`
 	BlockNumber    uint64 `json:"block_number" db:"block_number"`
 	BlockTimestamp uint64 `json:"block_timestamp" db:"block_timestamp"`
+	ChangeType     uint64 `json:"change_type" db:"change_type"`
+	BalanceBefore  string `json:"balance_before" db:"balance_before"`
+	BalanceAfter   string `json:"balance_after" db:"balance_after"`
+	BalanceChange  string `json:"balance_change" db:"balance_change"` // signed delta, negative for debits
+	Direction      string `json:"direction" db:"direction"`
+	Counterparty   string `json:"counterparty" db:"counterparty"` // empty for issued value like rewards
+	Txid           string `json:"txid" db:"txid"`
+	TxIndex        uint64 `json:"txindex" db:"txindex"`
+	TracePath      string `json:"trace_path" db:"trace_path"`
+
+	BalanceBeforeEth float64 `json:"balance_before_eth" db:"balance_before_eth"`
+	BalanceAfterEth  float64 `json:"balance_after_eth" db:"balance_after_eth"`
+	BalanceChangeEth float64 `json:"balance_change_eth" db:"balance_change_eth"`
+}
+
+// GetBlockNumber returns the block of the change
+func (h *BalanceCHangeHistory) GetBlockNumber() uint64 {
+	return h.BlockNumber
+}
+
+// GetBlockTimestamp returns the timestamp of the block of the change in milliseconds
+func (h *BalanceCHangeHistory) GetBlockTimestamp() uint64 {
+	return h.BlockTimestamp
+}
+
+// SetBalances sets the exact balances and signed delta in wei, their numeric values in ether and the direction of the delta
+func (h *BalanceCHangeHistory) SetBalances(before, after, delta string) {
+	h.BalanceBefore, h.BalanceBeforeEth = before, WeiToEther(before)
+	h.BalanceAfter, h.BalanceAfterEth = after, WeiToEther(after)
+	h.BalanceChange, h.BalanceChangeEth = delta, WeiToEther(delta)
+	h.Direction = DirectionCredit
+	if strings.HasPrefix(delta, "-") {
+		h.Direction = DirectionDebit
+	}
+}
+
+// WeiToEther converts a decimal wei amount to ether.
+// The result is rounded to float64 for range queries, sorting and aggregations, the wei string stays the exact value.
+func WeiToEther(wei string) float64 {
+	value, ok := new(big.Float).SetString(wei)
+	if !ok {
+		return 0
+	}
+	ether, _ := value.Quo(value, big.NewFloat(1e18)).Float64()
+	return ether
+}
+
+// BlockCommit marks a block whose documents have all been written.
+// It is written last, so a block without a marker is incomplete and must be rolled back.
+type BlockCommit struct {
+	*BaseEsType
+	BlockNumber   uint64 `json:"block_number" db:"block_number"`
+	AccountCount  uint64 `json:"account_count" db:"account_count"`
+	ChangeCount   uint64 `json:"change_count" db:"change_count"`
+	CommittedTime uint64 `json:"committed_time" db:"committed_time"`
+}
+
+// Block records the header of an indexed block and the value it moved, it is written in the commit of the block
+type Block struct {
+	*BaseEsType
+	BlockNumber     uint64 `json:"block_number" db:"block_number"`
+	BlockTimestamp  uint64 `json:"block_timestamp" db:"block_timestamp"`
+	Hash            string `json:"hash" db:"hash"`
+	ParentHash      string `json:"parent_hash" db:"parent_hash"`
+	Miner           string `json:"miner" db:"miner"`                       // fee recipient
+	BaseFeePerGas   string `json:"base_fee_per_gas" db:"base_fee_per_gas"` // wei, empty before london
+	GasUsed         uint64 `json:"gas_used" db:"gas_used"`
+	GasLimit        uint64 `json:"gas_limit" db:"gas_limit"`
+	BlobGasUsed     uint64 `json:"blob_gas_used" db:"blob_gas_used"`
+	ExcessBlobGas   uint64 `json:"excess_blob_gas" db:"excess_blob_gas"`
+	TxCount         uint64 `json:"tx_count" db:"tx_count"`
+	WithdrawalCount uint64 `json:"withdrawal_count" db:"withdrawal_count"`
+
+	// totals in wei of the value issued to accounts by rewards, withdrawals and the prealloc,
+	// of the fees burnt, and of the value transferred between accounts
+	Issuance       string `json:"issuance" db:"issuance"`
+	Burn           string `json:"burn" db:"burn"`
+	TransferVolume string `json:"transfer_volume" db:"transfer_volume"`
+
+	IssuanceEth       float64 `json:"issuance_eth" db:"issuance_eth"`
+	BurnEth           float64 `json:"burn_eth" db:"burn_eth"`
+	TransferVolumeEth float64 `json:"transfer_volume_eth" db:"transfer_volume_eth"`
+}
+
+// SetTotals sets the exact totals in wei and their numeric values in ether
+func (b *Block) SetTotals(issuance, burn, transferVolume string) {
+	b.Issuance, b.IssuanceEth = issuance, WeiToEther(issuance)
+	b.Burn, b.BurnEth = burn, WeiToEther(burn)
+	b.TransferVolume, b.TransferVolumeEth = transferVolume, WeiToEther(transferVolume)
+}
+
+// Transaction records a transaction of an indexed block with the fee it paid and the outcome of its receipt
+type Transaction struct {
+	*BaseEsType
+	BlockNumber     uint64  `json:"block_number" db:"block_number"`
+	BlockTimestamp  uint64  `json:"block_timestamp" db:"block_timestamp"`
+	Hash            string  `json:"hash" db:"hash"`
+	TxIndex         uint64  `json:"tx_index" db:"tx_index"`
+	Type            uint64  `json:"type" db:"type"`
+	From            string  `json:"from" db:"from_address"`
+	To              string  `json:"to" db:"to_address"` // empty for contract creations
+	Value           string  `json:"value" db:"value"`
+	ValueEth        float64 `json:"value_eth" db:"value_eth"`
+	Nonce           uint64  `json:"nonce" db:"nonce"`
+	GasLimit        uint64  `json:"gas_limit" db:"gas_limit"`
+	GasUsed         uint64  `json:"gas_used" db:"gas_used"`
+	Status          uint64  `json:"status" db:"status"`
+	ContractAddress string  `json:"contract_address" db:"contract_address"` // created contract
+
+	// prices in wei per gas, the fee components in wei: the burnt base fee, the priority fee of the fee
+	// recipient and the burnt blob fee
+	EffectiveGasPrice string  `json:"effective_gas_price" db:"effective_gas_price"`
+	BlobGasUsed       uint64  `json:"blob_gas_used" db:"blob_gas_used"`
+	BlobGasPrice      string  `json:"blob_gas_price" db:"blob_gas_price"`
+	BaseFee           string  `json:"base_fee" db:"base_fee"`
+	PriorityFee       string  `json:"priority_fee" db:"priority_fee"`
+	BlobFee           string  `json:"blob_fee" db:"blob_fee"`
+	Fee               string  `json:"fee" db:"fee"`
+	FeeEth            float64 `json:"fee_eth" db:"fee_eth"`
+}
+
+// SetValue sets the exact value in wei and its numeric value in ether
+func (t *Transaction) SetValue(value string) {
+	t.Value, t.ValueEth = value, WeiToEther(value)
+}
+
+// SetFees sets the fee components in wei, the total fee and its numeric value in ether
+func (t *Transaction) SetFees(baseFee, priorityFee, blobFee *big.Int) {
+	t.BaseFee, t.PriorityFee, t.BlobFee = baseFee.String(), priorityFee.String(), blobFee.String()
+	fee := new(big.Int).Add(baseFee, priorityFee)
+	fee.Add(fee, blobFee)
+	t.Fee = fee.String()
+	t.FeeEth = WeiToEther(t.Fee)
+}
+
+// InternalTransaction records a value transfer of a sub call of a transaction, it is found by either party
+type InternalTransaction struct {
+	*BaseEsType
+	BlockNumber    uint64  `json:"block_number" db:"block_number"`
+	BlockTimestamp uint64  `json:"block_timestamp" db:"block_timestamp"`
+	Txid           string  `json:"txid" db:"txid"`
+	TxIndex        uint64  `json:"tx_index" db:"tx_index"`
+	TraceAddress   string  `json:"trace_address" db:"trace_address"` // dot separated position in the call tree
+	Depth          uint64  `json:"depth" db:"depth"`
+	Type           string  `json:"type" db:"type"`           // call, create or suicide
+	CallType       string  `json:"call_type" db:"call_type"` // call or callcode, empty for create and suicide
+	From           string  `json:"from" db:"from_address"`
+	To             string  `json:"to" db:"to_address"`
+	Value          string  `json:"value" db:"value"`
+	ValueEth       float64 `json:"value_eth" db:"value_eth"`
+	Error          string  `json:"error" db:"error"`
+	Reverted       bool    `json:"reverted" db:"reverted"` // the call or one of its parents failed, no value was moved
+}
+
+// SetValue sets the exact value in wei and its numeric value in ether
+func (t *InternalTransaction) SetValue(value string) {
+	t.Value, t.ValueEth = value, WeiToEther(value)
+}
+
+// TokenBalance is the current balance of a holder of an ERC-20 token in the smallest unit of the token
+type TokenBalance struct {
+	*BaseEsType
+	Token          string `json:"token" db:"token"`
+	Holder         string `json:"holder" db:"holder"`
+	BlockNumber    uint64 `json:"block_number" db:"block_number"`
+	BlockTimestamp uint64 `json:"block_timestamp" db:"block_timestamp"`
 	Balance        string `json:"balance" db:"balance"`
 }
 
-type BalanceCHangeHistory struct {
+// TokenBalanceChangeHistory records a change of a token balance by a Transfer event
+type TokenBalanceChangeHistory struct {
 	*BaseEsType
+	Token          string `json:"token" db:"token"`
 	Account        string `json:"account" db:"account"`
 	BlockNumber    uint64 `json:"block_number" db:"block_number"`
 	BlockTimestamp uint64 `json:"block_timestamp" db:"block_timestamp"`
-	ChangeType     uint64 `json:"change_type" db:"change_type"`
 	BalanceBefore  string `json:"balance_before" db:"balance_before"`
 	BalanceAfter   string `json:"balance_after" db:"balance_after"`
-	BalanceChange  string `json:"change_balance" db:"balance_change"`
+	BalanceChange  string `json:"balance_change" db:"balance_change"` // signed delta, negative for debits
+	Direction      string `json:"direction" db:"direction"`
+	Counterparty   string `json:"counterparty" db:"counterparty"` // the zero address for mints and burns
+	Txid           string `json:"txid" db:"txid"`
+	TxIndex        uint64 `json:"txindex" db:"txindex"`
+	LogIndex       uint64 `json:"log_index" db:"log_index"`
+}
+
+// SetBalances sets the exact balances and signed delta and the direction of the delta
+func (h *TokenBalanceChangeHistory) SetBalances(before, after, delta string) {
+	h.BalanceBefore, h.BalanceAfter, h.BalanceChange = before, after, delta
+	h.Direction = DirectionCredit
+	if strings.HasPrefix(delta, "-") {
+		h.Direction = DirectionDebit
+	}
+}
+
+// NftOwner is the current owner of an ERC-721 token id, the zero address once it was burnt
+type NftOwner struct {
+	*BaseEsType
+	Contract       string `json:"contract" db:"contract"`
+	TokenID        string `json:"token_id" db:"token_id"` // decimal
+	Owner          string `json:"owner" db:"owner"`
+	BlockNumber    uint64 `json:"block_number" db:"block_number"`
+	BlockTimestamp uint64 `json:"block_timestamp" db:"block_timestamp"`
+}
+
+// NftHolding is the amount of a token id an account holds, 1 or 0 for ERC-721.
+// Holdings which were transferred away stay with an amount of 0.
+type NftHolding struct {
+	*BaseEsType
+	Contract       string `json:"contract" db:"contract"`
+	TokenID        string `json:"token_id" db:"token_id"`
+	Standard       string `json:"standard" db:"standard"`
+	Holder         string `json:"holder" db:"holder"`
+	Amount         string `json:"amount" db:"amount"`
+	BlockNumber    uint64 `json:"block_number" db:"block_number"`
+	BlockTimestamp uint64 `json:"block_timestamp" db:"block_timestamp"`
+}
+
+// NftTransfer records the transfer of a token id by an ERC-721 Transfer or an ERC-1155 TransferSingle or TransferBatch event
+type NftTransfer struct {
+	*BaseEsType
+	Contract       string `json:"contract" db:"contract"`
+	TokenID        string `json:"token_id" db:"token_id"`
+	Standard       string `json:"standard" db:"standard"`
+	From           string `json:"from" db:"from_address"` // the zero address for mints
+	To             string `json:"to" db:"to_address"`     // the zero address for burns
+	Operator       string `json:"operator" db:"operator"` // empty for ERC-721
+	Amount         string `json:"amount" db:"amount"`
+	BlockNumber    uint64 `json:"block_number" db:"block_number"`
+	BlockTimestamp uint64 `json:"block_timestamp" db:"block_timestamp"`
 	Txid           string `json:"txid" db:"txid"`
 	TxIndex        uint64 `json:"txindex" db:"txindex"`
+	LogIndex       uint64 `json:"log_index" db:"log_index"`
+	BatchIndex     uint64 `json:"batch_index" db:"batch_index"` // position of the token id in a TransferBatch
+}
+
+// Token is the metadata of a token contract read when the indexer first saw one of its transfers.
+// Name, symbol and decimals are empty for contracts which do not implement them.
+type Token struct {
+	*BaseEsType
+	Contract       string `json:"contract" db:"contract"`
+	Standard       string `json:"standard" db:"standard"`
+	Name           string `json:"name" db:"name"`
+	Symbol         string `json:"symbol" db:"symbol"`
+	Decimals       uint64 `json:"decimals" db:"decimals"`
+	HasDecimals    bool   `json:"has_decimals" db:"has_decimals"`
+	TotalSupply    string `json:"total_supply" db:"total_supply"`
+	BlockNumber    uint64 `json:"block_number" db:"block_number"` // block the metadata was read at
+	BlockTimestamp uint64 `json:"block_timestamp" db:"block_timestamp"`
+}
+
+// AccountBalanceID returns the document id of an account's current balance.
+// There is exactly one balance document per account, so re-indexing a block overwrites it.
+func AccountBalanceID(account string) string {
+	return strings.ToLower(account)
+}
+
+// BalanceChangeID returns the document id of a balance change.
+// It is derived from the position of the change in the chain, so re-indexing a block yields the same ids.
+func BalanceChangeID(blockNumber uint64, txIndex uint64, tracePath string, changeType BalanceChange, account string) string {
+	return fmt.Sprintf("%d_%d_%s_%d_%s", blockNumber, txIndex, tracePath, changeType, strings.ToLower(account))
+}
+
+// BlockID returns the document id of a block
+func BlockID(blockNumber uint64) string {
+	return strconv.FormatUint(blockNumber, 10)
+}
+
+// TransactionID returns the document id of a transaction
+func TransactionID(hash string) string {
+	return strings.ToLower(hash)
+}
+
+// InternalTransactionID returns the document id of an internal transaction, derived from its position in the chain
+func InternalTransactionID(blockNumber uint64, txIndex uint64, traceAddress string) string {
+	return fmt.Sprintf("%d_%d_%s", blockNumber, txIndex, traceAddress)
+}
+
+// TokenBalanceID returns the document id of the current balance of a token holder
+func TokenBalanceID(token string, holder string) string {
+	return strings.ToLower(token) + "_" + strings.ToLower(holder)
+}
+
+// TokenBalanceChangeID returns the document id of a token balance change, derived from the position of its log
+func TokenBalanceChangeID(blockNumber uint64, logIndex uint64, account string) string {
+	return fmt.Sprintf("%d_%d_%s", blockNumber, logIndex, strings.ToLower(account))
+}
+
+// NftOwnerID returns the document id of the owner of a token id
+func NftOwnerID(contract string, tokenID string) string {
+	return strings.ToLower(contract) + "_" + tokenID
+}
+
+// NftHoldingID returns the document id of the holding of a token id by holder
+func NftHoldingID(contract string, tokenID string, holder string) string {
+	return strings.ToLower(contract) + "_" + tokenID + "_" + strings.ToLower(holder)
+}
+
+// NftTransferID returns the document id of a transfer, derived from the position of its log
+func NftTransferID(blockNumber uint64, logIndex uint64, batchIndex uint64) string {
+	return fmt.Sprintf("%d_%d_%d", blockNumber, logIndex, batchIndex)
+}
+
+// TokenID returns the document id of the metadata of a token contract
+func TokenID(contract string) string {
+	return strings.ToLower(contract)
+}
+
+// BlockCommitID returns the document id of a block's commit marker
+func BlockCommitID(blockNumber uint64) string {
+	return strconv.FormatUint(blockNumber, 10)
 }
 
 var (
 	EsSchema                  map[string]string
+	DocTypes                  map[string]func() DocType
 	TableAccountBalance       = "account_balance"
 	TableBalanceChangeHistory = "balance_change_history"
+	TableBlocks               = "blocks"
+	TableTransactions         = "transactions"
+	TableInternalTransactions = "internal_transactions"
+	TableTokenBalance         = "token_balance"
+	TableTokenBalanceHistory  = "token_balance_change_history"
+	TableNftOwner             = "nft_owner"
+	TableNftHolding           = "nft_holding"
+	TableNftTransfer          = "nft_transfer_history"
+	TableTokens               = "tokens"
+	TableBlockCommit          = "block_commit"
+	TableSchemaVersion        = "schema_version"
+
+	// Tables are written for every block, the commit marker last
+	Tables = []string{TableAccountBalance, TableBalanceChangeHistory, TableBlocks, TableTransactions, TableInternalTransactions, TableTokenBalance, TableTokenBalanceHistory,
+		TableNftOwner, TableNftHolding, TableNftTransfer, TableTokens, TableBlockCommit}
 )
 
+// TimestampMillis converts the time of a block header in seconds to the milliseconds since epoch of block_timestamp fields
+func TimestampMillis(seconds uint64) uint64 {
+	return seconds * 1000
+}
+
+// IndexPrefix returns the prefix of the indices of a network, so that several networks share a database.
+// Indices are named <prefix><table>.
+func IndexPrefix(network string) string {
+	return strings.ToLower(network) + "_"
+}
+
 func init() {
+	DocTypes = map[string]func() DocType{
+		TableAccountBalance:       func() DocType { return &AccountBalance{BaseEsType: new(BaseEsType)} },
+		TableBalanceChangeHistory: func() DocType { return &BalanceCHangeHistory{BaseEsType: new(BaseEsType)} },
+		TableBlocks:               func() DocType { return &Block{BaseEsType: new(BaseEsType)} },
+		TableTransactions:         func() DocType { return &Transaction{BaseEsType: new(BaseEsType)} },
+		TableInternalTransactions: func() DocType { return &InternalTransaction{BaseEsType: new(BaseEsType)} },
+		TableTokenBalance:         func() DocType { return &TokenBalance{BaseEsType: new(BaseEsType)} },
+		TableTokenBalanceHistory:  func() DocType { return &TokenBalanceChangeHistory{BaseEsType: new(BaseEsType)} },
+		TableNftOwner:             func() DocType { return &NftOwner{BaseEsType: new(BaseEsType)} },
+		TableNftHolding:           func() DocType { return &NftHolding{BaseEsType: new(BaseEsType)} },
+		TableNftTransfer:          func() DocType { return &NftTransfer{BaseEsType: new(BaseEsType)} },
+		TableTokens:               func() DocType { return &Token{BaseEsType: new(BaseEsType)} },
+		TableBlockCommit:          func() DocType { return &BlockCommit{BaseEsType: new(BaseEsType)} },
+		TableSchemaVersion:        func() DocType { return &SchemaInfo{BaseEsType: new(BaseEsType)} },
+	}
+
 	EsSchema = map[string]string{}
 
 	EsSchema[TableAccountBalance] = `{
@@ -69,10 +431,15 @@ func init() {
 				"type": "long"
 			},
 			"block_timestamp": {
-				"type": "date"
+				"type": "date",
+				"format": "epoch_millis"
 			},
 			"balance": {
 				"type": "keyword"
+			},
+			"balance_eth": {
+				"type": "scaled_float",
+				"scaling_factor": 1000000000
 			}
 		}
 	}
@@ -96,7 +463,8 @@ func init() {
 				"type": "long"
 			},
 			"block_timestamp": {
-				"type": "date"
+				"type": "date",
+				"format": "epoch_millis"
 			},
 			"change_type": {
 				"type": "long"
@@ -115,9 +483,506 @@ func init() {
 			},
 			"txindex": {
 				"type": "long"
+			},
+			"direction": {
+				"type": "keyword"
+			},
+			"counterparty": {
+				"type": "keyword"
+			},
+			"trace_path": {
+				"type": "keyword"
+			},
+			"balance_before_eth": {
+				"type": "scaled_float",
+				"scaling_factor": 1000000000
+			},
+			"balance_after_eth": {
+				"type": "scaled_float",
+				"scaling_factor": 1000000000
+			},
+			"balance_change_eth": {
+				"type": "scaled_float",
+				"scaling_factor": 1000000000
 			}
 		}
 	}
 }`
 
+	EsSchema[TableBlocks] = `{
+	"settings": {
+		"number_of_shards": 3,
+		"number_of_replicas": 1
+	},
+	"mappings": {
+		"properties": {
+			"block_number": {
+				"type": "long"
+			},
+			"block_timestamp": {
+				"type": "date",
+				"format": "epoch_millis"
+			},
+			"hash": {
+				"type": "keyword"
+			},
+			"parent_hash": {
+				"type": "keyword"
+			},
+			"miner": {
+				"type": "keyword"
+			},
+			"base_fee_per_gas": {
+				"type": "keyword"
+			},
+			"gas_used": {
+				"type": "long"
+			},
+			"gas_limit": {
+				"type": "long"
+			},
+			"blob_gas_used": {
+				"type": "long"
+			},
+			"excess_blob_gas": {
+				"type": "long"
+			},
+			"tx_count": {
+				"type": "long"
+			},
+			"withdrawal_count": {
+				"type": "long"
+			},
+			"issuance": {
+				"type": "keyword"
+			},
+			"burn": {
+				"type": "keyword"
+			},
+			"transfer_volume": {
+				"type": "keyword"
+			},
+			"issuance_eth": {
+				"type": "scaled_float",
+				"scaling_factor": 1000000000
+			},
+			"burn_eth": {
+				"type": "scaled_float",
+				"scaling_factor": 1000000000
+			},
+			"transfer_volume_eth": {
+				"type": "scaled_float",
+				"scaling_factor": 1000000000
+			}
+		}
+	}
+}`
+
+	EsSchema[TableTransactions] = `{
+	"settings": {
+		"number_of_shards": 3,
+		"number_of_replicas": 1
+	},
+	"mappings": {
+		"properties": {
+			"block_number": {
+				"type": "long"
+			},
+			"block_timestamp": {
+				"type": "date",
+				"format": "epoch_millis"
+			},
+			"hash": {
+				"type": "keyword"
+			},
+			"tx_index": {
+				"type": "long"
+			},
+			"type": {
+				"type": "long"
+			},
+			"from": {
+				"type": "keyword"
+			},
+			"to": {
+				"type": "keyword"
+			},
+			"value": {
+				"type": "keyword"
+			},
+			"value_eth": {
+				"type": "scaled_float",
+				"scaling_factor": 1000000000
+			},
+			"nonce": {
+				"type": "long"
+			},
+			"gas_limit": {
+				"type": "long"
+			},
+			"gas_used": {
+				"type": "long"
+			},
+			"status": {
+				"type": "long"
+			},
+			"contract_address": {
+				"type": "keyword"
+			},
+			"effective_gas_price": {
+				"type": "keyword"
+			},
+			"blob_gas_used": {
+				"type": "long"
+			},
+			"blob_gas_price": {
+				"type": "keyword"
+			},
+			"base_fee": {
+				"type": "keyword"
+			},
+			"priority_fee": {
+				"type": "keyword"
+			},
+			"blob_fee": {
+				"type": "keyword"
+			},
+			"fee": {
+				"type": "keyword"
+			},
+			"fee_eth": {
+				"type": "scaled_float",
+				"scaling_factor": 1000000000
+			}
+		}
+	}
+}`
+
+	EsSchema[TableInternalTransactions] = `{
+	"settings": {
+		"number_of_shards": 3,
+		"number_of_replicas": 1
+	},
+	"mappings": {
+		"properties": {
+			"block_number": {
+				"type": "long"
+			},
+			"block_timestamp": {
+				"type": "date",
+				"format": "epoch_millis"
+			},
+			"txid": {
+				"type": "keyword"
+			},
+			"tx_index": {
+				"type": "long"
+			},
+			"trace_address": {
+				"type": "keyword"
+			},
+			"depth": {
+				"type": "long"
+			},
+			"type": {
+				"type": "keyword"
+			},
+			"call_type": {
+				"type": "keyword"
+			},
+			"from": {
+				"type": "keyword"
+			},
+			"to": {
+				"type": "keyword"
+			},
+			"value": {
+				"type": "keyword"
+			},
+			"value_eth": {
+				"type": "scaled_float",
+				"scaling_factor": 1000000000
+			},
+			"error": {
+				"type": "keyword"
+			},
+			"reverted": {
+				"type": "boolean"
+			}
+		}
+	}
+}`
+
+	EsSchema[TableTokenBalance] = `{
+	"settings": {
+		"number_of_shards": 3,
+		"number_of_replicas": 1
+	},
+	"mappings": {
+		"properties": {
+			"token": {
+				"type": "keyword"
+			},
+			"holder": {
+				"type": "keyword"
+			},
+			"block_number": {
+				"type": "long"
+			},
+			"block_timestamp": {
+				"type": "date",
+				"format": "epoch_millis"
+			},
+			"balance": {
+				"type": "keyword"
+			}
+		}
+	}
+}`
+
+	EsSchema[TableTokenBalanceHistory] = `{
+	"settings": {
+		"number_of_shards": 3,
+		"number_of_replicas": 1
+	},
+	"mappings": {
+		"properties": {
+			"token": {
+				"type": "keyword"
+			},
+			"account": {
+				"type": "keyword"
+			},
+			"block_number": {
+				"type": "long"
+			},
+			"block_timestamp": {
+				"type": "date",
+				"format": "epoch_millis"
+			},
+			"balance_before": {
+				"type": "keyword"
+			},
+			"balance_after": {
+				"type": "keyword"
+			},
+			"balance_change": {
+				"type": "keyword"
+			},
+			"direction": {
+				"type": "keyword"
+			},
+			"counterparty": {
+				"type": "keyword"
+			},
+			"txid": {
+				"type": "keyword"
+			},
+			"txindex": {
+				"type": "long"
+			},
+			"log_index": {
+				"type": "long"
+			}
+		}
+	}
+}`
+
+	EsSchema[TableNftOwner] = `{
+	"settings": {
+		"number_of_shards": 3,
+		"number_of_replicas": 1
+	},
+	"mappings": {
+		"properties": {
+			"contract": {
+				"type": "keyword"
+			},
+			"token_id": {
+				"type": "keyword"
+			},
+			"owner": {
+				"type": "keyword"
+			},
+			"block_number": {
+				"type": "long"
+			},
+			"block_timestamp": {
+				"type": "date",
+				"format": "epoch_millis"
+			}
+		}
+	}
+}`
+
+	EsSchema[TableNftHolding] = `{
+	"settings": {
+		"number_of_shards": 3,
+		"number_of_replicas": 1
+	},
+	"mappings": {
+		"properties": {
+			"contract": {
+				"type": "keyword"
+			},
+			"token_id": {
+				"type": "keyword"
+			},
+			"standard": {
+				"type": "keyword"
+			},
+			"holder": {
+				"type": "keyword"
+			},
+			"amount": {
+				"type": "keyword"
+			},
+			"block_number": {
+				"type": "long"
+			},
+			"block_timestamp": {
+				"type": "date",
+				"format": "epoch_millis"
+			}
+		}
+	}
+}`
+
+	EsSchema[TableNftTransfer] = `{
+	"settings": {
+		"number_of_shards": 3,
+		"number_of_replicas": 1
+	},
+	"mappings": {
+		"properties": {
+			"contract": {
+				"type": "keyword"
+			},
+			"token_id": {
+				"type": "keyword"
+			},
+			"standard": {
+				"type": "keyword"
+			},
+			"from": {
+				"type": "keyword"
+			},
+			"to": {
+				"type": "keyword"
+			},
+			"operator": {
+				"type": "keyword"
+			},
+			"amount": {
+				"type": "keyword"
+			},
+			"block_number": {
+				"type": "long"
+			},
+			"block_timestamp": {
+				"type": "date",
+				"format": "epoch_millis"
+			},
+			"txid": {
+				"type": "keyword"
+			},
+			"txindex": {
+				"type": "long"
+			},
+			"log_index": {
+				"type": "long"
+			},
+			"batch_index": {
+				"type": "long"
+			}
+		}
+	}
+}`
+
+	EsSchema[TableTokens] = `{
+	"settings": {
+		"number_of_shards": 1,
+		"number_of_replicas": 1
+	},
+	"mappings": {
+		"properties": {
+			"contract": {
+				"type": "keyword"
+			},
+			"standard": {
+				"type": "keyword"
+			},
+			"name": {
+				"type": "text",
+				"fields": {
+					"keyword": {
+						"type": "keyword",
+						"ignore_above": 256
+					}
+				}
+			},
+			"symbol": {
+				"type": "keyword"
+			},
+			"decimals": {
+				"type": "long"
+			},
+			"has_decimals": {
+				"type": "boolean"
+			},
+			"total_supply": {
+				"type": "keyword"
+			},
+			"block_number": {
+				"type": "long"
+			},
+			"block_timestamp": {
+				"type": "date",
+				"format": "epoch_millis"
+			}
+		}
+	}
+}`
+
+	EsSchema[TableBlockCommit] = `{
+	"settings": {
+		"number_of_shards": 1,
+		"number_of_replicas": 1
+	},
+	"mappings": {
+		"properties": {
+			"block_number": {
+				"type": "long"
+			},
+			"account_count": {
+				"type": "long"
+			},
+			"change_count": {
+				"type": "long"
+			},
+			"committed_time": {
+				"type": "date",
+				"format": "epoch_millis"
+			}
+		}
+	}
+}`
+
+	EsSchema[TableSchemaVersion] = `{
+	"settings": {
+		"number_of_shards": 1,
+		"number_of_replicas": 1
+	},
+	"mappings": {
+		"properties": {
+			"version": {
+				"type": "long"
+			},
+			"updated_time": {
+				"type": "date",
+				"format": "epoch_millis"
+			}
+		}
+	}
+}`
 }
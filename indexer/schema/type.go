@@ -14,3 +14,22 @@ const (
 	StakingSlashing
 	StakingWithdrawal
 )
+
+// direction of a balance change, a credit adds to the balance and a debit takes from it
+const (
+	DirectionCredit = "credit"
+	DirectionDebit  = "debit"
+)
+
+// status of a transaction receipt
+const (
+	TxStatusFailed  = 0
+	TxStatusSuccess = 1
+)
+
+// standard of a token contract
+const (
+	StandardERC20   = "erc20"
+	StandardERC721  = "erc721"
+	StandardERC1155 = "erc1155"
+)
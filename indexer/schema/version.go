@@ -0,0 +1,94 @@
+package schema
+
+// SchemaVersion is the version of the documents and mappings of this build, every entry of Migrations raises it
+const SchemaVersion = 8
+
+// SchemaInfoID is the id of the single document of TableSchemaVersion
+const SchemaInfoID = "schema"
+
+// SchemaInfo records the schema version the indices of a database hold
+type SchemaInfo struct {
+	*BaseEsType
+	Version     uint64 `json:"version" db:"version"`
+	UpdatedTime uint64 `json:"updated_time" db:"updated_time"`
+}
+
+// Migration turns the indices of the previous schema version into Version
+type Migration struct {
+	Version     uint64
+	Description string
+	// Reindex applies a migration incompatible with the existing mappings by reindexing into new indices.
+	// Other migrations create the new indices and put the new mappings in place.
+	Reindex bool
+	// Scripts update the documents of a table in place after the new mapping was put
+	Scripts map[string]MigrationScript
+}
+
+// MigrationScript is a painless script run on the documents of a table which lack Field
+type MigrationScript struct {
+	Field  string
+	Script string
+}
+
+// Migrations are ordered by version, version 0 is the schema of databases written before versions were recorded
+var Migrations = []Migration{
+	{
+		Version:     1,
+		Description: "numeric ether balances, signed deltas with direction, counterparty and trace path",
+		Scripts: map[string]MigrationScript{
+			TableAccountBalance: {
+				Field:  "balance_eth",
+				Script: `ctx._source.balance_eth = new BigDecimal(ctx._source.balance).movePointLeft(18).doubleValue();`,
+			},
+			// the counterparty of old history documents is unknown, the trace path is part of their id
+			TableBalanceChangeHistory: {
+				Field: "direction",
+				Script: `if (ctx._source.containsKey('change_balance')) {
+	ctx._source.remove('change_balance');
+}
+def before = new BigDecimal(ctx._source.balance_before);
+def after = new BigDecimal(ctx._source.balance_after);
+def delta = after.subtract(before);
+ctx._source.balance_change = delta.toPlainString();
+ctx._source.direction = delta.signum() < 0 ? 'debit' : 'credit';
+for (def field : ['balance_before', 'balance_after', 'balance_change']) {
+	ctx._source[field + '_eth'] = new BigDecimal(ctx._source[field]).movePointLeft(18).doubleValue();
+}
+def id = ctx._id.splitOnToken('_');
+if (id.length == 5) {
+	ctx._source.trace_path = id[2];
+}`,
+			},
+		},
+	},
+	{
+		Version:     2,
+		Description: "blocks index with header data and per block totals",
+	},
+	{
+		Version:     3,
+		Description: "transactions index with fee components and receipt status",
+	},
+	{
+		Version:     4,
+		Description: "internal transactions index of value transfers of sub calls",
+	},
+	{
+		Version:     5,
+		Description: "token balances and token balance change history of ERC-20 transfers",
+	},
+	{
+		Version:     6,
+		Description: "owners, holdings and transfer history of ERC-721 and ERC-1155 token ids",
+	},
+	{
+		Version:     7,
+		Description: "tokens index of the metadata of token contracts",
+	},
+	{
+		// the format of an existing date field cannot be changed in place
+		Version:     8,
+		Description: "block_timestamp dates of every index mapped as epoch_millis like the milliseconds written to them",
+		Reindex:     true,
+	},
+}
@@ -0,0 +1,212 @@
+package indexer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/rabbitprincess/eth-indexer/indexer/client"
+	"github.com/rabbitprincess/eth-indexer/indexer/db"
+	"github.com/rabbitprincess/eth-indexer/indexer/schema"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	// topic of Transfer(address,address,uint256), ERC-20 transfers index from and to, ERC-721 transfers also the token id
+	transferTopic = crypto.Keccak256Hash([]byte("Transfer(address,address,uint256)")).Hex()
+	zeroAddress   = "0x0000000000000000000000000000000000000000"
+)
+
+// tokenTransfer describes the value of a token moved by a single log
+type tokenTransfer struct {
+	token    string
+	from     string // the zero address for mints
+	to       string // the zero address for burns
+	value    *big.Int
+	txid     string
+	txIndex  uint64
+	logIndex uint64
+}
+
+// ApplyTokenTransfers applies the ERC-20 Transfer events of the current block's receipts to the token balances.
+// The committed balances of every touched holder are loaded from db in one round trip before the deltas are applied.
+func (d *DTO) ApplyTokenTransfers(receipts []*client.Receipt, dbController db.DbController, client *client.Client) error {
+	var transfers []*tokenTransfer
+	var ids []string
+	for _, receipt := range receipts {
+		for _, event := range receipt.Logs {
+			transfer := parseTokenTransfer(event)
+			if transfer == nil {
+				continue
+			}
+			transfers = append(transfers, transfer)
+			for _, holder := range []string{transfer.from, transfer.to} {
+				if holder != zeroAddress {
+					ids = append(ids, schema.TokenBalanceID(transfer.token, holder))
+				}
+			}
+		}
+	}
+	if len(transfers) == 0 {
+		return nil
+	}
+	committed, err := d.loadTokenBalances(ids, dbController)
+	if err != nil {
+		return err
+	}
+
+	for _, transfer := range transfers {
+		if transfer.from != zeroAddress {
+			err = d.addTokenDelta(transfer, transfer.from, transfer.to, new(big.Int).Neg(transfer.value), committed, client)
+			if err != nil {
+				return err
+			}
+		}
+		if transfer.to != zeroAddress {
+			err = d.addTokenDelta(transfer, transfer.to, transfer.from, transfer.value, committed, client)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// loadTokenBalances returns the committed token balances of ids which the current block did not touch yet
+func (d *DTO) loadTokenBalances(ids []string, dbController db.DbController) (map[string]*schema.TokenBalance, error) {
+	missing := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if _, exist := d.tokenBalance[id]; !exist {
+			missing = append(missing, id)
+		}
+	}
+	committed := make(map[string]*schema.TokenBalance, len(missing))
+	if len(missing) == 0 {
+		return committed, nil
+	}
+	docs, err := dbController.MultiGet(d.prefix+schema.TableTokenBalance, missing, schema.DocTypes[schema.TableTokenBalance])
+	if err != nil {
+		return nil, err
+	}
+	for _, doc := range docs {
+		balance := doc.(*schema.TokenBalance)
+		if !d.IsCommitted(balance.BlockNumber) {
+			continue // written by an incomplete block
+		}
+		committed[balance.GetID()] = balance
+	}
+	return committed, nil
+}
+
+// addTokenDelta adds a signed delta to the token balance of account and records the change against counterparty.
+// A balance neither touched nor committed is read from the token at the block before the current one, see contractBalance.
+func (d *DTO) addTokenDelta(transfer *tokenTransfer, account string, counterparty string, delta *big.Int, committed map[string]*schema.TokenBalance, client *client.Client) error {
+	id := schema.TokenBalanceID(transfer.token, account)
+	before, exist := d.tokenBalance[id]
+	if !exist {
+		before, exist = committed[id]
+	}
+	balanceBefore := new(big.Int)
+	if exist {
+		balanceBefore.SetString(before.Balance, 10)
+	} else if d.blockNumber > 0 {
+		balance, err := contractBalance(context.Background(), client, transfer.token, d.blockNumber-1, func(ctx context.Context) (*big.Int, error) {
+			return client.GetTokenBalance(ctx, transfer.token, account, d.blockNumber-1)
+		})
+		if err != nil {
+			return err
+		}
+		balanceBefore = balance
+	}
+	balanceAfter := new(big.Int).Add(balanceBefore, delta)
+
+	d.tokenBalance[id] = &schema.TokenBalance{
+		BaseEsType:     &schema.BaseEsType{Id: id},
+		Token:          transfer.token,
+		Holder:         account,
+		BlockNumber:    d.blockNumber,
+		BlockTimestamp: d.blockTimestamp,
+		Balance:        balanceAfter.String(),
+	}
+	change := &schema.TokenBalanceChangeHistory{
+		BaseEsType:     &schema.BaseEsType{Id: schema.TokenBalanceChangeID(d.blockNumber, transfer.logIndex, account)},
+		Token:          transfer.token,
+		Account:        account,
+		BlockNumber:    d.blockNumber,
+		BlockTimestamp: d.blockTimestamp,
+		Counterparty:   counterparty,
+		Txid:           transfer.txid,
+		TxIndex:        transfer.txIndex,
+		LogIndex:       transfer.logIndex,
+	}
+	change.SetBalances(balanceBefore.String(), balanceAfter.String(), delta.String())
+	d.tokenChange = append(d.tokenChange, change)
+	return nil
+}
+
+// contractBalance reads a balance of a token contract at the state after blockNumber with balanceOf. A contract without
+// code at blockNumber, like one created by the block after it, held nothing yet. A contract whose balanceOf reverts
+// or fails otherwise in execution, or returns no output, does not implement it. Its balance is counted as 0 rather
+// than halting the indexer.
+func contractBalance(ctx context.Context, c *client.Client, contract string, blockNumber uint64, balanceOf func(ctx context.Context) (*big.Int, error)) (*big.Int, error) {
+	hasCode, err := c.HasCode(ctx, contract, blockNumber)
+	if err != nil {
+		return nil, err
+	}
+	if !hasCode {
+		return new(big.Int), nil
+	}
+	balance, err := balanceOf(ctx)
+	if client.IsExecutionError(err) || errors.Is(err, client.ErrNoOutput) {
+		log.Warn().Err(err).Str("contract", contract).Uint64("blockNumber", blockNumber).Msg("contract has no balanceOf, counting its balance as 0")
+		return new(big.Int), nil
+	}
+	return balance, err
+}
+
+// VerifyTokenBalance compares the token balances touched by the current block with the balanceOf of their tokens
+func (d *DTO) VerifyTokenBalance(ctx context.Context, blockNumber uint64, client *client.Client) error {
+	for _, b := range d.tokenBalance {
+		verifyBalance, err := client.GetTokenBalance(ctx, b.Token, b.Holder, blockNumber)
+		if err != nil {
+			return err
+		}
+		if verifyBalance.String() != b.Balance {
+			log.Error().Uint64("blockNumber", blockNumber).Str("token", b.Token).Str("holder", b.Holder).Str("balance", b.Balance).Str("verifyBalance", verifyBalance.String()).Msg("token balance mismatch")
+			return fmt.Errorf("token %s balance of %s mismatch at block %d", b.Token, b.Holder, blockNumber)
+		}
+	}
+	return nil
+}
+
+// parseTokenTransfer returns the value transfer of an ERC-20 Transfer log, or nil if the log is none or moves no value
+func parseTokenTransfer(event *client.Log) *tokenTransfer {
+	if event.Removed || len(event.Topics) != 3 || !strings.EqualFold(event.Topics[0], transferTopic) || len(event.Data) != 32 {
+		return nil
+	}
+	transfer := &tokenTransfer{
+		token:    strings.ToLower(event.Address),
+		from:     topicAddress(event.Topics[1]),
+		to:       topicAddress(event.Topics[2]),
+		value:    new(big.Int).SetBytes(event.Data),
+		txid:     event.TransactionHash,
+		txIndex:  uint64(event.TransactionIndex),
+		logIndex: uint64(event.LogIndex),
+	}
+	if transfer.value.Sign() == 0 || transfer.from == transfer.to {
+		return nil
+	}
+	return transfer
+}
+
+// topicAddress returns the address of an indexed address topic
+func topicAddress(topic string) string {
+	topic = strings.ToLower(strings.TrimPrefix(topic, "0x"))
+	if len(topic) < 40 {
+		return zeroAddress
+	}
+	return "0x" + topic[len(topic)-40:]
+}
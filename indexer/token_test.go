@@ -0,0 +1,70 @@
+package indexer
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/rabbitprincess/eth-indexer/indexer/client"
+	"github.com/rabbitprincess/eth-indexer/indexer/db"
+	"github.com/rabbitprincess/eth-indexer/indexer/schema"
+	"github.com/stretchr/testify/require"
+)
+
+func transferLog(token string, from string, to string, value int64, logIndex uint64) *client.Log {
+	return &client.Log{
+		Address:         token,
+		Topics:          []string{transferTopic, common.HexToHash(from).Hex(), common.HexToHash(to).Hex()},
+		Data:            common.LeftPadBytes(big.NewInt(value).Bytes(), 32),
+		LogIndex:        hexutil.Uint64(logIndex),
+		TransactionHash: "0x01",
+	}
+}
+
+func TestDTOApplyTokenTransfers(t *testing.T) {
+	controller := db.NewMemoryDbController()
+	token, alice, bob := "0x00000000000000000000000000000000000000AA", "0x00000000000000000000000000000000000000a1", "0x00000000000000000000000000000000000000b0"
+	dto := &DTO{}
+	dto.Init(0, 0)
+	require.NoError(t, dto.ApplyTokenTransfers([]*client.Receipt{{Logs: []*client.Log{
+		transferLog(token, zeroAddress, alice, 1000, 0),
+		transferLog(token, zeroAddress, bob, 1, 1),
+	}}}, controller, nil))
+	require.NoError(t, dto.Commit(controller))
+
+	dto.Init(1, 12000)
+	nft := transferLog(token, alice, bob, 1, 2)
+	nft.Topics = append(nft.Topics, common.BigToHash(big.NewInt(7)).Hex())
+	removed := transferLog(token, alice, bob, 1, 3)
+	removed.Removed = true
+	require.NoError(t, dto.ApplyTokenTransfers([]*client.Receipt{{Logs: []*client.Log{
+		transferLog(token, alice, bob, 300, 0),
+		nft,     // erc-721 transfers index the token id
+		removed, // dropped by a reorg
+		transferLog(token, bob, zeroAddress, 1, 4),
+	}}}, controller, nil))
+	require.NoError(t, dto.Commit(controller))
+
+	docs, err := controller.MultiGet(schema.TableTokenBalance, []string{schema.TokenBalanceID(token, alice), schema.TokenBalanceID(token, bob), schema.TokenBalanceID(token, zeroAddress)}, schema.DocTypes[schema.TableTokenBalance])
+	require.NoError(t, err)
+	balances := map[string]string{}
+	for _, doc := range docs {
+		balances[doc.(*schema.TokenBalance).Holder] = doc.(*schema.TokenBalance).Balance
+	}
+	// the zero address of mints and burns holds no balance
+	require.Equal(t, map[string]string{alice: "700", bob: "300"}, balances)
+	require.EqualValues(t, 5, count(t, controller, schema.TableTokenBalanceHistory))
+
+	doc, err := controller.SelectOne(db.QueryParams{
+		IndexName: schema.TableTokenBalanceHistory,
+		Bool:      db.Filter(db.Match("account", bob), db.Match("direction", schema.DirectionDebit)),
+	}, schema.DocTypes[schema.TableTokenBalanceHistory])
+	require.NoError(t, err)
+	burn := doc.(*schema.TokenBalanceChangeHistory)
+	require.Equal(t, "-1", burn.BalanceChange)
+	require.Equal(t, "301", burn.BalanceBefore)
+	require.Equal(t, zeroAddress, burn.Counterparty)
+	require.EqualValues(t, 4, burn.LogIndex)
+	require.Equal(t, "0x00000000000000000000000000000000000000aa", burn.Token)
+}
@@ -0,0 +1,175 @@
+package indexer
+
+import (
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/rabbitprincess/eth-indexer/indexer/client"
+	"github.com/rabbitprincess/eth-indexer/indexer/db"
+	"github.com/rabbitprincess/eth-indexer/indexer/schema"
+)
+
+// traceTransfer describes the value moved by a single trace
+type traceTransfer struct {
+	from       string // empty for newly issued value
+	to         string
+	value      *big.Int
+	changeType schema.BalanceChange
+	tracePath  string
+}
+
+// ApplyTraces applies the value transfers of the current block's traces to the account balances.
+// Every touched account is prefetched from db in one round trip before the deltas are applied.
+func (d *DTO) ApplyTraces(traces []client.TraceBlock, dbController db.DbController, client *client.Client) error {
+	transfers := make([]*traceTransfer, len(traces))
+	accounts := make([]string, 0, len(traces)*2)
+	for idx := range traces {
+		transfer := parseTraceTransfer(&traces[idx], idx)
+		if transfer == nil {
+			continue
+		}
+		transfers[idx] = transfer
+		if transfer.from != "" {
+			accounts = append(accounts, transfer.from)
+		}
+		accounts = append(accounts, transfer.to)
+	}
+	err := d.PrefetchAccountBalance(accounts, dbController)
+	if err != nil {
+		return err
+	}
+
+	// value transfers of failed traces and their children are reverted
+	failed := failedTraces(traces)
+	for idx, transfer := range transfers {
+		trace := &traces[idx]
+		if transfer == nil || trace.Reverted(failed[trace.TransactionHash]) {
+			continue
+		}
+		if transfer.from != "" {
+			err = d.addBalanceDelta(transfer.from, transfer.to, new(big.Int).Neg(transfer.value), transfer.changeType, trace.TransactionHash, trace.TransactionPosition, transfer.tracePath, dbController, client)
+			if err != nil {
+				return err
+			}
+		}
+		err = d.addBalanceDelta(transfer.to, transfer.from, transfer.value, transfer.changeType, trace.TransactionHash, trace.TransactionPosition, transfer.tracePath, dbController, client)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddInternalTransactions records the value transfers of the sub calls of the current block's transactions,
+// transfers reverted by a failed trace are recorded with the error so that the attempt stays visible
+func (d *DTO) AddInternalTransactions(traces []client.TraceBlock) {
+	failed := failedTraces(traces)
+	for idx := range traces {
+		trace := &traces[idx]
+		if len(trace.TraceAddress) == 0 || trace.Type == client.TraceTypeReward {
+			continue
+		}
+		transfer := parseTraceTransfer(trace, idx)
+		if transfer == nil {
+			continue
+		}
+		internal := &schema.InternalTransaction{
+			BaseEsType:     &schema.BaseEsType{Id: schema.InternalTransactionID(d.blockNumber, trace.TransactionPosition, transfer.tracePath)},
+			BlockNumber:    d.blockNumber,
+			BlockTimestamp: d.blockTimestamp,
+			Txid:           trace.TransactionHash,
+			TxIndex:        trace.TransactionPosition,
+			TraceAddress:   transfer.tracePath,
+			Depth:          uint64(len(trace.TraceAddress)),
+			Type:           trace.Type,
+			CallType:       trace.Action.CallType,
+			From:           transfer.from,
+			To:             transfer.to,
+			Error:          trace.Error,
+			Reverted:       trace.Reverted(failed[trace.TransactionHash]),
+		}
+		internal.SetValue(transfer.value.String())
+		d.internalTransactions = append(d.internalTransactions, internal)
+	}
+}
+
+// failedTraces returns the paths of the failed traces by transaction hash
+func failedTraces(traces []client.TraceBlock) map[string]map[string]struct{} {
+	failed := make(map[string]map[string]struct{})
+	for idx := range traces {
+		trace := &traces[idx]
+		if trace.Error == "" {
+			continue
+		}
+		if failed[trace.TransactionHash] == nil {
+			failed[trace.TransactionHash] = make(map[string]struct{})
+		}
+		failed[trace.TransactionHash][trace.TracePath()] = struct{}{}
+	}
+	return failed
+}
+
+// addBalanceDelta adds a signed delta to the balance of account and records the change against counterparty
+func (d *DTO) addBalanceDelta(account string, counterparty string, delta *big.Int, changeType schema.BalanceChange, txid string, txIndex uint64, tracePath string, dbController db.DbController, client *client.Client) error {
+	before, err := d.GetAccountBalance(account, dbController, client)
+	if err != nil {
+		return err
+	}
+	balanceBefore, ok := new(big.Int).SetString(before.Balance, 10)
+	if !ok {
+		balanceBefore = new(big.Int)
+	}
+	balanceAfter := new(big.Int).Add(balanceBefore, delta)
+
+	d.AddAccountBalance(d.blockNumber, d.blockTimestamp, account, balanceAfter.String())
+	d.AddBalanceChange(d.blockNumber, d.blockTimestamp, account, counterparty, changeType, balanceBefore.String(), balanceAfter.String(), delta.String(), txid, txIndex, tracePath)
+	return nil
+}
+
+// parseTraceTransfer returns the value transfer of a trace, or nil if it does not move any value
+func parseTraceTransfer(trace *client.TraceBlock, idx int) *traceTransfer {
+	transfer := &traceTransfer{
+		tracePath:  trace.TracePath(),
+		changeType: schema.ContractCall,
+	}
+	if len(trace.TraceAddress) == 0 {
+		transfer.changeType = schema.Transfer
+	}
+
+	switch trace.Type {
+	case client.TraceTypeCall:
+		if trace.Action.CallType != "call" {
+			return nil // delegatecall, staticcall and callcode keep the value in the caller
+		}
+		transfer.from, transfer.to, transfer.value = trace.Action.From, trace.Action.To, parseHexBig(trace.Action.Value)
+	case client.TraceTypeCreate:
+		if trace.Result == nil {
+			return nil
+		}
+		transfer.from, transfer.to, transfer.value = trace.Action.From, trace.Result.Address, parseHexBig(trace.Action.Value)
+	case client.TraceTypeSuicide:
+		transfer.from, transfer.to, transfer.value = trace.Action.Address, trace.Action.RefundAddress, parseHexBig(trace.Action.Balance)
+		transfer.changeType = schema.ContractCall
+	case client.TraceTypeReward:
+		transfer.to, transfer.value = trace.Action.Author, parseHexBig(trace.Action.Value)
+		transfer.changeType = schema.MiningReward
+		transfer.tracePath = trace.Action.RewardType + "." + strconv.Itoa(idx)
+	default:
+		return nil
+	}
+
+	transfer.from, transfer.to = strings.ToLower(transfer.from), strings.ToLower(transfer.to)
+	if transfer.value.Sign() == 0 || transfer.to == "" || transfer.from == transfer.to {
+		return nil
+	}
+	return transfer
+}
+
+func parseHexBig(value string) *big.Int {
+	n, ok := new(big.Int).SetString(strings.TrimPrefix(value, "0x"), 16)
+	if !ok {
+		return new(big.Int)
+	}
+	return n
+}
@@ -0,0 +1,125 @@
+package indexer
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/rabbitprincess/eth-indexer/indexer/client"
+	"github.com/rabbitprincess/eth-indexer/indexer/db"
+	"github.com/rabbitprincess/eth-indexer/indexer/schema"
+)
+
+// AddTransactions records the transactions of the current block with the fees and outcome of their receipts.
+// Receipts before byzantium carry no status, the transaction failed if its top level trace did.
+func (d *DTO) AddTransactions(block *client.Block, receipts []*client.Receipt, traces []client.TraceBlock) error {
+	if len(receipts) != len(block.Transactions) {
+		return fmt.Errorf("block %d has %d transactions but %d receipts", d.blockNumber, len(block.Transactions), len(receipts))
+	}
+	failed := make(map[string]struct{})
+	for idx := range traces {
+		if trace := &traces[idx]; len(trace.TraceAddress) == 0 && trace.Error != "" {
+			failed[strings.ToLower(trace.TransactionHash)] = struct{}{}
+		}
+	}
+	baseFee := new(big.Int)
+	if block.BaseFeePerGas != nil {
+		baseFee = block.BaseFeePerGas.ToInt()
+	}
+
+	for idx, tx := range block.Transactions {
+		receipt := receipts[idx]
+		hash := strings.ToLower(tx.Hash)
+		if !strings.EqualFold(receipt.TransactionHash, hash) {
+			return fmt.Errorf("receipt %s does not belong to transaction %s", receipt.TransactionHash, hash)
+		}
+		transaction := &schema.Transaction{
+			BaseEsType:      &schema.BaseEsType{Id: schema.TransactionID(hash)},
+			BlockNumber:     d.blockNumber,
+			BlockTimestamp:  d.blockTimestamp,
+			Hash:            hash,
+			TxIndex:         uint64(tx.TransactionIndex),
+			Type:            uint64(tx.Type),
+			From:            strings.ToLower(tx.From),
+			To:              strings.ToLower(tx.To),
+			Nonce:           uint64(tx.Nonce),
+			GasLimit:        uint64(tx.Gas),
+			GasUsed:         uint64(receipt.GasUsed),
+			Status:          schema.TxStatusSuccess,
+			ContractAddress: strings.ToLower(receipt.ContractAddress),
+		}
+		transaction.SetValue(tx.Value.ToInt().String())
+		if receipt.Status != nil {
+			transaction.Status = uint64(*receipt.Status)
+		} else if _, ok := failed[hash]; ok {
+			transaction.Status = schema.TxStatusFailed
+		}
+
+		// receipts of old blocks may lack the effective gas price, which was the gas price before london
+		gasPrice := new(big.Int)
+		if receipt.EffectiveGasPrice != nil {
+			gasPrice = receipt.EffectiveGasPrice.ToInt()
+		} else if tx.GasPrice != nil {
+			gasPrice = tx.GasPrice.ToInt()
+		}
+		transaction.EffectiveGasPrice = gasPrice.String()
+
+		// the base fee is burnt and the rest of the gas price goes to the fee recipient
+		gasUsed := new(big.Int).SetUint64(transaction.GasUsed)
+		priorityPrice := new(big.Int).Sub(gasPrice, baseFee)
+		if priorityPrice.Sign() < 0 {
+			priorityPrice.SetUint64(0)
+		}
+		burnt := new(big.Int).Mul(new(big.Int).Sub(gasPrice, priorityPrice), gasUsed)
+		priorityFee := priorityPrice.Mul(priorityPrice, gasUsed)
+
+		// the blob gas price depends on the fork of the block, it is only taken from the receipt
+		blobFee := new(big.Int)
+		if receipt.BlobGasUsed != nil {
+			if receipt.BlobGasPrice == nil {
+				return fmt.Errorf("receipt %s has blob gas used but no blob gas price", receipt.TransactionHash)
+			}
+			transaction.BlobGasUsed = uint64(*receipt.BlobGasUsed)
+			blobPrice := receipt.BlobGasPrice.ToInt()
+			transaction.BlobGasPrice = blobPrice.String()
+			blobFee.Mul(blobPrice, new(big.Int).SetUint64(transaction.BlobGasUsed))
+		}
+		transaction.SetFees(burnt, priorityFee, blobFee)
+		d.transactions = append(d.transactions, transaction)
+	}
+	return nil
+}
+
+// ApplyFees debits the fees of the transactions recorded by AddTransactions from their senders and credits the
+// priority fees to the fee recipient of the block. The base fee and the blob fee are burnt.
+func (d *DTO) ApplyFees(block *client.Block, dbController db.DbController, client *client.Client) error {
+	feeRecipient := strings.ToLower(block.Miner)
+	accounts := make([]string, 0, len(d.transactions)+1)
+	for _, transaction := range d.transactions {
+		accounts = append(accounts, transaction.From)
+	}
+	err := d.PrefetchAccountBalance(append(accounts, feeRecipient), dbController)
+	if err != nil {
+		return err
+	}
+
+	for _, transaction := range d.transactions {
+		fee, _ := new(big.Int).SetString(transaction.Fee, 10)
+		if fee == nil || fee.Sign() == 0 {
+			continue
+		}
+		err = d.addBalanceDelta(transaction.From, feeRecipient, fee.Neg(fee), schema.FeeDeduction, transaction.Hash, transaction.TxIndex, "fee", dbController, client)
+		if err != nil {
+			return err
+		}
+		priorityFee, _ := new(big.Int).SetString(transaction.PriorityFee, 10)
+		if priorityFee == nil || priorityFee.Sign() == 0 {
+			continue
+		}
+		err = d.addBalanceDelta(feeRecipient, transaction.From, priorityFee, schema.MiningReward, transaction.Hash, transaction.TxIndex, "fee", dbController, client)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}